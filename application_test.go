@@ -39,7 +39,7 @@ func TestCreateNewApplicationFromRepo(t *testing.T) {
 		language := "go"
 		branch := "master"
 
-		imageName, imageID, err = c.CreateImage(creatorID, port, name, branch, tmpPath, language, nil)
+		imageName, imageID, err = c.CreateImage(creatorID, port, name, branch, tmpPath, language, DefaultLimits, nil)
 		if err != nil {
 			t.Fatalf("error has been generated: %s", err)
 		}
@@ -52,7 +52,7 @@ func TestCreateNewApplicationFromRepo(t *testing.T) {
 	// 	port := "8080"
 	// 	name := "test"
 	// 	language := "go"
-	// 	containerID, err = c.CreateNewApplicationFromRepo(creatorID, port, name, language, imageName)
+	// 	containerID, err = c.CreateNewApplicationFromRepo(creatorID, applicationContainerName(creatorID, name, language), imageName, DefaultLimits, DefaultRestartPolicy)
 	// 	if err != nil {
 	// 		t.Fatalf("error has been generated creating a container: %s", err)
 	// 	}
@@ -3,27 +3,33 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
+	"strconv"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/go-connections/nat"
+	"github.com/docker/docker/api/types/network"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type AppPost struct {
-	GithubRepoUrl string `json:"github-repo"`
-	GithubBranch  string `json:"github-branch"`
-	Language      string `json:"language"`
-	Port          string `json:"port"`
-	Description   string `json:"description,omitempty"`
-	Envs          []Env  `json:"envs,omitempty"`
+	GithubRepoUrl  string         `json:"github-repo"`
+	GithubBranch   string         `json:"github-branch"`
+	Language       string         `json:"language"`
+	Port           string         `json:"port"`
+	Description    string         `json:"description,omitempty"`
+	Envs           []Env          `json:"envs,omitempty"`
+	DockerfilePath string         `json:"dockerfile-path,omitempty"` //used by the dockerfile runtime, relative to the root of the repo
+	RestartPolicy  *RestartPolicy `json:"restart-policy,omitempty"`  //the default one is used if not set
+	HealthCheck    *HealthCheck   `json:"health-check,omitempty"`    //if not set the app is healthy when it accepts connections on the port
 }
 
 type Application struct {
-	ID             primitive.ObjectID `bson:"_id" json:"-"`
+	ID             primitive.ObjectID `bson:"_id" json:"id"`
 	ContainerID    string             `bson:"containerID" json:"containerID,omitempty"`
 	Status         string             `bson:"status" json:"status,omitempty"`
+	Health         string             `bson:"health,omitempty" json:"health,omitempty"`
 	StudentID      int                `bson:"studentID" json:"studentID,omitempty"`
 	Type           string             `bson:"type" json:"type,omitempty"`
 	Name           string             `bson:"name" json:"name,omitempty"`
@@ -32,66 +38,103 @@ type Application struct {
 	GithubBranch   string             `bson:"githubBranch,omitemtpy" json:"githubBranch,omitempty"`
 	LastCommitHash string             `bson:"lastCommitHash,omitemtpy" json:"lastCommitHash,omitempty"`
 	Port           string             `bson:"port" json:"port,omitempty"`
-	ExternalPort   string             `bson:"externalPort" json:"externalPort,omitempty"`
+	ExternalPort   string             `bson:"externalPort" json:"externalPort,omitempty"` //only for the databases and the applications created before the proxy
+	Slug           string             `bson:"slug,omitempty" json:"slug,omitempty"`       //name of the application in its url
+	URL            string             `bson:"url,omitempty" json:"url,omitempty"`         //url of the application on the proxy
 	Lang           string             `bson:"lang" json:"lang,omitempty"`
+	DockerfilePath string             `bson:"dockerfilePath,omitempty" json:"dockerfilePath,omitempty"`
 	CreatedAt      time.Time          `bson:"createdAt" json:"createdAt,omitempty"`
 	IsPublic       bool               `bson:"isPublic" json:"isPublic"`
 	IsUpdatable    bool               `bson:"isUpdatable,omitempty" json:"isUpdatable"`
 	Img            string             `bson:"img,omitempty" json:"img,omitempty"`
 	Envs           []Env              `bson:"envs,omitempty" json:"envs,omitempty"`
+	Links          []DatabaseLink     `bson:"links,omitempty" json:"links,omitempty"`   //databases whose connection envs are injected in the container
+	Volume         string             `bson:"volume,omitempty" json:"volume,omitempty"` //only for the databases, volume with their data
+	Limits         ResourceLimits     `bson:"limits,omitempty" json:"limits,omitempty"`
+	RestartPolicy  RestartPolicy      `bson:"restartPolicy,omitempty" json:"restartPolicy,omitempty"`
+	CrashLoop      *CrashLoop         `bson:"crashLoop,omitempty" json:"crashLoop,omitempty"`
+	UserStartedAt  *time.Time         `bson:"userStartedAt,omitempty" json:"userStartedAt,omitempty"` //last start or restart from the container api
+	HealthCheck    *HealthCheck       `bson:"healthCheck,omitempty" json:"healthCheck,omitempty"`
+	HealthResult   *HealthResult      `bson:"healthResult,omitempty" json:"healthResult,omitempty"`
 	Tags           []string           `bson:"tags,omitempty" json:"tags,omitempty"`
 	Stars          []string           `bson:"stars,omitempty" json:"stars,omitempty"`
 }
 
+// PublicApplication is what everyone can see of a public application, the other fields
+// of the application (envs, links, logs of the crashes, ...) are only returned to its owner
+type PublicApplication struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	GithubRepo   string   `json:"githubRepo,omitempty"`
+	URL          string   `json:"url,omitempty"`
+	ExternalPort string   `json:"externalPort,omitempty"` //only for the applications created before the proxy
+	Status       string   `json:"status,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Stars        []string `json:"stars,omitempty"`
+}
+
+// Public returns the public fields of the application
+func (a Application) Public() PublicApplication {
+	return PublicApplication{
+		Name:         a.Name,
+		Description:  a.Description,
+		GithubRepo:   a.GithubRepo,
+		URL:          a.URL,
+		ExternalPort: a.ExternalPort,
+		Status:       a.Status,
+		Tags:         a.Tags,
+		Stars:        a.Stars,
+	}
+}
+
+// Env is an environment variable of a container, the value is encrypted on the database
+// and the values of the secret ones are masked in the responses of the api (see envs.go)
 type Env struct {
-	Key   string `bson:"key" json:"key"`
-	Value string `bson:"value" json:"value"`
+	Key    string `bson:"key" json:"key"`
+	Value  string `bson:"value" json:"value"`
+	Secret bool   `bson:"secret,omitempty" json:"secret,omitempty"`
+}
+
+// applicationContainerName returns the name of the container of an application (<creatorID>-<name>-<language>)
+func applicationContainerName(creatorID int, name, language string) string {
+	return fmt.Sprintf("%d-%s-%s", creatorID, name, language)
 }
 
-// CreateNewApplicationFromRepo creates a container from an image which is the one created from a student's repository
-func (c ContainerController) CreateNewApplicationFromRepo(creatorID int, port, name, language, imageName string) (string, error) {
+// CreateNewApplicationFromRepo creates a container from an image which is the one created from a student's repository,
+// the envs are set on the container, it's limited by the given resource limits and restarted with the restart policy.
+// The container doesn't publish any port, it's attached to the network of the student and reached through the proxy
+func (c ContainerController) CreateNewApplicationFromRepo(creatorID int, containerName, imageName string, envs []Env, limits ResourceLimits, restartPolicy RestartPolicy) (string, error) {
 	//generic configs for the container
 	containerConfig := &container.Config{
 		Image: imageName,
+		Env:   EnvList(envs),
+		Labels: map[string]string{
+			ownerLabel: strconv.Itoa(creatorID),
+		},
 	}
 
-	// externalPort, err := getFreePort()
-	// if err != nil {
-	// 	return "", err
-	// }
-
-	//host bindings config, hostPort is not set cause the engine will assign a dinamyc one
-	hostBinding := nat.PortBinding{
-		HostIP: "0.0.0.0",
-		//HostPort is the port that the host will listen to, since it's not set
-		//the docker engine will assign a random open port
-		// HostPort: strconv.Itoa(externalPort),
+	//set the configuration of the host
+	//set the resource limits and the restart policy
+	hostConfig := &container.HostConfig{
+		Resources:     limits.HostResources(),
+		RestartPolicy: restartPolicy.OrDefault().Docker(),
 	}
 
-	//set the port for the container (internal one)
-	containerPort, err := nat.NewPort("tcp", port)
+	//the application is only attached to the network of the student, where the proxy
+	//reaches it and where it reaches the linked databases
+	studentNetwork, err := c.EnsureStudentNetwork(creatorID)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("error creating the network of the student: %v", err)
 	}
-
-	//set a slice of possible port bindings
-	//since it's a db container we need just one
-	portBinding := nat.PortMap{containerPort: []nat.PortBinding{hostBinding}}
-
-	//set the configuration of the host
-	//set the port bindings and the restart policy
-	//!choose a restart policy
-	hostConfig := &container.HostConfig{
-		PortBindings: portBinding,
-		// RestartPolicy: container.RestartPolicy{
-		// 	Name:              "on-failure",
-		// 	MaximumRetryCount: 3,
-		// },
+	networkConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			studentNetwork: {},
+		},
 	}
 
 	//create the container
 	containerBody, err := c.cli.ContainerCreate(c.ctx, containerConfig,
-		hostConfig, nil, nil, fmt.Sprintf("%d-%s-%s", creatorID, name, language))
+		hostConfig, networkConfig, nil, containerName)
 	if err != nil {
 		return "", err
 	}
@@ -99,6 +142,36 @@ func (c ContainerController) CreateNewApplicationFromRepo(creatorID int, port, n
 	return containerBody.ID, nil
 }
 
+// MoveToStudentNetworks attaches the containers created before the networks of the students (the databases on
+// the default bridge and the applications on the apps network) to the networks of their owners
+func (c ContainerController) MoveToStudentNetworks() error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	cur, err := db.Collection("applications").Find(context.TODO(), bson.M{"containerID": bson.M{"$ne": ""}})
+	if err != nil {
+		return err
+	}
+	var apps []Application
+	if err := cur.All(context.TODO(), &apps); err != nil {
+		return err
+	}
+	for _, app := range apps {
+		var aliases []string
+		if app.Type == "database" {
+			aliases = []string{databaseHostname(app)}
+		}
+		//a broken container doesn't stop the others from being moved
+		if err := c.MoveToStudentNetwork(app.ContainerID, app.StudentID, aliases...); err != nil {
+			log.Printf("[ERROR] can't move the container %s to the network of %d: %v", app.ContainerID, app.StudentID, err)
+		}
+	}
+	return nil
+}
+
 // GetAppInfoFromContainer returns the application metadata from the container id.
 // The parameter checkCommit will make the function check if the last commit changed, if so the application
 // returned will have isUpdatable set to true.
@@ -4,24 +4,26 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/docker/docker/api/types"
 	"github.com/gorilla/mux"
 	resp "github.com/vano2903/ipaas/responser"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/net/websocket"
 )
 
-// TODO: should delete the container/image in case of an error because it would stop the user to create again the application
 // new application handler let the user host a new application given:
 // 1) GitHub repository
-// 2) programming lang
-// 3) port of the program
+// 2) programming lang (can be empty or "auto" to detect it from the repo)
+// 3) port of the program (can be empty to use the default one of the lang)
+// the deploy is not done in the request, a job is queued and its id is returned
+// so the client can poll /api/app/jobs/{jobID} to follow the deploy
 // ! for now the only supported applications are web based one
 func (h Handler) NewApplicationHandler(w http.ResponseWriter, r *http.Request) {
 	//connect to the db
@@ -47,110 +49,221 @@ func (h Handler) NewApplicationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Println(appPost)
-
 	//check that the appPost.GithubRepo is an actual url
 	if err := h.util.ValidGithubUrl(appPost.GithubRepoUrl); err != nil {
 		resp.Error(w, http.StatusBadRequest, "Invalid github repo url")
 		return
 	}
 
-	//download the repo
-	repo, name, hash, err := h.util.DownloadGithubRepo(student.ID, appPost.GithubBranch, appPost.GithubRepoUrl)
-	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error downloading the repo, try again in one minute: %v", err.Error())
+	//check the language and the port before queueing the job,
+	//if the language is empty (or auto) it will be detected after cloning the repo
+	var runtime Runtime
+	if appPost.Language != "" && appPost.Language != AutoDetectLanguage {
+		var found bool
+		runtime, found = GetRuntime(appPost.Language)
+		if !found {
+			resp.Errorf(w, http.StatusBadRequest, "language %s not supported, the supported langs are: %v", appPost.Language, Langs)
+			return
+		}
+		if appPost.Port == "" {
+			appPost.Port = runtime.DefaultPort
+		}
+	}
+	if appPost.Port != "" {
+		if _, err := strconv.Atoi(appPost.Port); err != nil {
+			resp.Errorf(w, http.StatusBadRequest, "error converting the port to an int: %v", err.Error())
+			return
+		}
+	}
+	if err := ValidateEnvs(appPost.Envs); err != nil {
+		resp.Error(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	fmt.Println("repo: ", repo)
-	fmt.Println("name: ", name)
-	fmt.Println("hash: ", hash)
+	if appPost.RestartPolicy != nil {
+		if err := appPost.RestartPolicy.Validate(); err != nil {
+			resp.Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if appPost.HealthCheck != nil {
+		if err := appPost.HealthCheck.Validate(); err != nil {
+			resp.Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
 
-	//port to expose for the app
-	port, err := strconv.Atoi(appPost.Port)
-	if err != nil {
-		resp.Errorf(w, http.StatusBadRequest, "error converting the port to an int: %v", err.Error())
+	//check if the student can create another application, the runtime to detect is charged as the most expensive one
+	limits := GetResourceLimits(student, runtime.Limits)
+	if runtime.Lang == "" {
+		limits = MaxRuntimeLimits(student)
+	}
+	//the queued job is counted in the usage, so the lock is held until it's saved
+	unlock := h.cc.LockQuota(student.ID)
+	defer unlock()
+	if err := h.cc.CheckQuota(student, "web", limits.Memory, conn); err != nil {
+		if _, ok := err.(*QuotaError); ok {
+			resp.Error(w, http.StatusForbidden, err.Error())
+			return
+		}
+		resp.Errorf(w, http.StatusInternalServerError, "error checking the quota: %v", err.Error())
 		return
 	}
 
-	//create the image from the repo downloaded
-	imageName, imageID, err := h.cc.CreateImage(student.ID, port, name, appPost.GithubBranch, repo, appPost.Language, appPost.Envs)
+	//queue the deploy, the workers will do the rest
+	job, err := h.NewDeployJob(student.ID, appPost, limits)
 	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error creating the image: %v", err.Error())
+		resp.Errorf(w, http.StatusInternalServerError, "error queueing the deploy: %v", err.Error())
 		return
 	}
 
-	fmt.Println("name:", imageName)
-	fmt.Println("id:", imageID)
+	toSend := map[string]interface{}{
+		"jobID": job.ID.Hex(),
+		"phase": job.Phase,
+	}
+
+	resp.SuccessParse(w, http.StatusAccepted, "application deploy queued", toSend)
+}
+
+// returns the runtimes that can be used to deploy an application
+func (h Handler) GetRuntimesHandler(w http.ResponseWriter, r *http.Request) {
+	resp.SuccessParse(w, http.StatusOK, "supported runtimes", Runtimes)
+}
 
-	//create the container from the image just created
-	id, err := h.cc.CreateNewApplicationFromRepo(student.ID, appPost.Port, name, appPost.Language, imageName)
+// getOwnedDeployJob reads the {jobID} from the url and returns the job if the user in the cookies owns it,
+// in case of error the status code to respond with is returned too
+func (h Handler) getOwnedDeployJob(r *http.Request) (DeployJob, int, error) {
+	jobID, err := primitive.ObjectIDFromHex(mux.Vars(r)["jobID"])
 	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error creating the container: %v", err.Error())
-		return
+		return DeployJob{}, http.StatusBadRequest, fmt.Errorf("invalid job id")
 	}
 
-	//remove the image created
-	err = h.cc.RemoveImage(imageID)
+	//connect to the db
+	conn, err := connectToDB()
 	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error removing the image: %v", err.Error())
-		return
+		return DeployJob{}, http.StatusInternalServerError, fmt.Errorf("error connecting to the database: %v", err)
 	}
+	defer conn.Client().Disconnect(context.Background())
 
-	if err := h.cc.cli.ContainerStart(h.cc.ctx, id, types.ContainerStartOptions{}); err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error starting the container: %v", err.Error())
-		return
+	//get the student from the cookies
+	student, err := h.util.GetUserFromCookie(r, conn)
+	if err != nil {
+		return DeployJob{}, http.StatusInternalServerError, fmt.Errorf("error getting the user from cookies: %v", err)
+	}
+
+	job, err := GetDeployJob(jobID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return DeployJob{}, http.StatusNotFound, fmt.Errorf("there is no job with this id")
+		}
+		return DeployJob{}, http.StatusInternalServerError, fmt.Errorf("error getting the job from the database: %v", err)
 	}
 
-	//remove the repo after creating the application
-	err = os.RemoveAll(repo)
+	if job.StudentID != student.ID {
+		return DeployJob{}, http.StatusForbidden, fmt.Errorf("you don't have permission to see this job")
+	}
+	return job, http.StatusOK, nil
+}
+
+// returns the status of a deploy job given the job id, only the owner of the job can see it
+func (h Handler) GetDeployJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, code, err := h.getOwnedDeployJob(r)
 	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error removing the repo: %v", err)
+		resp.Error(w, code, err.Error())
 		return
 	}
 
-	exernalPort, err := h.cc.GetContainerExternalPort(id, appPost.Port)
+	resp.SuccessParse(w, http.StatusOK, "deploy job", job)
+}
+
+// returns the build log of a deploy job, if the job is still running the lines written so far are returned
+func (h Handler) GetDeployJobLogsHandler(w http.ResponseWriter, r *http.Request) {
+	job, code, err := h.getOwnedDeployJob(r)
 	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error getting the external port: %v", err.Error())
+		resp.Error(w, code, err.Error())
 		return
 	}
 
-	//get the status of the application
-	status, err := h.cc.GetContainerStatus(id)
+	lines := job.Log
+	if buildLog := h.buildLogs.Get(job.ID.Hex()); buildLog != nil {
+		lines = buildLog.Lines()
+	}
+
+	toSend := map[string]interface{}{
+		"phase": job.Phase,
+		"log":   lines,
+	}
+	resp.SuccessParse(w, http.StatusOK, "deploy job log", toSend)
+}
+
+// streams the build log of a deploy job with server sent events, every line is sent as a message
+// and an "end" event is sent when the job is finished (with the phase as data)
+func (h Handler) StreamDeployJobLogsHandler(w http.ResponseWriter, r *http.Request) {
+	job, code, err := h.getOwnedDeployJob(r)
 	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error getting the status of the container: %v", err.Error())
+		resp.Error(w, code, err.Error())
 		return
 	}
-	fmt.Println("status:", status)
 
-	var app Application
-	app.ID = primitive.NewObjectID()
-	app.ContainerID = id
-	app.Status = status
-	app.StudentID = student.ID
-	app.Type = "web"
-	app.Name = imageName
-	app.Description = appPost.Description
-	app.GithubRepo = appPost.GithubRepoUrl
-	app.LastCommitHash = hash
-	app.Port = appPost.Port
-	app.Lang = appPost.Language
-	app.ExternalPort = exernalPort
-	app.CreatedAt = time.Now()
-	app.Envs = appPost.Envs
-
-	//insert the application in the database
-	_, err = conn.Collection("applications").InsertOne(context.Background(), app)
-	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error inserting the application in the database: %v", err.Error())
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		resp.Error(w, http.StatusInternalServerError, "streaming is not supported")
 		return
 	}
-	toSend := map[string]interface{}{
-		"container id":  id,
-		"external_port": os.Getenv("IP") + ":" + exernalPort,
-		"status":        status,
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	buildLog := h.buildLogs.Get(job.ID.Hex())
+	if buildLog == nil {
+		//the build is not running, send the saved log (the job could still be in the queue)
+		for _, line := range job.Log {
+			writeEvent(w, "", line)
+		}
+		if job.IsFinished() {
+			writeEvent(w, "end", job.Phase)
+		}
+		flusher.Flush()
+		return
 	}
 
-	resp.SuccessParse(w, http.StatusOK, "application created", toSend)
+	backlog, sub := buildLog.Subscribe()
+	defer func() { buildLog.Unsubscribe(sub) }()
+	for _, line := range backlog {
+		writeEvent(w, "", line)
+	}
+	sent := len(backlog)
+	flusher.Flush()
+
+	for {
+		select {
+		case line, ok := <-sub:
+			if !ok && buildLog.Dropped(sub) {
+				//the client is too slow, the lines it missed are taken from the log
+				backlog, sub = buildLog.Subscribe()
+				for _, line := range backlog[sent:] {
+					writeEvent(w, "", line)
+				}
+				sent = len(backlog)
+				flusher.Flush()
+				continue
+			}
+			if !ok {
+				//the build finished, send the final phase
+				if job, err := GetDeployJob(job.ID); err == nil {
+					writeEvent(w, "end", job.Phase)
+					flusher.Flush()
+				}
+				return
+			}
+			writeEvent(w, "", line)
+			sent++
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
 }
 
 // delete a container given the container id, it will check if the user owns this application
@@ -201,17 +314,45 @@ func (h Handler) DeleteApplicationHandler(w http.ResponseWriter, r *http.Request
 		resp.Errorf(w, http.StatusInternalServerError, "error deleting the application: %v", err.Error())
 		return
 	}
+	//the data of a database is removed only when it's deleted
+	if app.Volume != "" {
+		if _, err := h.cc.RemoveVolume(app.Volume); err != nil {
+			log.Printf("[ERROR] can't remove the volume %s of database %s: %v", app.Volume, app.ID.Hex(), err)
+		}
+	}
+	if err := h.cc.RemoveStudentNetworkIfUnused(app.StudentID); err != nil {
+		log.Printf("[ERROR] can't remove the network of student %d: %v", app.StudentID, err)
+	}
+
+	//the images of the releases are not needed anymore
+	if err := h.removeReleases(app.ID, conn); err != nil {
+		log.Printf("[ERROR] can't remove the releases of application %s: %v", app.ID.Hex(), err)
+	}
+	if _, err := conn.Collection("appEvents").DeleteMany(context.Background(), bson.M{"applicationID": app.ID}); err != nil {
+		log.Printf("[ERROR] can't remove the events of application %s: %v", app.ID.Hex(), err)
+	}
+	if _, err := conn.Collection("domains").DeleteMany(context.Background(), bson.M{"applicationID": app.ID}); err != nil {
+		log.Printf("[ERROR] can't remove the domains of application %s: %v", app.ID.Hex(), err)
+	}
+	if _, err := conn.Collection("metrics").DeleteMany(context.Background(), bson.M{"applicationID": app.ID}); err != nil {
+		log.Printf("[ERROR] can't remove the metrics of application %s: %v", app.ID.Hex(), err)
+	}
+	//the applications linked to a deleted database don't get its envs anymore, their containers are recreated without them
+	h.updateLinkedApplications(app.ID, conn)
+	if _, err := applicationCollection.UpdateMany(context.Background(), bson.M{"links.databaseID": app.ID}, bson.M{"$pull": bson.M{"links": bson.M{"databaseID": app.ID}}}); err != nil {
+		log.Printf("[ERROR] can't remove the links to database %s: %v", app.ID.Hex(), err)
+	}
+	if err := h.proxy.Refresh(); err != nil {
+		log.Printf("[ERROR] Error refreshing the proxy routes: %v", err)
+	}
 	resp.Success(w, http.StatusOK, "container deleted successfully")
 }
 
-// !hold the port for the new container
-// !don't use a different one
-// *1) delete the old container
-// *2) download the repo from GitHub
-// *3) build the image
-// *4) create the new container
-// *5) cleanups
-// ! should delete old container lastly, but I have to change the way I create images
+// queue the update of an application if the last commit of its branch changed, the update job will:
+// *1) download the repo from GitHub and build the image
+// *2) start the new container next to the old one and wait for it to be healthy
+// *3) send the requests to the new container through the proxy and remove the old one
+// if the new version fails the old container keeps running
 func (h Handler) UpdateApplicationHandler(w http.ResponseWriter, r *http.Request) {
 	//get the container from /{containerID}
 	containerID := mux.Vars(r)["containerID"]
@@ -245,12 +386,12 @@ func (h Handler) UpdateApplicationHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	if app.StudentID != student.ID {
-		resp.Errorf(w, http.StatusForbidden, "you don't have permission to delete this application")
+		resp.Errorf(w, http.StatusForbidden, "you don't have permission to update this application")
 		return
 	}
 
 	//check if the commit has changed
-	changed, err := h.util.HasLastCommitChanged(app.LastCommitHash, app.GithubRepo, "") //app.GithubBranch)
+	changed, err := h.util.HasLastCommitChanged(app.LastCommitHash, app.GithubRepo, app.GithubBranch)
 	if err != nil {
 		resp.Errorf(w, http.StatusInternalServerError, "error checking if the commit has changed: %v", err.Error())
 		return
@@ -261,95 +402,30 @@ func (h Handler) UpdateApplicationHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	//download the repo
-	//TODO: implement the branch
-	repo, name, hash, err := h.util.DownloadGithubRepo(student.ID, "", app.GithubRepo)
-	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error downloading the repo, try again in one minute: %v", err.Error())
-		return
-	}
-
-	//port to expose for the app
-	Intport, err := strconv.Atoi(app.Port)
-	if err != nil {
-		resp.Errorf(w, http.StatusBadRequest, "error converting the port to an int: %v", err.Error())
-		return
-	}
-
-	//delete the container
-	err = h.cc.DeleteContainer(containerID)
-	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error deleting the container: %v", err.Error())
-		return
-	}
-
-	//create the image from the repo downloaded
-	imageName, _, err := h.cc.CreateImage(student.ID, Intport, name, repo, app.GithubBranch, app.Lang, app.Envs)
-	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error creating the image: %v", err.Error())
-		return
-	}
-
-	//create the container from the image just created
-	newContainerID, err := h.cc.CreateNewApplicationFromRepo(student.ID, app.Port, name, app.Lang, imageName)
+	//only one update at a time can replace the container
+	updating, err := hasRunningJob(app.ID, conn)
 	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error creating the container: %v", err.Error())
+		resp.Errorf(w, http.StatusInternalServerError, "error checking the updates of the application: %v", err.Error())
 		return
 	}
-
-	//remove the repo after creating the application
-	err = os.RemoveAll(repo)
-	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error removing the repo: %v", err)
-		return
-	}
-
-	//!remove the image created
-	//!not implemented for now
-	// err = h.cc.RemoveImage(imageID)
-	// if err != nil {
-	// 	resp.Errorf(w, http.StatusInternalServerError, "error removing the image: %v", err.Error())
-	// 	return
-	// }
-
-	if err := h.cc.cli.ContainerStart(h.cc.ctx, newContainerID, types.ContainerStartOptions{}); err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error starting the container: %v", err.Error())
-		return
-	}
-
-	exernalPort, err := h.cc.GetContainerExternalPort(newContainerID, app.Port)
-	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error getting the external port: %v", err.Error())
-		return
-	}
-
-	//get the status of the application
-	status, err := h.cc.GetContainerStatus(newContainerID)
-	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error getting the status of the container: %v", err.Error())
+	if updating {
+		resp.Error(w, http.StatusConflict, "the application is already being updated")
 		return
 	}
-	fmt.Println("status:", status)
 
-	//update the application in the database
-	app.LastCommitHash = hash
-	app.ExternalPort = exernalPort
-	app.Status = status
-	app.ContainerID = newContainerID
-
-	_, err = applicationCollection.UpdateOne(context.Background(), bson.M{"_id": app.ID}, bson.M{"$set": app})
+	//queue the update, the old container keeps running until the new one is healthy
+	job, err := h.NewUpdateJob(student.ID, app.ID)
 	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error updating application: %v", err.Error())
+		resp.Errorf(w, http.StatusInternalServerError, "error queueing the update: %v", err.Error())
 		return
 	}
 
 	toSend := map[string]interface{}{
-		"container id":  newContainerID,
-		"external port": os.Getenv("IP") + ":" + exernalPort,
-		"status":        status,
+		"jobID": job.ID.Hex(),
+		"phase": job.Phase,
 	}
 
-	resp.SuccessParse(w, http.StatusOK, "application updated", toSend)
+	resp.SuccessParse(w, http.StatusAccepted, "application update queued", toSend)
 }
 
 // it will return a json with all the applications owned by the student (even the privates one)
@@ -422,7 +498,6 @@ func (h Handler) GetAllApplicationsOfStudentPrivate(w http.ResponseWriter, r *ht
 			}
 		}
 		if onlyUpdatable {
-			fmt.Printf("app %s is updatable: %v\n", app.Name, app.IsUpdatable)
 			if !app.IsUpdatable {
 				continue
 			}
@@ -469,7 +544,12 @@ func (h Handler) GetAllApplicationsOfStudentPublic(w http.ResponseWriter, r *htt
 		resp.Errorf(w, http.StatusInternalServerError, "error getting the applications: %v", err.Error())
 		return
 	}
-	resp.SuccessParse(w, http.StatusOK, fmt.Sprintf("Public applications of %d", studentID), apps)
+	//the endpoint doesn't need a login, only the public fields are returned
+	var public []PublicApplication
+	for _, app := range apps {
+		public = append(public, app.Public())
+	}
+	resp.SuccessParse(w, http.StatusOK, fmt.Sprintf("Public applications of %d", studentID), public)
 }
 
 func (h Handler) PublishApplicationHandler(w http.ResponseWriter, r *http.Request) {
@@ -534,3 +614,1041 @@ func (h Handler) RevokeApplicationHandler(w http.ResponseWriter, r *http.Request
 	}
 	resp.Success(w, http.StatusOK, "Application is now private")
 }
+
+// getOwnedApplication returns the application with the {containerID} of the url if it's owned by the student
+// who made the request, the status code to send is returned with the error
+func (h Handler) getOwnedApplication(r *http.Request, conn *mongo.Database) (Application, int, error) {
+	filter := bson.M{"containerID": mux.Vars(r)["containerID"]}
+	//the routes that must keep working across the deploys (they replace the container) use the id of the application
+	if id, found := mux.Vars(r)["applicationID"]; found {
+		applicationID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return Application{}, http.StatusBadRequest, fmt.Errorf("invalid application id")
+		}
+		filter = bson.M{"_id": applicationID}
+	}
+
+	//get the student from the cookies
+	student, err := h.util.GetUserFromCookie(r, conn)
+	if err != nil {
+		return Application{}, http.StatusInternalServerError, fmt.Errorf("error getting the user from cookies: %v", err)
+	}
+
+	var app Application
+	err = conn.Collection("applications").FindOne(context.Background(), filter).Decode(&app)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Application{}, http.StatusBadRequest, fmt.Errorf("there is no application with this id")
+		}
+		return Application{}, http.StatusInternalServerError, fmt.Errorf("error getting the application from the database: %v", err)
+	}
+
+	if app.StudentID != student.ID {
+		return Application{}, http.StatusForbidden, fmt.Errorf("you don't have permission to access this application")
+	}
+	return app, http.StatusOK, nil
+}
+
+// returns the releases of an application, the newest first
+func (h Handler) GetReleasesHandler(w http.ResponseWriter, r *http.Request) {
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+
+	releases, err := GetReleases(app.ID, conn)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error getting the releases: %v", err.Error())
+		return
+	}
+
+	resp.SuccessParse(w, http.StatusOK, "releases", releases)
+}
+
+// queue the rollback of an application to the release {releaseID}, the image of the release is used
+// so the application is not rebuilt. The rollback is a blue/green deploy like the updates
+func (h Handler) RollbackApplicationHandler(w http.ResponseWriter, r *http.Request) {
+	releaseID, err := primitive.ObjectIDFromHex(mux.Vars(r)["releaseID"])
+	if err != nil {
+		resp.Error(w, http.StatusBadRequest, "invalid release id")
+		return
+	}
+
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+
+	var release Release
+	err = conn.Collection("releases").FindOne(context.Background(), bson.M{"_id": releaseID, "applicationID": app.ID}).Decode(&release)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			resp.Error(w, http.StatusNotFound, "there is no release with this id")
+			return
+		}
+		resp.Errorf(w, http.StatusInternalServerError, "error getting the release from the database: %v", err.Error())
+		return
+	}
+	if release.Pruned {
+		resp.Errorf(w, http.StatusGone, "the image of this release was removed, only the last %d releases can be rolled back", h.releasesToKeep)
+		return
+	}
+
+	//only one update at a time can replace the container
+	updating, err := hasRunningJob(app.ID, conn)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error checking the updates of the application: %v", err.Error())
+		return
+	}
+	if updating {
+		resp.Error(w, http.StatusConflict, "the application is already being updated")
+		return
+	}
+
+	job, err := h.NewRollbackJob(app.StudentID, app.ID, release.ID)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error queueing the rollback: %v", err.Error())
+		return
+	}
+
+	toSend := map[string]interface{}{
+		"jobID": job.ID.Hex(),
+		"phase": job.Phase,
+	}
+
+	resp.SuccessParse(w, http.StatusAccepted, "application rollback queued", toSend)
+}
+
+// returns the timeline of the events of an application (start, die, oom, health changes), the newest first.
+// The number of events can be set with ?limit= (default 100)
+func (h Handler) GetAppEventsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := int64(100)
+	if l := r.URL.Query().Get("limit"); l != "" {
+		parsed, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || parsed <= 0 {
+			resp.Error(w, http.StatusBadRequest, "the limit must be a positive number")
+			return
+		}
+		limit = parsed
+	}
+
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+
+	appEvents, err := GetAppEvents(app.ID, limit, conn)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error getting the events: %v", err.Error())
+		return
+	}
+
+	toSend := map[string]interface{}{
+		"status": app.Status,
+		"health": app.Health,
+		"events": appEvents,
+	}
+
+	resp.SuccessParse(w, http.StatusOK, "application events", toSend)
+}
+
+// change the restart policy of an application, the body is the new policy ({"name": "on-failure", "maxRetries": 3}).
+// The container is updated without being recreated
+func (h Handler) UpdateRestartPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var policy RestartPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "error decoding the json: %v", err.Error())
+		return
+	}
+	if err := policy.Validate(); err != nil {
+		resp.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+	if app.Type != "web" {
+		resp.Error(w, http.StatusBadRequest, "the restart policy can only be changed for web applications")
+		return
+	}
+
+	if err := h.cc.SetRestartPolicy(app.ContainerID, policy); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error updating the container: %v", err.Error())
+		return
+	}
+
+	if _, err := conn.Collection("applications").UpdateOne(context.Background(), bson.M{"_id": app.ID}, bson.M{"$set": bson.M{"restartPolicy": policy}}); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error updating the application: %v", err.Error())
+		return
+	}
+
+	resp.SuccessParse(w, http.StatusOK, "restart policy updated", policy)
+}
+
+// set the health check of an application (PUT with the health check as body) or remove it (DELETE),
+// without a health check the application is healthy when it accepts connections on its port
+func (h Handler) UpdateHealthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	var check HealthCheck
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&check); err != nil {
+			resp.Errorf(w, http.StatusBadRequest, "error decoding the json: %v", err.Error())
+			return
+		}
+		if err := check.Validate(); err != nil {
+			resp.Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+	if app.Type != "web" {
+		resp.Error(w, http.StatusBadRequest, "the health check can only be set for web applications")
+		return
+	}
+
+	update := bson.M{"$unset": bson.M{"healthCheck": "", "healthResult": ""}}
+	if r.Method == http.MethodPut {
+		update = bson.M{"$set": bson.M{"healthCheck": check}, "$unset": bson.M{"healthResult": ""}}
+	}
+	if _, err := conn.Collection("applications").UpdateOne(context.Background(), bson.M{"_id": app.ID}, update); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error updating the application: %v", err.Error())
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		resp.SuccessParse(w, http.StatusOK, "health check updated", check)
+		return
+	}
+	resp.Success(w, http.StatusOK, "health check removed")
+}
+
+// getAppDomain returns the custom domain /{domainID} of the application
+func getAppDomain(r *http.Request, app Application, conn *mongo.Database) (CustomDomain, int, error) {
+	domainID, err := primitive.ObjectIDFromHex(mux.Vars(r)["domainID"])
+	if err != nil {
+		return CustomDomain{}, http.StatusBadRequest, fmt.Errorf("invalid domain id")
+	}
+
+	var domain CustomDomain
+	err = conn.Collection("domains").FindOne(context.Background(), bson.M{"_id": domainID, "applicationID": app.ID}).Decode(&domain)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return CustomDomain{}, http.StatusNotFound, fmt.Errorf("the application has no domain with this id")
+		}
+		return CustomDomain{}, http.StatusInternalServerError, fmt.Errorf("error getting the domain from the database: %v", err)
+	}
+	return domain, http.StatusOK, nil
+}
+
+// returns the custom domains of an application with their verification status
+func (h Handler) GetDomainsHandler(w http.ResponseWriter, r *http.Request) {
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+
+	domains, err := GetDomains(app.ID, conn)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error getting the domains: %v", err.Error())
+		return
+	}
+	resp.SuccessParse(w, http.StatusOK, "domains of the application", domains)
+}
+
+// attaches a custom domain to an application, the domain is routed only after its verification
+// so the response has the token and the instructions to verify it
+func (h Handler) AddDomainHandler(w http.ResponseWriter, r *http.Request) {
+	var post struct {
+		Hostname string `json:"hostname"`
+		Method   string `json:"method"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "error decoding the json: %v", err.Error())
+		return
+	}
+	if post.Method == "" {
+		post.Method = DomainVerificationTXT
+	}
+	if post.Method != DomainVerificationTXT {
+		resp.Errorf(w, http.StatusBadRequest, "invalid verification method %q, the domains are verified with a %s record", post.Method, DomainVerificationTXT)
+		return
+	}
+	hostname, err := NormalizeHostname(post.Hostname, h.proxy.ReservedHosts())
+	if err != nil {
+		resp.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+	if app.Type != "web" {
+		resp.Error(w, http.StatusBadRequest, "custom domains can only be attached to web applications")
+		return
+	}
+
+	taken, err := isHostnameTaken(hostname, conn)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error checking the domain: %v", err.Error())
+		return
+	}
+	if taken {
+		resp.Errorf(w, http.StatusConflict, "%s is already used by another application", hostname)
+		return
+	}
+	attached, err := conn.Collection("domains").CountDocuments(context.Background(), bson.M{"applicationID": app.ID, "hostname": hostname})
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error checking the domain: %v", err.Error())
+		return
+	}
+	if attached > 0 {
+		resp.Errorf(w, http.StatusConflict, "%s is already attached to the application", hostname)
+		return
+	}
+
+	token, err := newDomainToken()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error generating the verification token: %v", err.Error())
+		return
+	}
+	domain := CustomDomain{
+		ID:            primitive.NewObjectID(),
+		ApplicationID: app.ID,
+		StudentID:     app.StudentID,
+		Hostname:      hostname,
+		Method:        post.Method,
+		Token:         token,
+		CreatedAt:     time.Now(),
+	}
+	if _, err := conn.Collection("domains").InsertOne(context.Background(), domain); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error saving the domain: %v", err.Error())
+		return
+	}
+	resp.SuccessParse(w, http.StatusCreated, domain.Instructions(), domain)
+}
+
+// checks the token of a custom domain and, if it's published, starts routing the domain to the application
+func (h Handler) VerifyDomainHandler(w http.ResponseWriter, r *http.Request) {
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+	domain, code, err := getAppDomain(r, app, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+	if domain.Verified {
+		resp.SuccessParse(w, http.StatusOK, "domain already verified", domain)
+		return
+	}
+
+	taken, err := isHostnameTaken(domain.Hostname, conn)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error checking the domain: %v", err.Error())
+		return
+	}
+	if taken {
+		resp.Errorf(w, http.StatusConflict, "%s has been verified by another application", domain.Hostname)
+		return
+	}
+
+	if err := h.domainVerifier.Verify(domain); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "verification failed: %v", err.Error())
+		return
+	}
+
+	now := time.Now()
+	domain.Verified = true
+	domain.VerifiedAt = &now
+	if _, err := conn.Collection("domains").UpdateOne(context.Background(), bson.M{"_id": domain.ID}, bson.M{"$set": bson.M{
+		"verified":   true,
+		"verifiedAt": now,
+	}}); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error updating the domain: %v", err.Error())
+		return
+	}
+	//the other applications waiting to verify the same hostname can't anymore
+	if _, err := conn.Collection("domains").DeleteMany(context.Background(), bson.M{"hostname": domain.Hostname, "verified": false}); err != nil {
+		log.Printf("[ERROR] can't remove the pending verifications of %s: %v", domain.Hostname, err)
+	}
+
+	if err := h.proxy.Refresh(); err != nil {
+		log.Printf("[ERROR] Error refreshing the proxy routes: %v", err)
+	}
+	resp.SuccessParse(w, http.StatusOK, "domain verified", domain)
+}
+
+// uploads the certificate and the key of a verified custom domain, the proxy uses them to terminate the tls
+func (h Handler) UploadDomainCertificateHandler(w http.ResponseWriter, r *http.Request) {
+	var cert DomainCertificate
+	if err := json.NewDecoder(r.Body).Decode(&cert); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "error decoding the json: %v", err.Error())
+		return
+	}
+
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+	domain, code, err := getAppDomain(r, app, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+	if !domain.Verified {
+		resp.Error(w, http.StatusBadRequest, "the domain must be verified before uploading its certificate")
+		return
+	}
+
+	expiry, err := ParseDomainCertificate(cert, domain.Hostname)
+	if err != nil {
+		resp.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	domain.CertExpiry = &expiry
+	//the private key is saved encrypted, like the other secrets
+	key, err := secretStore.Encrypt(cert.Key)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error encrypting the key: %v", err.Error())
+		return
+	}
+	if _, err := conn.Collection("domains").UpdateOne(context.Background(), bson.M{"_id": domain.ID}, bson.M{"$set": bson.M{
+		"certificate": cert.Certificate,
+		"key":         key,
+		"certExpiry":  expiry,
+	}}); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error updating the domain: %v", err.Error())
+		return
+	}
+
+	if err := h.proxy.Refresh(); err != nil {
+		log.Printf("[ERROR] Error refreshing the proxy routes: %v", err)
+	}
+	resp.SuccessParse(w, http.StatusOK, "certificate uploaded", domain)
+}
+
+// detaches a custom domain from an application
+func (h Handler) DeleteDomainHandler(w http.ResponseWriter, r *http.Request) {
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+	domain, code, err := getAppDomain(r, app, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+
+	if _, err := conn.Collection("domains").DeleteOne(context.Background(), bson.M{"_id": domain.ID}); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error deleting the domain: %v", err.Error())
+		return
+	}
+
+	if err := h.proxy.Refresh(); err != nil {
+		log.Printf("[ERROR] Error refreshing the proxy routes: %v", err)
+	}
+	resp.Success(w, http.StatusOK, "domain removed")
+}
+
+// getControllableApplication returns the application (or database) of the user that owns the container,
+// the ones being updated can't be controlled since their container is about to be replaced
+func (h Handler) getControllableApplication(w http.ResponseWriter, r *http.Request, conn *mongo.Database) (Application, bool) {
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return Application{}, false
+	}
+
+	updating, err := hasRunningJob(app.ID, conn)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error checking the updates of the application: %v", err.Error())
+		return Application{}, false
+	}
+	if updating {
+		resp.Error(w, http.StatusConflict, "the application is being updated")
+		return Application{}, false
+	}
+	return app, true
+}
+
+// setApplicationStatus saves the status of an application, fields can contain other values to set
+func setApplicationStatus(app Application, status string, fields bson.M, conn *mongo.Database) error {
+	if fields == nil {
+		fields = bson.M{}
+	}
+	fields["status"] = status
+	_, err := conn.Collection("applications").UpdateOne(context.Background(), bson.M{"_id": app.ID}, bson.M{"$set": fields})
+	return err
+}
+
+// starts the stopped container of an application or a database,
+// a crashlooping application gets its restart policy back
+func (h Handler) StartContainerHandler(w http.ResponseWriter, r *http.Request) {
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, ok := h.getControllableApplication(w, r, conn)
+	if !ok {
+		return
+	}
+
+	//the crash loop detection disabled the restarts
+	if app.Status == AppStatusCrashLooping {
+		if err := h.cc.SetRestartPolicy(app.ContainerID, app.RestartPolicy.OrDefault()); err != nil {
+			resp.Errorf(w, http.StatusInternalServerError, "error restoring the restart policy: %v", err.Error())
+			return
+		}
+	}
+
+	//the start time is saved before starting so the deaths before it don't count for the crash loops
+	if err := setApplicationStatus(app, app.Status, bson.M{"userStartedAt": time.Now()}, conn); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error updating the application: %v", err.Error())
+		return
+	}
+	if err := h.cc.StartContainer(app.ContainerID); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error starting the container: %v", err.Error())
+		return
+	}
+	if err := setApplicationStatus(app, AppStatusRunning, bson.M{"crashLoop": nil}, conn); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error updating the application: %v", err.Error())
+		return
+	}
+	resp.Success(w, http.StatusOK, "container started")
+}
+
+// stops the container of an application or a database, it stays stopped until it's started again
+func (h Handler) StopContainerHandler(w http.ResponseWriter, r *http.Request) {
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, ok := h.getControllableApplication(w, r, conn)
+	if !ok {
+		return
+	}
+
+	//the status is set before stopping so the event handler doesn't take the die event for a crash
+	if err := setApplicationStatus(app, AppStatusStopped, nil, conn); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error updating the application: %v", err.Error())
+		return
+	}
+	if err := h.cc.StopContainer(app.ContainerID); err != nil {
+		if err := setApplicationStatus(app, app.Status, nil, conn); err != nil {
+			log.Printf("[ERROR] can't restore the status of application %s: %v", app.ID.Hex(), err)
+		}
+		resp.Errorf(w, http.StatusInternalServerError, "error stopping the container: %v", err.Error())
+		return
+	}
+	resp.Success(w, http.StatusOK, "container stopped")
+}
+
+// restarts the container of an application or a database
+func (h Handler) RestartContainerHandler(w http.ResponseWriter, r *http.Request) {
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, ok := h.getControllableApplication(w, r, conn)
+	if !ok {
+		return
+	}
+
+	if app.Status == AppStatusCrashLooping {
+		if err := h.cc.SetRestartPolicy(app.ContainerID, app.RestartPolicy.OrDefault()); err != nil {
+			resp.Errorf(w, http.StatusInternalServerError, "error restoring the restart policy: %v", err.Error())
+			return
+		}
+	}
+
+	//like in the stop the die event of the restart must not be taken for a crash
+	if err := setApplicationStatus(app, AppStatusRestarting, bson.M{"userStartedAt": time.Now()}, conn); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error updating the application: %v", err.Error())
+		return
+	}
+	if err := h.cc.RestartContainer(app.ContainerID); err != nil {
+		if err := setApplicationStatus(app, app.Status, nil, conn); err != nil {
+			log.Printf("[ERROR] can't restore the status of application %s: %v", app.ID.Hex(), err)
+		}
+		resp.Errorf(w, http.StatusInternalServerError, "error restarting the container: %v", err.Error())
+		return
+	}
+	if err := setApplicationStatus(app, AppStatusRunning, bson.M{"crashLoop": nil}, conn); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error updating the application: %v", err.Error())
+		return
+	}
+	resp.Success(w, http.StatusOK, "container restarted")
+}
+
+// returns the logs of the container of an application (or database), the query can have:
+// tail (number of lines or all, default 100), since (timestamp or duration like 10m),
+// stream (stdout or stderr, default both) and follow (true to stream the new lines with server sent events)
+func (h Handler) GetContainerLogsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts, err := ParseLogsOptions(query.Get("tail"), query.Get("since"), query.Get("stream"), query.Get("follow"))
+	if err != nil {
+		resp.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	app, code, err := h.getOwnedApplication(r, conn)
+	//the connection is not kept open while following the logs
+	conn.Client().Disconnect(context.Background())
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+
+	if !opts.Follow {
+		lines, err := h.cc.GetContainerLogs(app.ContainerID, opts)
+		if err != nil {
+			resp.Errorf(w, http.StatusInternalServerError, "error getting the logs: %v", err.Error())
+			return
+		}
+		resp.SuccessParse(w, http.StatusOK, "logs of the container", lines)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		resp.Error(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	//the stream ends when the client disconnects (the context of the request is canceled) or the container stops
+	err = h.cc.StreamContainerLogs(r.Context(), app.ContainerID, opts, func(line LogLine) error {
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		if err := writeEvent(w, "", string(data)); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		writeEvent(w, "error", err.Error())
+	}
+	writeEvent(w, "end", "")
+	flusher.Flush()
+}
+
+// returns the cpu, memory, network and disk usage of an application (or database) between from and to
+// (rfc3339 or unix timestamps, by default the last hour) grouped in steps (like 5m, at least a minute)
+func (h Handler) GetMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, to, step, err := ParseMetricsRange(query.Get("from"), query.Get("to"), query.Get("step"), time.Now())
+	if err != nil {
+		resp.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+
+	points, err := GetMetrics(app.ID, from, to, step, conn)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error getting the metrics: %v", err.Error())
+		return
+	}
+	resp.SuccessParse(w, http.StatusOK, "metrics of the application", map[string]interface{}{
+		"from":   from,
+		"to":     to,
+		"step":   int(step / time.Second),
+		"points": points,
+	})
+}
+
+// returns a one time ticket to open a terminal in the container of an application (or database),
+// the websocket must be opened with it in a few seconds (see ExecTickets)
+func (h Handler) ExecTicketHandler(w http.ResponseWriter, r *http.Request) {
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+	resp.SuccessParse(w, http.StatusOK, "ticket to open the terminal", map[string]interface{}{
+		"ticket":    h.execTickets.Issue(app.ID, app.StudentID),
+		"expiresIn": int(execTicketTTL / time.Second),
+	})
+}
+
+// opens a terminal in the container of an application (or database) over a websocket, the ticket parameter
+// must be one returned by ExecTicketHandler. The session is described in RunExecSession and saved in the audit log when it ends
+func (h Handler) ExecHandler(w http.ResponseWriter, r *http.Request) {
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	app, code, err := h.getOwnedApplication(r, conn)
+	//the connection is not kept open during the session
+	conn.Client().Disconnect(context.Background())
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+	if !h.execTickets.Consume(r.URL.Query().Get("ticket"), app.ID, app.StudentID) {
+		resp.Error(w, http.StatusForbidden, "invalid or expired ticket, ask a new one to open the terminal")
+		return
+	}
+
+	status, err := h.cc.GetContainerStatus(app.ContainerID)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error getting the status of the container: %v", err.Error())
+		return
+	}
+	if status != AppStatusRunning {
+		resp.Errorf(w, http.StatusConflict, "the container is %s, start it to open a terminal", status)
+		return
+	}
+
+	session := &ExecSession{
+		ID:            primitive.NewObjectID(),
+		ApplicationID: app.ID,
+		ContainerID:   app.ContainerID,
+		StudentID:     app.StudentID,
+		Command:       execCommand,
+		RemoteAddr:    r.RemoteAddr,
+	}
+	websocket.Server{
+		Handshake: checkSameOrigin,
+		Handler: func(ws *websocket.Conn) {
+			//the output of the tty is sent as binary
+			ws.PayloadType = websocket.BinaryFrame
+			h.cc.RunExecSession(ws, session, h.execIdleTimeout)
+		},
+	}.ServeHTTP(w, r)
+}
+
+// queueEnvsJob queues the recreation of the container of an application with the new envs and links (nil keeps the current ones)
+func (h Handler) queueEnvsJob(w http.ResponseWriter, app Application, envs []Env, links *[]DatabaseLink, conn *mongo.Database) {
+	//only one job at a time can replace the container
+	updating, err := hasRunningJob(app.ID, conn)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error checking the updates of the application: %v", err.Error())
+		return
+	}
+	if updating {
+		resp.Error(w, http.StatusConflict, "the application is already being updated")
+		return
+	}
+
+	job, err := h.NewEnvsJob(app.StudentID, app.ID, envs, links)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error queueing the update of the envs: %v", err.Error())
+		return
+	}
+	resp.SuccessParse(w, http.StatusAccepted, "update of the envs queued", map[string]interface{}{
+		"jobID": job.ID.Hex(),
+		"phase": job.Phase,
+	})
+}
+
+// handles the envs of an application: GET returns them, PUT sets the envs in the body (the other ones are kept)
+// and DELETE removes the ones in the key parameters (?key=A&key=B). The changes recreate the container
+// from the current image with a job like the updates
+func (h Handler) EnvsHandler(w http.ResponseWriter, r *http.Request) {
+	var updates []Env
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+			resp.Errorf(w, http.StatusBadRequest, "error decoding the json: %v", err.Error())
+			return
+		}
+		if len(updates) == 0 {
+			resp.Error(w, http.StatusBadRequest, "no envs to set")
+			return
+		}
+		if err := ValidateEnvs(updates); err != nil {
+			resp.Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	keys := r.URL.Query()["key"]
+	if r.Method == http.MethodDelete && len(keys) == 0 {
+		resp.Error(w, http.StatusBadRequest, "no envs to remove, set them with the key parameter")
+		return
+	}
+
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+	if app.Type != "web" {
+		resp.Error(w, http.StatusBadRequest, "the envs can only be set for web applications")
+		return
+	}
+	if app.Envs == nil {
+		app.Envs = []Env{}
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		//the secrets sent back masked keep their values
+		updates, err := UnmaskEnvs(app.Envs, updates)
+		if err != nil {
+			resp.Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		envs := SetEnvs(app.Envs, updates)
+		if err := ValidateEnvs(envs); err != nil {
+			resp.Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		h.queueEnvsJob(w, app, envs, nil, conn)
+	case http.MethodDelete:
+		envs, missing := RemoveEnvs(app.Envs, keys)
+		if len(missing) > 0 {
+			resp.Errorf(w, http.StatusNotFound, "the application doesn't have the envs %s", strings.Join(missing, ", "))
+			return
+		}
+		h.queueEnvsJob(w, app, envs, nil, conn)
+	default:
+		resp.SuccessParse(w, http.StatusOK, "envs of the application", app.Envs)
+	}
+}
+
+// handles the databases linked to an application: GET returns the links, POST links the database in the body
+// (its containerID and an optional prefix of the envs) and DELETE removes the link with the database in the
+// database parameter (?database=containerID). The changes recreate the container with a job like the envs
+func (h Handler) LinksHandler(w http.ResponseWriter, r *http.Request) {
+	var linkPost LinkPost
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&linkPost); err != nil {
+			resp.Errorf(w, http.StatusBadRequest, "error decoding the json: %v", err.Error())
+			return
+		}
+	} else {
+		linkPost.Database = r.URL.Query().Get("database")
+	}
+	if r.Method != http.MethodGet && linkPost.Database == "" {
+		resp.Error(w, http.StatusBadRequest, "the containerID of the database is missing")
+		return
+	}
+
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.Background())
+
+	app, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+	if app.Type != "web" {
+		resp.Error(w, http.StatusBadRequest, "the databases can only be linked to web applications")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		links := []DatabaseLink{}
+		for _, link := range app.Links {
+			var db Application
+			if err := conn.Collection("applications").FindOne(context.Background(), bson.M{"_id": link.DatabaseID}).Decode(&db); err == nil {
+				link.ContainerID = db.ContainerID
+			}
+			links = append(links, link)
+		}
+		resp.SuccessParse(w, http.StatusOK, "databases linked to the application", links)
+		return
+	}
+
+	//the database must be one of the student's
+	var db Application
+	err = conn.Collection("applications").FindOne(context.Background(), bson.M{"containerID": linkPost.Database, "type": "database"}).Decode(&db)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			resp.Error(w, http.StatusNotFound, "there is no database with this id")
+			return
+		}
+		resp.Errorf(w, http.StatusInternalServerError, "error getting the database: %v", err.Error())
+		return
+	}
+	if db.StudentID != app.StudentID {
+		resp.Error(w, http.StatusForbidden, "you don't have permission to access this database")
+		return
+	}
+
+	links := []DatabaseLink{}
+	switch r.Method {
+	case http.MethodPost:
+		link := DatabaseLink{DatabaseID: db.ID, Prefix: linkPost.Prefix}
+		if err := ValidateLink(link, app.Links); err != nil {
+			resp.Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, err := GetDatabaseCredentials(db, "", ""); err != nil {
+			resp.Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		links = append(app.Links, link)
+	case http.MethodDelete:
+		for _, link := range app.Links {
+			if link.DatabaseID != db.ID {
+				links = append(links, link)
+			}
+		}
+		if len(links) == len(app.Links) {
+			resp.Error(w, http.StatusNotFound, "the database is not linked to the application")
+			return
+		}
+	}
+
+	//the links are saved by the job once the container with their envs is running
+	h.queueEnvsJob(w, app, app.Envs, &links, conn)
+}
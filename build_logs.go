@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// BuildLog keeps the output of a running build and relays every new line to its subscribers
+type BuildLog struct {
+	mu       sync.Mutex
+	lines    []string
+	subs     map[chan string]struct{}
+	dropped  map[chan string]struct{} //subscribers closed since they couldn't keep up, not because the build finished
+	finished bool
+}
+
+// Write implements io.Writer so the log can be passed to CreateImage,
+// every non empty line written is saved and sent to the subscribers
+func (l *BuildLog) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(string(p), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		l.Append(line)
+	}
+	return len(p), nil
+}
+
+// Append saves a line and relays it, a subscriber that can't keep up is dropped
+// (Dropped tells it apart from the end of the build, it can subscribe again and it will get the whole log)
+func (l *BuildLog) Append(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, line)
+	for sub := range l.subs {
+		select {
+		case sub <- line:
+		default:
+			delete(l.subs, sub)
+			l.dropped[sub] = struct{}{}
+			close(sub)
+		}
+	}
+}
+
+// Dropped reports if the closed channel of a subscriber was dropped since it couldn't keep up,
+// false means that the build finished
+func (l *BuildLog) Dropped(sub chan string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, dropped := l.dropped[sub]
+	delete(l.dropped, sub)
+	return dropped
+}
+
+// Lines returns a copy of all the lines written so far
+func (l *BuildLog) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.lines...)
+}
+
+// Subscribe returns the lines already written and a channel that will receive the new ones,
+// the channel is closed when the build finishes
+func (l *BuildLog) Subscribe() ([]string, chan string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sub := make(chan string, 256)
+	if l.finished {
+		close(sub)
+	} else {
+		l.subs[sub] = struct{}{}
+	}
+	return append([]string(nil), l.lines...), sub
+}
+
+// Unsubscribe removes a subscriber, used when the client disconnects
+func (l *BuildLog) Unsubscribe(sub chan string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.dropped, sub)
+	if _, ok := l.subs[sub]; ok {
+		delete(l.subs, sub)
+		close(sub)
+	}
+}
+
+// finish closes all the subscribers
+func (l *BuildLog) finish() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.finished = true
+	for sub := range l.subs {
+		delete(l.subs, sub)
+		close(sub)
+	}
+}
+
+// BuildLogStore holds the logs of the builds that are currently running, indexed by job id
+type BuildLogStore struct {
+	mu   sync.Mutex
+	logs map[string]*BuildLog
+}
+
+// NewBuildLogStore creates an empty store
+func NewBuildLogStore() *BuildLogStore {
+	return &BuildLogStore{logs: make(map[string]*BuildLog)}
+}
+
+// New creates the log of a job and saves it in the store
+func (s *BuildLogStore) New(jobID string) *BuildLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := &BuildLog{subs: make(map[chan string]struct{}), dropped: make(map[chan string]struct{})}
+	s.logs[jobID] = l
+	return l
+}
+
+// Get returns the log of a running job, nil if the job is not running
+func (s *BuildLogStore) Get(jobID string) *BuildLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.logs[jobID]
+}
+
+// Finish closes the log of a job and removes it from the store, the lines are returned
+// so they can be saved on the database
+func (s *BuildLogStore) Finish(jobID string) []string {
+	s.mu.Lock()
+	l, ok := s.logs[jobID]
+	delete(s.logs, jobID)
+	s.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	l.finish()
+	return l.Lines()
+}
+
+// writeEvent writes a server sent event (without the event field if it's empty), every line
+// of the data gets its own data field since a new line would end the field
+func writeEvent(w io.Writer, event, data string) error {
+	var b strings.Builder
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	data = strings.ReplaceAll(strings.ReplaceAll(data, "\r\n", "\n"), "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	_, err := fmt.Fprint(w, b.String())
+	return err
+}
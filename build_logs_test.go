@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildLogDroppedSubscriber(t *testing.T) {
+	store := NewBuildLogStore()
+	buildLog := store.New("job")
+	_, sub := buildLog.Subscribe()
+
+	//nobody reads the channel, it's dropped when its buffer is full
+	for i := 0; i <= cap(sub); i++ {
+		buildLog.Append("line")
+	}
+	for range sub {
+	}
+	if !buildLog.Dropped(sub) {
+		t.Errorf("a slow subscriber wasn't reported as dropped")
+	}
+
+	backlog, sub := buildLog.Subscribe()
+	if len(backlog) != cap(sub)+1 {
+		t.Errorf("expected %d lines after subscribing again, got %d", cap(sub)+1, len(backlog))
+	}
+	store.Finish("job")
+	if _, ok := <-sub; ok {
+		t.Fatalf("the channel wasn't closed at the end of the build")
+	}
+	if buildLog.Dropped(sub) {
+		t.Errorf("the end of the build was reported as a drop")
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	tests := []struct {
+		event, data, expected string
+	}{
+		{"", "Step 1/4 : FROM alpine", "data: Step 1/4 : FROM alpine\n\n"},
+		{"end", "failed", "event: end\ndata: failed\n\n"},
+		{"end", "", "event: end\ndata: \n\n"},
+		{"error", "first\nsecond\r\nthird", "event: error\ndata: first\ndata: second\ndata: third\n\n"},
+	}
+	for _, test := range tests {
+		var b strings.Builder
+		if err := writeEvent(&b, test.event, test.data); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.expected {
+			t.Errorf("writeEvent(%q, %q) = %q, expected %q", test.event, test.data, b.String(), test.expected)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+var (
+	//classic builder: "Step 3/9 : RUN go build"
+	classicStepRegex = regexp.MustCompile(`^Step (\d+)/(\d+) : (.*)$`)
+	//buildkit plain output: "#7 [builder 3/9] RUN go build"
+	buildkitStepRegex = regexp.MustCompile(`^#\d+ \[(?:[^\]]* )?(\d+)/(\d+)\] (.*)$`)
+)
+
+// BuildStep is a single instruction of the dockerfile being executed
+type BuildStep struct {
+	Number      int    `bson:"number" json:"number"`
+	Total       int    `bson:"total" json:"total"`
+	Instruction string `bson:"instruction" json:"instruction"`
+}
+
+// BuildResult is the parsed output of an image build
+type BuildResult struct {
+	ImageID string
+	Steps   []BuildStep
+	Output  string
+}
+
+// LastStep returns the last step executed, an empty step if the build didn't start any
+func (b BuildResult) LastStep() BuildStep {
+	if len(b.Steps) == 0 {
+		return BuildStep{}
+	}
+	return b.Steps[len(b.Steps)-1]
+}
+
+// BuildError is returned when the docker daemon reports an error during the build,
+// it carries the step that was running when it failed
+type BuildError struct {
+	Step    BuildStep `bson:"step" json:"step"`
+	Code    int       `bson:"code,omitempty" json:"code,omitempty"`
+	Message string    `bson:"message" json:"message"`
+}
+
+func (e *BuildError) Error() string {
+	if e.Step.Number == 0 {
+		return fmt.Sprintf("build failed: %s", e.Message)
+	}
+	return fmt.Sprintf("build failed at step %d/%d (%s): %s", e.Step.Number, e.Step.Total, e.Step.Instruction, e.Message)
+}
+
+// parseBuildStep returns the step described by a line of the build output, if any
+func parseBuildStep(line string) (BuildStep, bool) {
+	line = strings.TrimSpace(line)
+	matches := classicStepRegex.FindStringSubmatch(line)
+	if matches == nil {
+		matches = buildkitStepRegex.FindStringSubmatch(line)
+	}
+	if matches == nil {
+		return BuildStep{}, false
+	}
+
+	number, _ := strconv.Atoi(matches[1])
+	total, _ := strconv.Atoi(matches[2])
+	return BuildStep{
+		Number:      number,
+		Total:       total,
+		Instruction: matches[3],
+	}, true
+}
+
+// ParseBuildStream decodes the json messages sent by the docker daemon during a build.
+// Every message is written to logWriter (can be nil) as soon as it's received.
+// If the daemon reports an error a *BuildError is returned together with the partial result
+func ParseBuildStream(body io.Reader, logWriter io.Writer) (BuildResult, error) {
+	if logWriter == nil {
+		logWriter = io.Discard
+	}
+
+	var result BuildResult
+	var output strings.Builder
+	decoder := json.NewDecoder(body)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				break
+			}
+			result.Output = output.String()
+			return result, err
+		}
+
+		//the aux message contains the id of the image built
+		if msg.Aux != nil {
+			var aux struct {
+				ID string `json:"ID"`
+			}
+			if err := json.Unmarshal(*msg.Aux, &aux); err == nil && aux.ID != "" {
+				result.ImageID = aux.ID
+			}
+			continue
+		}
+
+		if msg.Error != nil {
+			io.WriteString(logWriter, msg.Error.Message+"\n")
+			output.WriteString(msg.Error.Message + "\n")
+			result.Output = output.String()
+			return result, &BuildError{
+				Step:    result.LastStep(),
+				Code:    msg.Error.Code,
+				Message: msg.Error.Message,
+			}
+		}
+
+		var text string
+		switch {
+		case msg.Stream != "":
+			text = msg.Stream
+		case msg.Status != "":
+			text = msg.Status + "\n"
+		default:
+			continue
+		}
+
+		for _, line := range strings.Split(text, "\n") {
+			if step, ok := parseBuildStep(line); ok {
+				result.Steps = append(result.Steps, step)
+			}
+		}
+
+		output.WriteString(text)
+		if _, err := io.WriteString(logWriter, text); err != nil {
+			result.Output = output.String()
+			return result, err
+		}
+	}
+
+	result.Output = output.String()
+	return result, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseBuildStream(t *testing.T) {
+	t.Run("Successful build", func(t *testing.T) {
+		stream := `{"stream":"Step 1/2 : FROM golang:1-alpine3.15\n"}
+{"stream":" ---> 1a2b3c4d\n"}
+{"stream":"Step 2/2 : RUN go build\n"}
+{"aux":{"ID":"sha256:abcdef"}}
+{"stream":"Successfully built abcdef\n"}`
+
+		var log strings.Builder
+		result, err := ParseBuildStream(strings.NewReader(stream), &log)
+		if err != nil {
+			t.Fatalf("error has been generated: %s", err)
+		}
+		if result.ImageID != "sha256:abcdef" {
+			t.Errorf("expected image id sha256:abcdef, got %s", result.ImageID)
+		}
+		if len(result.Steps) != 2 {
+			t.Fatalf("expected 2 steps, got %d", len(result.Steps))
+		}
+		if result.LastStep().Instruction != "RUN go build" {
+			t.Errorf("unexpected last step: %+v", result.LastStep())
+		}
+		if !strings.Contains(log.String(), "Successfully built") {
+			t.Errorf("the log writer didn't receive the output: %s", log.String())
+		}
+	})
+
+	t.Run("Failing build", func(t *testing.T) {
+		stream := `{"stream":"Step 1/3 : FROM golang:1-alpine3.15\n"}
+{"stream":"Step 2/3 : RUN go build\n"}
+{"errorDetail":{"code":1,"message":"exit code 1"},"error":"exit code 1"}`
+
+		_, err := ParseBuildStream(strings.NewReader(stream), nil)
+		var buildErr *BuildError
+		if !errors.As(err, &buildErr) {
+			t.Fatalf("expected a build error, got %v", err)
+		}
+		if buildErr.Step.Number != 2 || buildErr.Step.Total != 3 {
+			t.Errorf("unexpected failing step: %+v", buildErr.Step)
+		}
+		if buildErr.Code != 1 || buildErr.Message != "exit code 1" {
+			t.Errorf("unexpected error detail: %+v", buildErr)
+		}
+	})
+
+	t.Run("Empty output", func(t *testing.T) {
+		result, err := ParseBuildStream(strings.NewReader(""), nil)
+		if err != nil {
+			t.Fatalf("error has been generated: %s", err)
+		}
+		if result.ImageID != "" || len(result.Steps) != 0 {
+			t.Errorf("expected an empty result, got %+v", result)
+		}
+	})
+
+	t.Run("Buildkit step", func(t *testing.T) {
+		step, ok := parseBuildStep("#7 [builder 3/9] RUN go build")
+		if !ok || step.Number != 3 || step.Total != 9 || step.Instruction != "RUN go build" {
+			t.Errorf("unexpected step: %+v", step)
+		}
+	})
+}
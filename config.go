@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/joho/godotenv"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
@@ -17,7 +16,9 @@ var (
 	privateKey                   *rsa.PrivateKey
 	publicKey                    *rsa.PublicKey
 	handler                      *Handler
+	secretStore                  *SecretStore //encrypts the envs and the credentials saved on the database
 	Langs                        []string
+	Runtimes                     []Runtime
 	oauthStateCleaningInterval   = 5 * time.Minute
 	refreshTokenCleaningInterval = 5 * time.Minute
 	usersCleaningInterval        = 1 * time.Minute
@@ -34,10 +35,25 @@ func init() {
 		panic("Error loading .env file")
 	}
 
+	if err := loadDefaultLimits(); err != nil {
+		panic(err)
+	}
+	if err := loadDefaultQuota(); err != nil {
+		panic(err)
+	}
+	if err := loadCrashLoopConfig(); err != nil {
+		panic(err)
+	}
+
 	DatabaseUri = os.Getenv("DB_URI")
 	fmt.Println(DatabaseUri)
 	JwtSecret = []byte(os.Getenv("JWT_SECRET"))
 
+	secretStore, err = NewSecretStore(os.Getenv("SECRETS_KEY"))
+	if err != nil {
+		panic("error creating the secret store: " + err.Error())
+	}
+
 	conn, err := connectToDB()
 	if err != nil {
 		panic("error connecting to the database: " + err.Error())
@@ -58,21 +74,13 @@ func init() {
 	}
 	publicKey = &privateKey.PublicKey
 
-	var LangsStruct []struct {
-		Lang string
-	}
-	cur, err := conn.Collection("langs").Find(context.TODO(), bson.D{})
+	Runtimes, err = loadRuntimes(conn)
 	if err != nil {
 		panic("error getting supported langs " + err.Error())
 	}
 
-	err = cur.All(context.TODO(), &LangsStruct)
-	if err != nil {
-		panic("error reading supported langs " + err.Error())
-	}
-
-	for _, Lang := range LangsStruct {
-		Langs = append(Langs, Lang.Lang)
+	for _, runtime := range Runtimes {
+		Langs = append(Langs, runtime.Lang)
 	}
 
 	handler, err = NewHandler()
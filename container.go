@@ -6,57 +6,101 @@ import (
 	"fmt"
 	"github.com/docker/docker/pkg/archive"
 	"io"
-	"io/ioutil"
+	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
 	volumeType "github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
+	"github.com/docker/go-units"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type ContainerController struct {
 	ctx                 context.Context //context for the docker client
 	cli                 *client.Client  //docker client
 	dbContainersConfigs map[string]dbContainerConfig
+	appsNetwork         string      //network shared by the applications created before the networks of the students
+	quota               *quotaState //locks of the quota checks and disk usage of the volumes
+	//connection shared by the event handler, the proxy and the collectors, they run for every event or request
+	//so they don't open their own. It's never closed
+	db *mongo.Database
 }
 
+// default name of the network of the old applications, can be changed with APPS_NETWORK
+const defaultAppsNetwork = "ipaas-apps"
+
+// time given to a container to exit when it's stopped before it's killed
+const containerStopTimeout = 10 * time.Second
+
 // CreateImage will create an image given the creator id, port to expose (in the docker),
-// name of the app, path for the tmp file, lang for the dockerfile and envs, if no error occurs
-// the function will return the image name and image id
-func (c ContainerController) CreateImage(creatorID, port int, name, branch, path, language string, envs []Env) (string, string, error) {
+// name of the app, path for the tmp file and lang for the dockerfile, if no error occurs
+// the function will return the image name and image id (the envs are set on the container, not in the image).
+// Every step of the build is written to logWriter (can be nil), the build memory is limited by limits.BuildMemory
+func (c ContainerController) CreateImage(creatorID, port int, name, branch, path, language string, limits ResourceLimits, logWriter io.Writer) (string, string, error) {
 	//check if the language is supported
-	var found bool
-	for _, l := range Langs {
-		if l == language {
-			found = true
-			break
-		}
-	}
-
-	//check if it's found
+	runtime, found := GetRuntime(language)
 	if !found {
 		return "", "", fmt.Errorf("language %s not supported, the supported langs are: %v", language, Langs)
 	}
 
-	//get the dockerfile
-	dockerfile, err := ioutil.ReadFile(fmt.Sprintf("dockerfiles/%s.dockerfile", language))
+	if runtime.Template == "" {
+		return "", "", fmt.Errorf("language %s doesn't have a dockerfile template", language)
+	}
+
+	//create the dockerfile
+	dockerfile, err := runtime.RenderDockerfile(DockerfileData{
+		AppName: name,
+		Repo:    path,
+		Port:    port,
+	})
 	if err != nil {
 		return "", "", err
 	}
+	return c.buildImage(creatorID, name, branch, path, language, dockerfile, limits, logWriter)
+}
 
-	//set the env variables in a string with syntax: ENV key value
-	var envString string
-	for _, env := range envs {
-		envString += fmt.Sprintf("ENV %s %s\n", env.Key, env.Value)
+// CreateImageFromRepoDockerfile creates an image using the dockerfile shipped in the repo (dockerfilePath is relative
+// to the root of the repo, if empty the Dockerfile in the root is used). The dockerfile must respect the platform
+// policy (see Dockerfile.CheckPolicy)
+func (c ContainerController) CreateImageFromRepoDockerfile(creatorID, port int, name, branch, path, dockerfilePath string, limits ResourceLimits, logWriter io.Writer) (string, string, error) {
+	if dockerfilePath == "" {
+		dockerfilePath = defaultDockerfilePath
+	}
+	//the dockerfile must be inside the repo
+	dockerfilePath = filepath.Clean(dockerfilePath)
+	if filepath.IsAbs(dockerfilePath) || strings.HasPrefix(dockerfilePath, "..") {
+		return "", "", fmt.Errorf("the dockerfile path %s must be relative to the root of the repo", dockerfilePath)
 	}
 
-	//create the dockerfile
-	dockerfileWithEnvs := fmt.Sprintf(string(dockerfile), name, path, envString, port)
+	content, err := os.ReadFile(filepath.Join(path, dockerfilePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", fmt.Errorf("dockerfile %s not found in the repo", dockerfilePath)
+		}
+		return "", "", err
+	}
+
+	dockerfile, err := ParseDockerfile(bytes.NewReader(content))
+	if err != nil {
+		return "", "", err
+	}
+	if err := dockerfile.CheckPolicy(strconv.Itoa(port), allowedBaseImages()); err != nil {
+		return "", "", err
+	}
+
+	return c.buildImage(creatorID, name, branch, path, DockerfileRuntime, string(content), limits, logWriter)
+}
+
+// buildImage writes the dockerfile in the repo and builds the image, the image name and id are returned
+func (c ContainerController) buildImage(creatorID int, name, branch, path, language, dockerfile string, limits ResourceLimits, logWriter io.Writer) (string, string, error) {
 	//set a random name for the dockerfile
 	dockerName := "ipaas-dockerfile_" + generateRandomString(10)
 
@@ -65,7 +109,7 @@ func (c ContainerController) CreateImage(creatorID, port int, name, branch, path
 	if err != nil {
 		return "", "", err
 	}
-	if _, err := f.WriteString(dockerfileWithEnvs); err != nil {
+	if _, err := f.WriteString(dockerfile); err != nil {
 		return "", "", err
 	}
 	if err := f.Close(); err != nil {
@@ -90,8 +134,7 @@ func (c ContainerController) CreateImage(creatorID, port int, name, branch, path
 	fmt.Println("image name:", imageName[0])
 
 	//create the image from the dockerfile
-	//we are setting some default labels and the flag -rm -f
-	//!should set memory and cpu limit
+	//we are setting some default labels, the flag -rm -f and the memory limit of the build
 	resp, err := c.cli.ImageBuild(c.ctx, buildContext, types.ImageBuildOptions{
 		Dockerfile: dockerName,
 		//Squash: true,
@@ -103,41 +146,33 @@ func (c ContainerController) CreateImage(creatorID, port int, name, branch, path
 		},
 		Remove:      true,
 		ForceRemove: true,
+		Memory:      limits.BuildMemory,
+		MemorySwap:  limits.BuildMemory,
 	})
 	if err != nil {
 		return "", "", err
 	}
 
 	//read the resp.Body, it's a way to wait for the image to be created
-	a, err := io.ReadAll(resp.Body)
-	err = resp.Body.Close()
+	result, err := ParseBuildStream(resp.Body, logWriter)
+	resp.Body.Close()
 	if err != nil {
 		return "", "", err
 	}
-	fmt.Println("body:", string(a))
 
-	//find the id of the image just created
-	var out bytes.Buffer
-	cmd := exec.CommandContext(c.ctx, "docker", "images", "-q", imageName[0])
-	cmd.Stdout = &out
-	if err := cmd.Run(); err != nil {
-		return "", "", err
-	}
-	imageID := strings.Replace(out.String(), "\n", "", -1)
-
-	if !c.CheckIfImageCompiled(string(a)) {
-		return "", imageID, fmt.Errorf("image %s compiled incorrectly", imageName[0])
+	//the daemon sends the image id as an aux message, if it didn't we ask for it
+	imageID := result.ImageID
+	if imageID == "" {
+		image, _, err := c.cli.ImageInspectWithRaw(c.ctx, imageName[0])
+		if err != nil {
+			return "", "", fmt.Errorf("image %s not found after the build: %v", imageName[0], err)
+		}
+		imageID = image.ID
 	}
 
 	return imageName[0], imageID, nil
 }
 
-// CheckIfImageCompiled will check the output of the image build to see if the image was compiled correctly
-func (c ContainerController) CheckIfImageCompiled(imageBuildOutput string) bool {
-	lines := strings.Split(imageBuildOutput, "\n")
-	return strings.Contains(lines[len(lines)-2], "Successfully tagged")
-}
-
 // RemoveImage removes an image given the image id
 func (c ContainerController) RemoveImage(imageID string) error {
 	//remove the image
@@ -196,8 +231,8 @@ func (c ContainerController) FindVolume(name string) (volume *types.Volume, err
 }
 
 // EnsureVolume checks if a volume exists, if so returns false, the volume and an error.
-// If it doesn't exist it will be created and the output will be true, the volume and an error
-func (c ContainerController) EnsureVolume(name string) (created bool, volume *types.Volume, err error) {
+// If it doesn't exist it will be created with the labels and the output will be true, the volume and an error
+func (c ContainerController) EnsureVolume(name string, labels map[string]string) (created bool, volume *types.Volume, err error) {
 	//check if the volume exists (if it doesn't volume will be nil)
 	volume, err = c.FindVolume(name)
 	if err != nil {
@@ -211,7 +246,7 @@ func (c ContainerController) EnsureVolume(name string) (created bool, volume *ty
 	//create the volume given the context and the volume create body struct
 	vol, err := c.cli.VolumeCreate(c.ctx, volumeType.VolumeCreateBody{
 		Driver: "local",
-		Labels: map[string]string{"matricola": "18008", "type": "db", "dbType": "mysql"},
+		Labels: labels,
 		Name:   name,
 	})
 	return true, &vol, err
@@ -245,30 +280,285 @@ func (c ContainerController) DeleteContainer(containerID string) error {
 	})
 }
 
-func (c ContainerController) GetContainerLogs(containerID string) (string, error) {
-	reader, err := c.cli.ContainerLogs(c.ctx, containerID, types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Follow:     true,
-		Tail:       "all",
-	})
+// StartContainer starts a stopped container
+func (c ContainerController) StartContainer(containerID string) error {
+	return c.cli.ContainerStart(c.ctx, containerID, types.ContainerStartOptions{})
+}
+
+// StopContainer stops a container, it's killed if it doesn't exit in containerStopTimeout
+func (c ContainerController) StopContainer(containerID string) error {
+	timeout := containerStopTimeout
+	return c.cli.ContainerStop(c.ctx, containerID, &timeout)
+}
+
+// RestartContainer stops (with the same timeout of StopContainer) and starts again a container
+func (c ContainerController) RestartContainer(containerID string) error {
+	timeout := containerStopTimeout
+	return c.cli.ContainerRestart(c.ctx, containerID, &timeout)
+}
+
+func (c ContainerController) GetContainerStatus(id string) (string, error) {
+	container, err := c.cli.ContainerInspect(c.ctx, id)
 	if err != nil {
 		return "", err
 	}
-	defer reader.Close()
-	logs, err := io.ReadAll(reader)
+	return container.State.Status, nil
+}
+
+// EnsureNetwork creates the bridge network with the given name and labels if it doesn't exist
+func (c ContainerController) EnsureNetwork(name string, labels map[string]string) error {
+	networks, err := c.cli.NetworkList(c.ctx, types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.Arg("name", name)),
+	})
 	if err != nil {
+		return err
+	}
+	//the name filter matches the substrings too
+	for _, n := range networks {
+		if n.Name == name {
+			return nil
+		}
+	}
+
+	_, err = c.cli.NetworkCreate(c.ctx, name, types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         "bridge",
+		Labels:         labels,
+	})
+	//another request could have created it in the meantime
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		return nil
+	}
+	return err
+}
+
+// studentNetworkName returns the name of the network shared by the containers of a student
+func studentNetworkName(studentID int) string {
+	return fmt.Sprintf("ipaas-student-%d", studentID)
+}
+
+// EnsureStudentNetwork creates the network of a student and returns its name. All the applications and the databases
+// of the student are attached only to it, so the containers of the other students can't reach them
+// (docker isolates the bridge networks from each other). The proxy reaches the applications on it
+func (c ContainerController) EnsureStudentNetwork(studentID int) (string, error) {
+	name := studentNetworkName(studentID)
+	if err := c.EnsureNetwork(name, map[string]string{"ipaas": "student", ownerLabel: strconv.Itoa(studentID)}); err != nil {
 		return "", err
 	}
-	return string(logs), nil
+	return name, c.ConnectSelfToNetwork(name)
 }
 
-func (c ContainerController) GetContainerStatus(id string) (string, error) {
+// ConnectSelfToStudentNetworks attaches the container of the ipaas server to the networks of all the students,
+// they could have been created by a previous container of the server
+func (c ContainerController) ConnectSelfToStudentNetworks() error {
+	networks, err := c.cli.NetworkList(c.ctx, types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", "ipaas=student")),
+	})
+	if err != nil {
+		return err
+	}
+	for _, n := range networks {
+		if err := c.ConnectSelfToNetwork(n.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveStudentNetworkIfUnused removes the network of a student when none of its containers are left,
+// the stopped ones are counted too since they are attached again when they are started
+func (c ContainerController) RemoveStudentNetworkIfUnused(studentID int) error {
+	name := studentNetworkName(studentID)
+	owned, err := c.cli.ContainerList(c.ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", ownerLabel+"="+strconv.Itoa(studentID))),
+	})
+	if err != nil {
+		return err
+	}
+	if len(owned) > 0 {
+		return nil
+	}
+
+	//the containers without the owner label could have been attached to the network too,
+	//the only one allowed is the ipaas server (if it runs in docker)
+	attached, err := c.cli.ContainerList(c.ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("network", name)),
+	})
+	if err != nil {
+		return err
+	}
+	self := c.selfContainerID()
+	for _, container := range attached {
+		if container.ID != self {
+			return nil
+		}
+	}
+	if len(attached) > 0 {
+		if err := c.cli.NetworkDisconnect(c.ctx, name, self, true); err != nil {
+			return err
+		}
+	}
+	err = c.cli.NetworkRemove(c.ctx, name)
+	if err != nil && client.IsErrNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// MoveToStudentNetwork attaches a container created before the networks of the students to the network of its owner
+// with the aliases as hostnames and detaches it from the shared networks (the default bridge and the apps network),
+// where the containers of the other students could reach it. The published ports are kept
+func (c ContainerController) MoveToStudentNetwork(containerID string, studentID int, aliases ...string) error {
+	studentNetwork, err := c.EnsureStudentNetwork(studentID)
+	if err != nil {
+		return fmt.Errorf("error creating the network of the student: %v", err)
+	}
+	//the container is attached to the new network before leaving the old ones so it's never unreachable
+	if err := c.ConnectToNetwork(studentNetwork, containerID, aliases...); err != nil {
+		return fmt.Errorf("error connecting to the network of the student: %v", err)
+	}
+	container, err := c.cli.ContainerInspect(c.ctx, containerID)
+	if err != nil {
+		return err
+	}
+	for name := range container.NetworkSettings.Networks {
+		if name != "bridge" && name != c.appsNetwork {
+			continue
+		}
+		if err := c.cli.NetworkDisconnect(c.ctx, name, containerID, false); err != nil {
+			return fmt.Errorf("error disconnecting from %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// ConnectToNetwork attaches a container to a network with the aliases as hostnames,
+// nothing is done if it's already attached
+func (c ContainerController) ConnectToNetwork(networkName, containerID string, aliases ...string) error {
+	err := c.cli.NetworkConnect(c.ctx, networkName, containerID, &network.EndpointSettings{Aliases: aliases})
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		return nil
+	}
+	return err
+}
+
+// ConnectSelfToNetwork attaches the container of the ipaas server (if it's running in docker)
+// to the network so the proxy can reach the applications
+func (c ContainerController) ConnectSelfToNetwork(name string) error {
+	if _, err := os.Stat("/.dockerenv"); err != nil {
+		return nil
+	}
+	//the hostname of a container is its short id
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	err = c.cli.NetworkConnect(c.ctx, name, hostname, nil)
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		return nil
+	}
+	return err
+}
+
+// selfContainerID returns the id of the container of the ipaas server, it's empty if the server doesn't run in docker
+func (c ContainerController) selfContainerID() string {
+	if _, err := os.Stat("/.dockerenv"); err != nil {
+		return ""
+	}
+	//the hostname of a container is its short id
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	container, err := c.cli.ContainerInspect(c.ctx, hostname)
+	if err != nil {
+		return ""
+	}
+	return container.ID
+}
+
+// AppIP returns the ip of a container on the network of its owner, the containers created
+// before the networks of the students are reached on the apps network or on the other ones
+func (c ContainerController) AppIP(id string) (string, error) {
 	container, err := c.cli.ContainerInspect(c.ctx, id)
 	if err != nil {
 		return "", err
 	}
-	return container.State.Status, nil
+	preferred := []string{c.appsNetwork}
+	if studentID, err := strconv.Atoi(container.Config.Labels[ownerLabel]); err == nil {
+		preferred = append([]string{studentNetworkName(studentID)}, preferred...)
+	}
+	for _, name := range preferred {
+		if network, found := container.NetworkSettings.Networks[name]; found && network.IPAddress != "" {
+			return network.IPAddress, nil
+		}
+	}
+	for _, network := range container.NetworkSettings.Networks {
+		if network.IPAddress != "" {
+			return network.IPAddress, nil
+		}
+	}
+	return "", fmt.Errorf("the container has no ip address")
+}
+
+// WaitUntilHealthy waits for the container to be ready to receive requests on the given port,
+// if the application has a health check it's probed, otherwise the port is checked with a tcp dial.
+// If the image has a healthcheck it must pass too, but it never replaces the one of the user
+func (c ContainerController) WaitUntilHealthy(id, port string, timeout time.Duration, check *HealthCheck) error {
+	var lastErr error
+	deadline := time.Now().Add(timeout)
+	for {
+		container, err := c.cli.ContainerInspect(c.ctx, id)
+		if err != nil {
+			return err
+		}
+		if !container.State.Running {
+			return fmt.Errorf("the container is not running (status: %s, exit code: %d)", container.State.Status, container.State.ExitCode)
+		}
+
+		imageReady := true
+		if container.State.Health != nil {
+			switch container.State.Health.Status {
+			case types.Healthy:
+				//without a health check of the user the one of the image is enough
+				if check == nil {
+					return nil
+				}
+			case types.Unhealthy:
+				return fmt.Errorf("the container is unhealthy")
+			default:
+				imageReady = false
+			}
+		}
+		if imageReady {
+			for _, network := range container.NetworkSettings.Networks {
+				if check != nil {
+					if _, lastErr = check.Probe(network.IPAddress, port); lastErr == nil {
+						return nil
+					}
+					continue
+				}
+				conn, err := net.DialTimeout("tcp", net.JoinHostPort(network.IPAddress, port), time.Second)
+				if err == nil {
+					conn.Close()
+					return nil
+				}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			if !imageReady {
+				return fmt.Errorf("the healthcheck of the image didn't pass after %v", timeout)
+			}
+			if lastErr != nil {
+				return fmt.Errorf("the health check of the application failed after %v: %v", timeout, lastErr)
+			}
+			return fmt.Errorf("the application didn't answer on port %s after %v", port, timeout)
+		}
+		time.Sleep(time.Second)
+	}
 }
 
 // NewContainerController creates a new controller
@@ -277,6 +567,11 @@ func NewContainerController() (*ContainerController, error) {
 
 	c := new(ContainerController)
 	c.ctx = context.Background()
+	c.quota = newQuotaState()
+	c.db, err = connectToDB()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the database: %v", err)
+	}
 
 	//creating docker client from env
 	c.cli, err = client.NewClientWithOpts(client.FromEnv)
@@ -284,23 +579,50 @@ func NewContainerController() (*ContainerController, error) {
 		return nil, err
 	}
 
+	c.appsNetwork = os.Getenv("APPS_NETWORK")
+	if c.appsNetwork == "" {
+		c.appsNetwork = defaultAppsNetwork
+	}
+	if err := c.EnsureNetwork(c.appsNetwork, map[string]string{"ipaas": "apps"}); err != nil {
+		return nil, fmt.Errorf("error creating the apps network: %v", err)
+	}
+	if err := c.ConnectSelfToNetwork(c.appsNetwork); err != nil {
+		return nil, fmt.Errorf("error connecting to the apps network: %v", err)
+	}
+	if err := c.ConnectSelfToStudentNetworks(); err != nil {
+		return nil, fmt.Errorf("error connecting to the networks of the students: %v", err)
+	}
+
 	c.dbContainersConfigs = map[string]dbContainerConfig{
 		"mysql": {
-			name:  "mysql",
-			image: "mysql:8.0.28-oracle",
-			port:  "3306",
+			name:    "mysql",
+			image:   "mysql:8.0.28-oracle",
+			port:    "3306",
+			dataDir: "/var/lib/mysql",
+			limits:  ResourceLimits{Memory: 768 * units.MiB, PidsLimit: 1024},
 		},
 		"mariadb": {
-			name:  "mariadb",
-			image: "mariadb:10.8.2-rc-focal",
-			port:  "3306",
+			name:    "mariadb",
+			image:   "mariadb:10.8.2-rc-focal",
+			port:    "3306",
+			dataDir: "/var/lib/mysql",
+			limits:  ResourceLimits{Memory: 512 * units.MiB, PidsLimit: 1024},
 		},
 		"mongodb": {
-			name:  "mongodb",
-			image: "mongo:5.0.6",
-			port:  "27017",
+			name:    "mongodb",
+			image:   "mongo:5.0.6",
+			port:    "27017",
+			dataDir: "/data/db",
+			limits:  ResourceLimits{Memory: 768 * units.MiB, PidsLimit: 1024},
 		},
 	}
+	//the limits of the engines can be changed with <ENGINE>_MEMORY_LIMIT, <ENGINE>_CPU_LIMIT and <ENGINE>_PIDS_LIMIT
+	for name, config := range c.dbContainersConfigs {
+		if config.limits, err = limitsFromEnv(strings.ToUpper(name), config.limits); err != nil {
+			return nil, err
+		}
+		c.dbContainersConfigs[name] = config
+	}
 
 	return c, nil
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// status of an application stopped by the platform since it kept crashing
+const AppStatusCrashLooping = "crashlooping"
+
+// number of log lines saved when a crash loop is detected
+const crashLoopLogLines = 50
+
+// max number of retries of the on-failure restart policy
+const maxRestartRetries = 10
+
+// DefaultRestartPolicy is the restart policy of the applications that don't choose one
+var DefaultRestartPolicy = RestartPolicy{Name: "on-failure", MaxRetries: 5}
+
+// a crash loop is detected when an application dies CrashLoopRestarts times in CrashLoopWindow,
+// the values are read from the enviroment variables in loadCrashLoopConfig
+var (
+	CrashLoopRestarts = 5
+	CrashLoopWindow   = 10 * time.Minute
+)
+
+// RestartPolicy is the policy used by docker to restart the container of an application when it exits
+type RestartPolicy struct {
+	Name       string `bson:"name" json:"name"`                                 //no, always, unless-stopped or on-failure
+	MaxRetries int    `bson:"maxRetries,omitempty" json:"maxRetries,omitempty"` //only for on-failure
+}
+
+// CrashLoop is what the platform saved when it stopped a crashing application
+type CrashLoop struct {
+	ExitCode   string    `bson:"exitCode" json:"exitCode"`
+	Restarts   int       `bson:"restarts" json:"restarts"` //deaths counted in the window
+	Logs       []string  `bson:"logs" json:"logs"`         //last lines of the logs
+	DetectedAt time.Time `bson:"detectedAt" json:"detectedAt"`
+}
+
+// Validate checks that the policy is supported by docker and that the retries are allowed
+func (p RestartPolicy) Validate() error {
+	switch p.Name {
+	case "no", "always", "unless-stopped":
+		if p.MaxRetries != 0 {
+			return fmt.Errorf("the max retries can only be set with the on-failure restart policy")
+		}
+	case "on-failure":
+		if p.MaxRetries < 0 || p.MaxRetries > maxRestartRetries {
+			return fmt.Errorf("the max retries must be between 0 and %d", maxRestartRetries)
+		}
+	default:
+		return fmt.Errorf("invalid restart policy %q, must be no, always, unless-stopped or on-failure", p.Name)
+	}
+	return nil
+}
+
+// OrDefault returns the default policy if the policy is not set
+func (p RestartPolicy) OrDefault() RestartPolicy {
+	if p.Name == "" {
+		return DefaultRestartPolicy
+	}
+	return p
+}
+
+// Docker converts the policy in the docker one
+func (p RestartPolicy) Docker() container.RestartPolicy {
+	return container.RestartPolicy{
+		Name:              p.Name,
+		MaximumRetryCount: p.MaxRetries,
+	}
+}
+
+// SetRestartPolicy changes the restart policy of a running container
+func (c ContainerController) SetRestartPolicy(id string, policy RestartPolicy) error {
+	_, err := c.cli.ContainerUpdate(c.ctx, id, container.UpdateConfig{RestartPolicy: policy.Docker()})
+	return err
+}
+
+// GetLastLogLines returns the last n lines of the logs (stdout and stderr) of a container
+func (c ContainerController) GetLastLogLines(id string, n int) ([]string, error) {
+	reader, err := c.cli.ContainerLogs(c.ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(n),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	//the containers without a tty have the streams multiplexed
+	var logs bytes.Buffer
+	if _, err := stdcopy.StdCopy(&logs, &logs, reader); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(&logs)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// checkCrashLoop counts the deaths of an application in the crash loop window (the current one included),
+// if they are too many the restarts are disabled, the container is stopped and the app is marked as crashlooping.
+// The deaths before the last start from the user don't count so a crashlooping app can be started again
+func (c ContainerController) checkCrashLoop(app Application, exitCode string, db *mongo.Database) (bool, error) {
+	since := time.Now().Add(-CrashLoopWindow)
+	if app.UserStartedAt != nil && app.UserStartedAt.After(since) {
+		since = *app.UserStartedAt
+	}
+	deaths, err := db.Collection("appEvents").CountDocuments(context.TODO(), bson.M{
+		"applicationID": app.ID,
+		"containerID":   app.ContainerID,
+		"action":        "die",
+		"time":          bson.M{"$gte": since},
+	})
+	if err != nil {
+		return false, err
+	}
+	if int(deaths) < CrashLoopRestarts {
+		return false, nil
+	}
+
+	//stop restarting it, the user has to fix the application and update it (or restart it)
+	if err := c.SetRestartPolicy(app.ContainerID, RestartPolicy{Name: "no"}); err != nil {
+		return false, err
+	}
+	timeout := time.Duration(0)
+	if err := c.cli.ContainerStop(c.ctx, app.ContainerID, &timeout); err != nil {
+		log.Printf("[ERROR] can't stop the crashlooping container %s: %v", app.ContainerID, err)
+	}
+
+	logs, err := c.GetLastLogLines(app.ContainerID, crashLoopLogLines)
+	if err != nil {
+		logs = []string{"unable to read the logs: " + err.Error()}
+	}
+
+	crashLoop := CrashLoop{
+		ExitCode:   exitCode,
+		Restarts:   int(deaths),
+		Logs:       logs,
+		DetectedAt: time.Now(),
+	}
+	_, err = db.Collection("applications").UpdateOne(context.TODO(), bson.M{"_id": app.ID}, bson.M{"$set": bson.M{
+		"status":    AppStatusCrashLooping,
+		"crashLoop": crashLoop,
+	}})
+	return true, err
+}
+
+// loadCrashLoopConfig reads the crash loop detection settings from the enviroment variables, the empty ones are ignored:
+// CRASHLOOP_RESTARTS (5), CRASHLOOP_WINDOW (10m)
+func loadCrashLoopConfig() error {
+	if restarts := os.Getenv("CRASHLOOP_RESTARTS"); restarts != "" {
+		value, err := strconv.Atoi(strings.TrimSpace(restarts))
+		if err != nil || value <= 0 {
+			return fmt.Errorf("invalid CRASHLOOP_RESTARTS: %s", restarts)
+		}
+		CrashLoopRestarts = value
+	}
+
+	if window := os.Getenv("CRASHLOOP_WINDOW"); window != "" {
+		value, err := time.ParseDuration(strings.TrimSpace(window))
+		if err != nil {
+			return fmt.Errorf("invalid CRASHLOOP_WINDOW: %v", err)
+		}
+		CrashLoopWindow = value
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestRestartPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RestartPolicy
+		valid  bool
+	}{
+		{"No restarts", RestartPolicy{Name: "no"}, true},
+		{"Always", RestartPolicy{Name: "always"}, true},
+		{"Unless stopped", RestartPolicy{Name: "unless-stopped"}, true},
+		{"On failure", RestartPolicy{Name: "on-failure", MaxRetries: 3}, true},
+		{"On failure without limit", RestartPolicy{Name: "on-failure"}, true},
+		{"Too many retries", RestartPolicy{Name: "on-failure", MaxRetries: maxRestartRetries + 1}, false},
+		{"Retries without on-failure", RestartPolicy{Name: "always", MaxRetries: 3}, false},
+		{"Unknown policy", RestartPolicy{Name: "sometimes"}, false},
+		{"Empty policy", RestartPolicy{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.policy.Validate()
+			if test.valid && err != nil {
+				t.Errorf("expected a valid policy, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("expected an error for %+v", test.policy)
+			}
+		})
+	}
+}
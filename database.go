@@ -2,16 +2,23 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/go-connections/nat"
 )
 
 type dbContainerConfig struct {
-	name  string
-	image string
-	port  string
+	name    string
+	image   string
+	port    string
+	dataDir string         //directory where the engine saves the data, the volume of the database is mounted on it
+	limits  ResourceLimits //resource limits of the engine, override the default ones
 }
 
 type dbPost struct {
@@ -20,66 +27,226 @@ type dbPost struct {
 	DbType            string `json:"databaseType"`
 	DbVersion         string `json:"databaseVersion"`
 	DbTableCollection string `json:"databaseTable"`
+	Public            bool   `json:"public,omitempty"` //publish the port on the host, otherwise only the linked applications reach it
+}
+
+// keys of the envs with the root password of each database engine
+var dbPasswordEnvs = map[string]string{
+	"mysql":   "MYSQL_ROOT_PASSWORD",
+	"mariadb": "MYSQL_ROOT_PASSWORD",
+	"mongodb": "MONGO_INITDB_ROOT_PASSWORD",
+}
+
+// DatabaseCredentials are the root credentials of a database
+type DatabaseCredentials struct {
+	User     string `json:"user"`
+	Password string `json:"pass"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Database string `json:"database,omitempty"`
+	URI      string `json:"uri"`
+}
+
+// DatabaseEnvs returns the envs of the container of a new database of the engine, the password is a secret env.
+// The database is created only if dbName is not empty
+func DatabaseEnvs(engine, password, dbName string) ([]Env, error) {
+	var envs []Env
+	switch engine {
+	case "mysql", "mariadb":
+		envs = []Env{{Key: "MYSQL_ROOT_PASSWORD", Value: password, Secret: true}}
+		if dbName != "" {
+			envs = append(envs, Env{Key: "MYSQL_DATABASE", Value: dbName})
+		}
+	case "mongodb":
+		envs = []Env{
+			{Key: "MONGO_INITDB_ROOT_USERNAME", Value: "root"},
+			{Key: "MONGO_INITDB_ROOT_PASSWORD", Value: password, Secret: true},
+		}
+		//!apparently this part doesn't work, the user can create the db on its own though
+		if dbName != "" {
+			envs = append(envs, Env{Key: "MONGO_INITDB_DATABASE", Value: dbName})
+		}
+	default:
+		return nil, fmt.Errorf("Invalid db type, must be mysql, mariadb or mongodb")
+	}
+	return envs, nil
+}
+
+// GetDatabaseCredentials returns the credentials of a database from its envs, the database is reached on host:port
+func GetDatabaseCredentials(db Application, host, port string) (DatabaseCredentials, error) {
+	passwordKey, found := dbPasswordEnvs[db.Lang]
+	if !found {
+		return DatabaseCredentials{}, fmt.Errorf("the credentials of this database were not saved when it was created")
+	}
+	envs := make(map[string]string)
+	for _, env := range db.Envs {
+		envs[env.Key] = env.Value
+	}
+	password, found := envs[passwordKey]
+	if !found {
+		return DatabaseCredentials{}, fmt.Errorf("the credentials of this database were not saved when it was created")
+	}
+
+	credentials := DatabaseCredentials{
+		User:     "root",
+		Password: password,
+		Host:     host,
+		Port:     port,
+	}
+	if db.Lang == "mongodb" {
+		if user := envs["MONGO_INITDB_ROOT_USERNAME"]; user != "" {
+			credentials.User = user
+		}
+		credentials.Database = envs["MONGO_INITDB_DATABASE"]
+		//the root user is created in the admin database
+		credentials.URI = fmt.Sprintf("mongodb://%s:%s@%s:%s/%s?authSource=admin", credentials.User, password, host, port, credentials.Database)
+	} else {
+		credentials.Database = envs["MYSQL_DATABASE"]
+		credentials.URI = fmt.Sprintf("mysql://%s:%s@%s:%s/%s", credentials.User, password, host, port, credentials.Database)
+	}
+	return credentials, nil
+}
+
+// UserDatabaseCredentials returns the credentials that the owner uses to connect to a database: the public
+// databases are reached on the ip of the server, the private ones only on the network of the student
+func UserDatabaseCredentials(db Application) (DatabaseCredentials, error) {
+	if db.ExternalPort != "" {
+		return GetDatabaseCredentials(db, os.Getenv("IP"), db.ExternalPort)
+	}
+	return GetDatabaseCredentials(db, databaseHostname(db), db.Port)
+}
+
+// RotateDatabasePassword changes the password of the root user inside the running database container.
+// The passwords are passed as envs of the command so they don't end up in the command line.
+// The accounts of mysql and mariadb (root@% and root@localhost) are changed in a single statement, if it
+// fails the old password is set again on both so the saved credentials keep working
+func (c ContainerController) RotateDatabasePassword(containerID, engine, user, oldPassword, newPassword string) error {
+	var cmd []string
+	switch engine {
+	case "mysql", "mariadb":
+		//the newer mariadb images don't have the mysql client
+		cmd = []string{"sh", "-c", `$(command -v mysql || command -v mariadb) -u"$IPAAS_USER" -e "ALTER USER IF EXISTS '$IPAAS_USER'@'%' IDENTIFIED BY '$IPAAS_NEW_PASSWORD', '$IPAAS_USER'@'localhost' IDENTIFIED BY '$IPAAS_NEW_PASSWORD';"`}
+	case "mongodb":
+		cmd = []string{"sh", "-c", `$(command -v mongosh || command -v mongo) --quiet -u "$IPAAS_USER" -p "$MYSQL_PWD" --authenticationDatabase admin admin --eval "db.changeUserPassword('$IPAAS_USER', '$IPAAS_NEW_PASSWORD')"`}
+	default:
+		return fmt.Errorf("unknown database engine %s", engine)
+	}
+
+	err := c.changeDatabasePassword(containerID, cmd, user, oldPassword, newPassword)
+	if err == nil || engine == "mongodb" {
+		return err
+	}
+	//mariadb doesn't roll back a statement that failed halfway, the accounts already changed are set back
+	//logging in with the password that still works on localhost
+	for _, current := range []string{oldPassword, newPassword} {
+		if c.changeDatabasePassword(containerID, cmd, user, current, oldPassword) == nil {
+			break
+		}
+	}
+	return err
+}
+
+// changeDatabasePassword runs the command that changes the password of the user from current to next
+func (c ContainerController) changeDatabasePassword(containerID string, cmd []string, user, current, next string) error {
+	//MYSQL_PWD is read by the mysql client as the password, the mongo shell gets it with -p
+	output, exitCode, err := c.ExecCommand(containerID, cmd, []string{
+		"IPAAS_USER=" + user,
+		"MYSQL_PWD=" + current,
+		"IPAAS_NEW_PASSWORD=" + next,
+	})
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("the password change exited with code %d: %s", exitCode, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// dbVolumeName returns the name of the volume with the data of a database
+func dbVolumeName(db Application) string {
+	return "ipaas-db-" + db.ID.Hex()
+}
+
+// EnsureDBVolume creates the volume of a database labelled with its owner and engine,
+// it's kept when the container is recreated and removed only when the database is deleted
+func (c ContainerController) EnsureDBVolume(name string, studentID int, engine string) error {
+	_, _, err := c.EnsureVolume(name, map[string]string{
+		ownerLabel: strconv.Itoa(studentID),
+		"type":     "db",
+		"dbType":   engine,
+	})
+	return err
 }
 
 // TODO: ADD DB NAME
-// create a new database container given the db type, image, port, enviroment variables and volume
-// it returns the container id and an error
-func (c ContainerController) CreateNewDB(conf dbContainerConfig, env []string) (string, error) {
+// create a new database container of a student given the db type, image, port, enviroment variables, volume and resource limits.
+// The volume is mounted on the data directory of the engine. The container is attached to the network of the student where
+// it's reached on hostname, the port is published on the host only if public is true. It returns the container id and an error
+func (c ContainerController) CreateNewDB(studentID int, hostname string, conf dbContainerConfig, env []string, volume string, limits ResourceLimits, public bool) (string, error) {
 	//container config (image and environment variables)
 	config := &container.Config{
 		Image: conf.image,
 		Env:   env,
-	}
-	//host config
-	hostBinding := nat.PortBinding{
-		HostIP: "0.0.0.0",
-		//HostPort is the port that the host will listen to, since it's not set
-		//the docker engine will assign a random open port
-		// HostPort: "8080",
+		Labels: map[string]string{
+			ownerLabel: strconv.Itoa(studentID),
+		},
 	}
 
-	//set the port for the container (internal one)
+	//the private databases are only reachable by the applications of the student
+	var portBinding nat.PortMap
+	if public {
+		//host config
+		hostBinding := nat.PortBinding{
+			HostIP: "0.0.0.0",
+			//HostPort is the port that the host will listen to, since it's not set
+			//the docker engine will assign a random open port
+			// HostPort: "8080",
+		}
 
-	containerPort, err := nat.NewPort("tcp", conf.port)
-	fmt.Println("container port" + containerPort)
-	if err != nil {
-		return "", err
-	}
+		//set the port for the container (internal one)
+		containerPort, err := nat.NewPort("tcp", conf.port)
+		if err != nil {
+			return "", err
+		}
 
-	//set a slice of possible port bindings
-	//since it's a db container we need just one
-	portBinding := nat.PortMap{containerPort: []nat.PortBinding{hostBinding}}
+		//set a slice of possible port bindings
+		//since it's a db container we need just one
+		portBinding = nat.PortMap{containerPort: []nat.PortBinding{hostBinding}}
+	}
 
 	//set the configuration of the host
 	//set the port bindings and the restart policy
 	//!choose a restart policy
 	hostConfig := &container.HostConfig{
 		PortBindings: portBinding,
+		Resources:    limits.HostResources(),
 		RestartPolicy: container.RestartPolicy{
 			Name:              "on-failure",
 			MaximumRetryCount: 5,
 		},
-		// Mounts: []mount.Mount{
-		// 	{
-		// 		Type:   "volume",
-		// 		Source: volumePath,
-		// 		Target: "/var/lib/mysql",
-		// 	},
-		// },
-	}
-
-	// networkConf := &network.NetworkingConfig{
-	// 	EndpointsConfig: map[string]*network.EndpointSettings{
-	// 		"ipaas-network": {
-	// 			NetworkID: "cf8bc28f9dcd413ece744e799e24c9be15cecae17e8225dc7e3b25db97644e10",
-	// 		},
-	// 	},
-	// }
+		Mounts: []mount.Mount{
+			{
+				Type:   mount.TypeVolume,
+				Source: volume,
+				Target: conf.dataDir,
+			},
+		},
+	}
+
+	studentNetwork, err := c.EnsureStudentNetwork(studentID)
+	if err != nil {
+		return "", fmt.Errorf("error creating the network of the student: %v", err)
+	}
+	networkConf := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			studentNetwork: {Aliases: []string{hostname}},
+		},
+	}
 
 	//create the container
 	//!set a name to identify the container (<student-name>.<registration_number>-<db-name>)
-	resp, err := c.cli.ContainerCreate(c.ctx, config, hostConfig, nil, nil, "")
+	resp, err := c.cli.ContainerCreate(c.ctx, config, hostConfig, networkConf, nil, "")
 	if err != nil {
 		return "", err
 	}
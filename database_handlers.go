@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
-	"os"
 	"time"
 
 	resp "github.com/vano2903/ipaas/responser"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // ! still under development
@@ -43,53 +45,79 @@ func (h Handler) NewDBHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//generate env variables for the container
+	//generate env variables for the container, they are saved (encrypted) so the credentials can be read later
 	password := generateRandomString(16)
-	var env []string
-	switch dbPost.DbType {
-	case "mysql", "mariadb":
-		//root password
-		env = []string{
-			"MYSQL_ROOT_PASSWORD=" + password,
-		}
-		//set a database if it's not empty
-		if dbPost.DbName != "" {
-			env = append(env, "MYSQL_DATABASE="+dbPost.DbName)
-		}
-	case "mongodb":
-		//root password
-		env = []string{
-			"MONGO_INITDB_ROOT_USERNAME=" + "root",
-			"MONGO_INITDB_ROOT_PASSWORD=" + password,
-		}
-		//set a database if it's not empty
-		//!apparently this part doesn't work, the user can create the db on its own though
-		if dbPost.DbName != "" {
-			env = append(env, "MONGO_INITDB_DATABASE="+dbPost.DbName)
+	envs, err := DatabaseEnvs(dbPost.DbType, password, dbPost.DbName)
+	if err != nil {
+		resp.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	//check if the student can create another database
+	dbConfig := h.cc.dbContainersConfigs[dbPost.DbType]
+	limits := GetResourceLimits(student, dbConfig.limits)
+	//the lock is held until the database is saved, it's counted in the usage only then
+	unlock := h.cc.LockQuota(student.ID)
+	defer unlock()
+	if err := h.cc.CheckQuota(student, "database", limits.Memory, conn); err != nil {
+		if _, ok := err.(*QuotaError); ok {
+			resp.Error(w, http.StatusForbidden, err.Error())
+			return
 		}
-	default:
-		resp.Error(w, http.StatusBadRequest, "Invalid db type, must be mysql, mariadb or mongodb")
+		resp.Errorf(w, http.StatusInternalServerError, "error checking the quota: %v", err.Error())
 		return
 	}
 
-	//create the database container
-	id, err := h.cc.CreateNewDB(h.cc.dbContainersConfigs[dbPost.DbType], env)
+	var Db Application
+	Db.ID = primitive.NewObjectID()
+
+	//the data is saved on a volume so it's not lost if the container is recreated
+	volume := dbVolumeName(Db)
+	if err := h.cc.EnsureDBVolume(volume, student.ID, dbPost.DbType); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error creating the volume of the database: %v", err.Error())
+		return
+	}
+
+	//create the database container on the network of the student
+	id, err := h.cc.CreateNewDB(student.ID, databaseHostname(Db), dbConfig, EnvList(envs), volume, limits, dbPost.Public)
 	if err != nil {
+		if _, err := h.cc.RemoveVolume(volume); err != nil {
+			log.Printf("[ERROR] can't remove the volume %s: %v", volume, err)
+		}
 		resp.Errorf(w, http.StatusInternalServerError, "error creating a new database: %v", err.Error())
 		return
 	}
+	//if the database can't be saved the container and its volume are removed, nothing else would delete them
+	cleanup := func() {
+		if err := h.cc.DeleteContainer(id); err != nil {
+			log.Printf("[ERROR] can't remove the container %s: %v", id, err)
+		}
+		if _, err := h.cc.RemoveVolume(volume); err != nil {
+			log.Printf("[ERROR] can't remove the volume %s: %v", volume, err)
+		}
+	}
 
-	//get the external port
-	port, err := h.cc.GetContainerExternalPort(id, h.cc.dbContainersConfigs[dbPost.DbType].port)
+	//get the external port, only the public databases have one
+	var port string
+	if dbPost.Public {
+		port, err = h.cc.GetContainerExternalPort(id, h.cc.dbContainersConfigs[dbPost.DbType].port)
+		if err != nil {
+			cleanup()
+			resp.Errorf(w, http.StatusInternalServerError, "error getting the external port: %v", err.Error())
+			return
+		}
+	}
+
+	//get the status of the database, the event handler will keep it updated
+	status, err := h.cc.GetContainerStatus(id)
 	if err != nil {
-		resp.Errorf(w, http.StatusInternalServerError, "error getting the external port: %v", err.Error())
+		cleanup()
+		resp.Errorf(w, http.StatusInternalServerError, "error getting the status of the container: %v", err.Error())
 		return
 	}
 
-	var Db Application
-	Db.ID = primitive.NewObjectID()
 	Db.ContainerID = id
-	Db.Status = "up"
+	Db.Status = status
 	Db.StudentID = student.ID
 	Db.Type = "database"
 	Db.Name = fmt.Sprintf("%d:%s/%s", student.ID, dbPost.DbType, dbPost.DbName)
@@ -97,26 +125,121 @@ func (h Handler) NewDBHandler(w http.ResponseWriter, r *http.Request) {
 	Db.Port = h.cc.dbContainersConfigs[dbPost.DbType].port
 	Db.ExternalPort = port
 	Db.CreatedAt = time.Now()
-	// Db.Envs =
+	Db.Limits = limits
+	Db.Lang = dbPost.DbType
+	Db.Envs = envs
+	Db.Volume = volume
 
 	_, err = conn.Collection("applications").InsertOne(context.TODO(), Db)
 	if err != nil {
+		cleanup()
 		resp.Errorf(w, http.StatusInternalServerError, "error inserting the application: %v", err.Error())
 		return
 	}
 
+	credentials, _ := UserDatabaseCredentials(Db)
 	json := map[string]interface{}{
-		"important": "the password is for root user of the server",
-		"user":      "root",
-		"port":      port,
-		"pass":      password,
+		"important": "the password is for root user of the server, it can be read again from the credentials of the database",
+		"user":      credentials.User,
+		"host":      credentials.Host,
+		"port":      credentials.Port,
+		"pass":      credentials.Password,
+		"uri":       credentials.URI,
 	}
-	if dbPost.DbType == "mongodb" {
-		json["uri"] = fmt.Sprintf("mongodb://root:%s@%s:%s", password, os.Getenv("IP"), port)
+	if !dbPost.Public {
+		json["important"] = "the password is for root user of the server, it can be read again from the credentials of the database. " +
+			"The database is private: link it to an application to reach it or use the terminal of the container"
 	}
 	resp.SuccessParse(w, http.StatusOK, "New DB created", json)
 }
 
+// getOwnedDatabase returns the database with the {containerID} of the url if it's owned by the student who made the request
+func (h Handler) getOwnedDatabase(r *http.Request, conn *mongo.Database) (Application, int, error) {
+	db, code, err := h.getOwnedApplication(r, conn)
+	if err != nil {
+		return Application{}, code, err
+	}
+	if db.Type != "database" {
+		return Application{}, http.StatusBadRequest, fmt.Errorf("the application is not a database")
+	}
+	return db, http.StatusOK, nil
+}
+
+// returns the root credentials of a database
+func (h Handler) GetDBCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.TODO())
+
+	db, code, err := h.getOwnedDatabase(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+
+	credentials, err := UserDatabaseCredentials(db)
+	if err != nil {
+		resp.Error(w, http.StatusNotFound, err.Error())
+		return
+	}
+	resp.SuccessParse(w, http.StatusOK, "credentials of the database", credentials)
+}
+
+// generates a new root password for a database, it's changed inside the container (that must be running) and saved,
+// the containers of the linked applications are recreated with it
+func (h Handler) RotateDBCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	//connect to the db
+	conn, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer conn.Client().Disconnect(context.TODO())
+
+	db, code, err := h.getOwnedDatabase(r, conn)
+	if err != nil {
+		resp.Error(w, code, err.Error())
+		return
+	}
+
+	credentials, err := UserDatabaseCredentials(db)
+	if err != nil {
+		resp.Error(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if db.Status != AppStatusRunning {
+		resp.Error(w, http.StatusConflict, "the database must be running to change its password")
+		return
+	}
+
+	password := generateRandomString(16)
+	if err := h.cc.RotateDatabasePassword(db.ContainerID, db.Lang, credentials.User, credentials.Password, password); err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error changing the password: %v", err.Error())
+		return
+	}
+
+	envs := SetEnvs(db.Envs, []Env{{Key: dbPasswordEnvs[db.Lang], Value: password, Secret: true}})
+	if _, err := conn.Collection("applications").UpdateOne(context.TODO(), bson.M{"_id": db.ID}, bson.M{"$set": bson.M{"envs": envs}}); err != nil {
+		//the new password would be lost, the old one is restored
+		if err := h.cc.RotateDatabasePassword(db.ContainerID, db.Lang, credentials.User, password, credentials.Password); err != nil {
+			log.Printf("[ERROR] can't restore the password of the database %s: %v", db.ContainerID, err)
+		}
+		resp.Errorf(w, http.StatusInternalServerError, "error saving the new password: %v", err.Error())
+		return
+	}
+
+	//the linked applications are recreated with the new password
+	h.updateLinkedApplications(db.ID, conn)
+
+	db.Envs = envs
+	credentials, _ = UserDatabaseCredentials(db)
+	resp.SuccessParse(w, http.StatusOK, "password of the database changed", credentials)
+}
+
 //! under development, not implementing it now
 //! if you want to export the database use an external tool
 // /user/
@@ -19,9 +19,12 @@ type db struct {
 func TestCreateNewDB(t *testing.T) {
 	c, _ := NewContainerController()
 
-	_, err := c.CreateNewDB(c.dbContainersConfigs["mysql"], []string{
+	if err := c.EnsureDBVolume("ipaas-db-test", 18008, "mysql"); err != nil {
+		t.Fatalf("error creating the volume: %s", err)
+	}
+	_, err := c.CreateNewDB(18008, "db-test", c.dbContainersConfigs["mysql"], []string{
 		"MYSQL_ROOT_PASSWORD=ciao",
-	})
+	}, "ipaas-db-test", DefaultLimits, true)
 	if err != nil {
 		t.Errorf("error has been generated: %s", err)
 	}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// phases of a deploy job, a job always starts as queued and ends as failed or succeeded
+const (
+	JobPhaseQueued    = "queued"
+	JobPhaseCloning   = "cloning"
+	JobPhaseBuilding  = "building"
+	JobPhaseStarting  = "starting"
+	JobPhaseFailed    = "failed"
+	JobPhaseSucceeded = "succeeded"
+)
+
+// types of deploy job, a create job deploys a new application, an update job replaces the container
+// of an existing one with a new build, a rollback job replaces it with the image of a previous release
+// and an envs job replaces it with one of the same image with other envs
+const (
+	JobTypeCreate   = "create"
+	JobTypeUpdate   = "update"
+	JobTypeRollback = "rollback"
+	JobTypeEnvs     = "envs"
+)
+
+// time given to a new container of an application to become healthy during a deploy
+const deployHealthTimeout = 60 * time.Second
+
+// default number of builds that can run at the same time, can be changed with MAX_CONCURRENT_BUILDS
+const defaultMaxConcurrentBuilds = 2
+
+// DeployJob is a persistent deploy request saved in the deployJobs collection,
+// it's updated by the workers every time the job moves to another phase
+type DeployJob struct {
+	ID            primitive.ObjectID     `bson:"_id" json:"id"`
+	StudentID     int                    `bson:"studentID" json:"studentID"`
+	Type          string                 `bson:"type" json:"type"`
+	ApplicationID primitive.ObjectID     `bson:"applicationID,omitempty" json:"-"`
+	ReleaseID     primitive.ObjectID     `bson:"releaseID,omitempty" json:"-"`
+	Envs          []Env                  `bson:"envs,omitempty" json:"-"`   //new envs of an envs job
+	Links         *[]DatabaseLink        `bson:"links,omitempty" json:"-"`  //new links of an envs job, nil keeps the current ones
+	Limits        *ResourceLimits        `bson:"limits,omitempty" json:"-"` //limits reserved in the quota by a create job
+	Phase         string                 `bson:"phase" json:"phase"`
+	Error         string                 `bson:"error,omitempty" json:"error,omitempty"`
+	Detection     *RuntimeDetection      `bson:"detection,omitempty" json:"detection,omitempty"`
+	BuildError    *BuildError            `bson:"buildError,omitempty" json:"buildError,omitempty"`
+	PolicyError   *DockerfilePolicyError `bson:"policyError,omitempty" json:"policyError,omitempty"`
+	Log           []string               `bson:"log,omitempty" json:"-"`
+	AppPost       AppPost                `bson:"appPost" json:"appPost"`
+	ContainerID   string                 `bson:"containerID,omitempty" json:"containerID,omitempty"`
+	URL           string                 `bson:"url,omitempty" json:"url,omitempty"`
+	CreatedAt     time.Time              `bson:"createdAt" json:"createdAt"`
+	UpdatedAt     time.Time              `bson:"updatedAt" json:"updatedAt"`
+}
+
+// IsFinished returns true if the job reached a terminal phase
+func (j DeployJob) IsFinished() bool {
+	return j.Phase == JobPhaseFailed || j.Phase == JobPhaseSucceeded
+}
+
+// DeployQueue holds the ids of the jobs waiting for a worker
+type DeployQueue struct {
+	jobs    chan primitive.ObjectID
+	workers int
+}
+
+// NewDeployQueue creates a queue that will be consumed by the given number of workers
+func NewDeployQueue(workers int) *DeployQueue {
+	if workers <= 0 {
+		workers = defaultMaxConcurrentBuilds
+	}
+	return &DeployQueue{
+		jobs:    make(chan primitive.ObjectID, 100),
+		workers: workers,
+	}
+}
+
+// Enqueue adds a job to the queue without blocking the caller
+func (q *DeployQueue) Enqueue(jobID primitive.ObjectID) {
+	go func() {
+		q.jobs <- jobID
+	}()
+}
+
+// NewDeployJob saves a new queued job that creates an application on the database and adds it to the queue,
+// the limits are reserved in the quota of the student until the job ends
+func (h Handler) NewDeployJob(studentID int, appPost AppPost, limits ResourceLimits) (DeployJob, error) {
+	return h.queueJob(DeployJob{
+		StudentID: studentID,
+		Type:      JobTypeCreate,
+		//the id of the application is chosen now, so a resumed job knows if it was already saved
+		ApplicationID: primitive.NewObjectID(),
+		AppPost:       appPost,
+		Limits:        &limits,
+	})
+}
+
+// NewUpdateJob saves a new queued job that updates an existing application and adds it to the queue
+func (h Handler) NewUpdateJob(studentID int, applicationID primitive.ObjectID) (DeployJob, error) {
+	return h.queueJob(DeployJob{
+		StudentID:     studentID,
+		Type:          JobTypeUpdate,
+		ApplicationID: applicationID,
+	})
+}
+
+// NewRollbackJob saves a new queued job that brings back a release of an application and adds it to the queue
+func (h Handler) NewRollbackJob(studentID int, applicationID, releaseID primitive.ObjectID) (DeployJob, error) {
+	return h.queueJob(DeployJob{
+		StudentID:     studentID,
+		Type:          JobTypeRollback,
+		ApplicationID: applicationID,
+		ReleaseID:     releaseID,
+	})
+}
+
+// NewEnvsJob saves a new queued job that recreates the container of an application with the envs and the linked
+// databases (nil keeps the current links) and adds it to the queue, they are saved on the application only if the job succeeds
+func (h Handler) NewEnvsJob(studentID int, applicationID primitive.ObjectID, envs []Env, links *[]DatabaseLink) (DeployJob, error) {
+	return h.queueJob(DeployJob{
+		StudentID:     studentID,
+		Type:          JobTypeEnvs,
+		ApplicationID: applicationID,
+		Envs:          envs,
+		Links:         links,
+	})
+}
+
+// queueJob saves the job as queued and adds it to the queue
+func (h Handler) queueJob(job DeployJob) (DeployJob, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return DeployJob{}, err
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	job.ID = primitive.NewObjectID()
+	job.Phase = JobPhaseQueued
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = time.Now()
+
+	if _, err := db.Collection("deployJobs").InsertOne(context.TODO(), job); err != nil {
+		return DeployJob{}, err
+	}
+
+	h.queue.Enqueue(job.ID)
+	return job, nil
+}
+
+// GetDeployJob returns the job with the given id
+func GetDeployJob(jobID primitive.ObjectID) (DeployJob, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return DeployJob{}, err
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	var job DeployJob
+	err = db.Collection("deployJobs").FindOne(context.TODO(), bson.M{"_id": jobID}).Decode(&job)
+	return job, err
+}
+
+// hasRunningJob returns true if an update or a rollback of the application is queued or running
+func hasRunningJob(applicationID primitive.ObjectID, db *mongo.Database) (bool, error) {
+	running, err := db.Collection("deployJobs").CountDocuments(context.TODO(), bson.M{
+		"applicationID": applicationID,
+		"phase":         bson.M{"$nin": []string{JobPhaseFailed, JobPhaseSucceeded}},
+	})
+	return running > 0, err
+}
+
+// setJobPhase updates the phase of the job, fields can contain other values to set
+func setJobPhase(jobID primitive.ObjectID, phase string, fields bson.M) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	if fields == nil {
+		fields = bson.M{}
+	}
+	fields["phase"] = phase
+	fields["updatedAt"] = time.Now()
+
+	_, err = db.Collection("deployJobs").UpdateOne(context.TODO(), bson.M{"_id": jobID}, bson.M{"$set": fields})
+	return err
+}
+
+// setJobLog saves the whole build log of a job
+func setJobLog(jobID primitive.ObjectID, lines []string) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	_, err = db.Collection("deployJobs").UpdateOne(context.TODO(), bson.M{"_id": jobID}, bson.M{"$set": bson.M{"log": lines}})
+	return err
+}
+
+// failJob sets the job as failed saving the error message,
+// if the image build failed the failing step is saved too
+func failJob(jobID primitive.ObjectID, err error) {
+	log.Printf("[ERROR] Deploy job %s failed: %v\n", jobID.Hex(), err)
+	fields := bson.M{"error": err.Error()}
+	var buildErr *BuildError
+	if errors.As(err, &buildErr) {
+		fields["buildError"] = buildErr
+	}
+	var policyErr *DockerfilePolicyError
+	if errors.As(err, &policyErr) {
+		fields["policyError"] = policyErr
+	}
+	if err := setJobPhase(jobID, JobPhaseFailed, fields); err != nil {
+		log.Printf("[ERROR] Error setting job %s as failed: %v\n", jobID.Hex(), err)
+	}
+}
+
+// DeployWorker waits for jobs on the queue and runs them one at a time,
+// the number of workers started is the limit of concurrent builds
+func (h Handler) DeployWorker() {
+	for jobID := range h.queue.jobs {
+		job, err := GetDeployJob(jobID)
+		if err != nil {
+			log.Printf("[ERROR] Error getting deploy job %s: %v\n", jobID.Hex(), err)
+			continue
+		}
+		if job.IsFinished() {
+			continue
+		}
+		log.Printf("[INFO] Running deploy job %s\n", jobID.Hex())
+		buildLog := h.buildLogs.New(jobID.Hex())
+		switch job.Type {
+		case JobTypeUpdate:
+			err = h.runUpdateJob(job, buildLog)
+		case JobTypeRollback:
+			err = h.runRollbackJob(job, buildLog)
+		case JobTypeEnvs:
+			err = h.runEnvsJob(job, buildLog)
+		default:
+			err = h.runDeployJob(job, buildLog)
+		}
+		if err != nil {
+			buildLog.Append("deploy failed: " + err.Error())
+		}
+
+		//save the log before closing it so the clients streaming it can read it from the database
+		if err := setJobLog(jobID, buildLog.Lines()); err != nil {
+			log.Printf("[ERROR] Error saving the log of job %s: %v\n", jobID.Hex(), err)
+		}
+		if err != nil {
+			failJob(jobID, err)
+		} else {
+			log.Printf("[INFO] Deploy job %s succeeded\n", jobID.Hex())
+		}
+		h.buildLogs.Finish(jobID.Hex())
+	}
+}
+
+// StartDeployWorkers starts the workers and requeues the jobs that didn't finish
+// (for example because the server was restarted while building)
+func (h Handler) StartDeployWorkers() {
+	for i := 0; i < h.queue.workers; i++ {
+		go h.DeployWorker()
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		log.Printf("[ERROR] Error connecting to database: %v\n", err)
+		return
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	cur, err := db.Collection("deployJobs").Find(context.TODO(), bson.M{"phase": bson.M{"$nin": []string{JobPhaseFailed, JobPhaseSucceeded}}})
+	if err != nil {
+		log.Printf("[ERROR] Error getting the unfinished deploy jobs: %v\n", err)
+		return
+	}
+	var jobs []DeployJob
+	if err := cur.All(context.TODO(), &jobs); err != nil {
+		log.Printf("[ERROR] Error reading the unfinished deploy jobs: %v\n", err)
+		return
+	}
+	for _, job := range jobs {
+		log.Printf("[INFO] Resuming deploy job %s (was %s)\n", job.ID.Hex(), job.Phase)
+		if err := setJobPhase(job.ID, JobPhaseQueued, nil); err != nil {
+			log.Printf("[ERROR] Error requeueing job %s: %v\n", job.ID.Hex(), err)
+			continue
+		}
+		h.queue.Enqueue(job.ID)
+	}
+}
+
+// createApplicationImage builds the image of an application with the template of the runtime
+// or, for the dockerfile runtime, with the dockerfile of the repo
+func (c ContainerController) createApplicationImage(creatorID, port int, name, branch, repo string, runtime Runtime, dockerfilePath string, limits ResourceLimits, logWriter io.Writer) (string, string, error) {
+	if runtime.Lang == DockerfileRuntime {
+		return c.CreateImageFromRepoDockerfile(creatorID, port, name, branch, repo, dockerfilePath, limits, logWriter)
+	}
+	return c.CreateImage(creatorID, port, name, branch, repo, runtime.Lang, limits, logWriter)
+}
+
+// runDeployJob clones the repo, builds the image, creates and starts the container of a job.
+// Everything created before an error is removed so the user can submit the job again,
+// the output of the build is written to buildLog
+func (h Handler) runDeployJob(job DeployJob, buildLog io.Writer) error {
+	appPost := job.AppPost
+
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	//a job interrupted by a restart of the platform after saving the application is already done
+	if !job.ApplicationID.IsZero() {
+		var app Application
+		err := db.Collection("applications").FindOne(context.TODO(), bson.M{"_id": job.ApplicationID}).Decode(&app)
+		if err == nil {
+			return setJobPhase(job.ID, JobPhaseSucceeded, bson.M{
+				"containerID": app.ContainerID,
+				"url":         app.URL,
+			})
+		}
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+
+	if err := setJobPhase(job.ID, JobPhaseCloning, nil); err != nil {
+		return err
+	}
+
+	//download the repo
+	repo, name, hash, err := h.util.DownloadGithubRepo(job.StudentID, appPost.GithubBranch, appPost.GithubRepoUrl)
+	if err != nil {
+		return fmt.Errorf("error downloading the repo: %v", err)
+	}
+	//remove the repo after creating the application
+	defer os.RemoveAll(repo)
+
+	//check which runtime the repo looks like, if the user didn't choose one the detected one is used
+	detection, err := DetectRuntimeFromPath(repo)
+	if err != nil {
+		return fmt.Errorf("error inspecting the repo: %v", err)
+	}
+	if err := setJobPhase(job.ID, JobPhaseCloning, bson.M{"detection": detection}); err != nil {
+		return err
+	}
+	if appPost.Language == "" || appPost.Language == AutoDetectLanguage {
+		if !detection.Detected() {
+			return fmt.Errorf("unable to detect the language of the repo, choose one of: %v", Langs)
+		}
+		appPost.Language = detection.Lang
+		fmt.Fprintf(buildLog, "detected language: %s\n", detection.Lang)
+	} else if detection.Detected() && !detection.Has(appPost.Language) {
+		fmt.Fprintf(buildLog, "warning: the repo looks like %s but %s was chosen\n", detection.Lang, appPost.Language)
+	}
+
+	runtime, found := GetRuntime(appPost.Language)
+	if !found {
+		return fmt.Errorf("language %s not supported, the supported langs are: %v", appPost.Language, Langs)
+	}
+	if appPost.Port == "" {
+		appPost.Port = runtime.DefaultPort
+	}
+	//with the dockerfile runtime the default port is the first one exposed
+	if appPost.Port == "" && runtime.Lang == DockerfileRuntime {
+		dockerfilePath := appPost.DockerfilePath
+		if dockerfilePath == "" {
+			dockerfilePath = defaultDockerfilePath
+		}
+		if dockerfile, err := ParseDockerfileFromPath(filepath.Join(repo, filepath.Clean(dockerfilePath))); err == nil {
+			if ports := dockerfile.ExposedPorts(); len(ports) > 0 {
+				appPost.Port = ports[0]
+			}
+		}
+	}
+
+	//port to expose for the app
+	port, err := strconv.Atoi(appPost.Port)
+	if err != nil {
+		return fmt.Errorf("error converting the port to an int: %v", err)
+	}
+
+	//resource limits of the runtime and of the student
+	student, err := GetStudentFromID(job.StudentID, db)
+	if err != nil {
+		return fmt.Errorf("error getting the student: %v", err)
+	}
+	limits := GetResourceLimits(student, runtime.Limits)
+
+	//the other deploys could have used the quota while this one was queued or the detected runtime could need more memory
+	if err := h.cc.CheckDeployJobQuota(student, job.ID, limits, db); err != nil {
+		return fmt.Errorf("error checking the quota: %w", err)
+	}
+
+	if err := setJobPhase(job.ID, JobPhaseBuilding, nil); err != nil {
+		return err
+	}
+
+	//create the image from the repo downloaded
+	imageName, imageID, err := h.cc.createApplicationImage(job.StudentID, port, name, appPost.GithubBranch, repo, runtime, appPost.DockerfilePath, limits, buildLog)
+	if err != nil {
+		return fmt.Errorf("error creating the image: %w", err)
+	}
+
+	//the image is kept tagged with the commit so the release can be rolled back
+	image, err := h.cc.TagReleaseImage(imageName, imageID, hash, job.ID.Hex())
+	if err != nil {
+		h.cc.RemoveImage(imageID)
+		return fmt.Errorf("error tagging the image: %v", err)
+	}
+
+	if err := setJobPhase(job.ID, JobPhaseStarting, nil); err != nil {
+		return err
+	}
+
+	//create the container from the image just created
+	restartPolicy := DefaultRestartPolicy
+	if appPost.RestartPolicy != nil {
+		restartPolicy = *appPost.RestartPolicy
+	}
+	containerName := applicationContainerName(job.StudentID, name, appPost.Language)
+	if err := h.removeLeftoverContainer(containerName, db); err != nil {
+		h.cc.RemoveImage(imageID)
+		return fmt.Errorf("error removing the container of an interrupted deploy: %v", err)
+	}
+	id, err := h.cc.CreateNewApplicationFromRepo(job.StudentID, containerName, image, appPost.Envs, limits, restartPolicy)
+	if err != nil {
+		h.cc.RemoveImage(imageID)
+		return fmt.Errorf("error creating the container: %v", err)
+	}
+	//if the deploy fails the container and the image of the release are removed
+	cleanup := func() {
+		h.cc.DeleteContainer(id)
+		h.cc.RemoveImage(imageID)
+	}
+
+	if err := h.cc.cli.ContainerStart(h.cc.ctx, id, types.ContainerStartOptions{}); err != nil {
+		cleanup()
+		return fmt.Errorf("error starting the container: %v", err)
+	}
+
+	//the deploy succeeds only if the application answers
+	fmt.Fprintln(buildLog, "waiting for the application to be healthy")
+	if err := h.cc.WaitUntilHealthy(id, appPost.Port, deployHealthTimeout, appPost.HealthCheck); err != nil {
+		cleanup()
+		return fmt.Errorf("the application is not healthy: %v", err)
+	}
+
+	//name of the application in its url
+	slug, err := uniqueAppSlug(job.StudentID, name, db)
+	if err != nil {
+		cleanup()
+		return fmt.Errorf("error choosing the url of the application: %v", err)
+	}
+
+	//get the status of the application
+	status, err := h.cc.GetContainerStatus(id)
+	if err != nil {
+		cleanup()
+		return fmt.Errorf("error getting the status of the container: %v", err)
+	}
+
+	var app Application
+	app.ID = job.ApplicationID
+	//the jobs queued before the id was chosen with the job
+	if app.ID.IsZero() {
+		app.ID = primitive.NewObjectID()
+	}
+	app.ContainerID = id
+	app.Status = status
+	app.Health = HealthHealthy
+	app.StudentID = job.StudentID
+	app.Type = "web"
+	app.Name = imageName
+	app.Description = appPost.Description
+	app.GithubRepo = appPost.GithubRepoUrl
+	app.GithubBranch = appPost.GithubBranch
+	app.LastCommitHash = hash
+	app.Port = appPost.Port
+	app.Lang = appPost.Language
+	app.DockerfilePath = appPost.DockerfilePath
+	app.Slug = slug
+	app.URL = h.proxy.AppURL(job.StudentID, slug)
+	app.CreatedAt = time.Now()
+	app.Envs = appPost.Envs
+	app.Limits = limits
+	app.RestartPolicy = restartPolicy
+	app.HealthCheck = appPost.HealthCheck
+
+	//insert the application in the database
+	if _, err := db.Collection("applications").InsertOne(context.TODO(), app); err != nil {
+		cleanup()
+		return fmt.Errorf("error inserting the application in the database: %v", err)
+	}
+
+	//the application is reachable as soon as the proxy knows it
+	if err := h.proxy.Refresh(); err != nil {
+		log.Printf("[ERROR] Error refreshing the proxy routes: %v", err)
+	}
+
+	if err := h.saveRelease(Release{
+		ApplicationID: app.ID,
+		StudentID:     app.StudentID,
+		CommitHash:    hash,
+		Image:         image,
+		ImageID:       imageID,
+		Envs:          app.Envs,
+	}, db); err != nil {
+		//the application already runs the new container, only the history misses it
+		log.Printf("[ERROR] Error saving the release of application %s: %v", app.ID.Hex(), err)
+	}
+
+	return setJobPhase(job.ID, JobPhaseSucceeded, bson.M{
+		"containerID": id,
+		"url":         app.URL,
+	})
+}
+
+// removeLeftoverContainer removes the container with the given name if no application uses it,
+// a create job interrupted by a restart of the platform could have left it
+func (h Handler) removeLeftoverContainer(containerName string, db *mongo.Database) error {
+	leftover, err := h.cc.cli.ContainerInspect(h.cc.ctx, containerName)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	owners, err := db.Collection("applications").CountDocuments(context.TODO(), bson.M{"containerID": leftover.ID})
+	if err != nil {
+		return err
+	}
+	if owners > 0 {
+		return fmt.Errorf("the container %s belongs to another application", containerName)
+	}
+	return h.cc.DeleteContainer(leftover.ID)
+}
+
+// runUpdateJob rebuilds an application from the last commit of its branch with a blue/green deploy,
+// the built image is saved as a new release
+func (h Handler) runUpdateJob(job DeployJob, buildLog io.Writer) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	var app Application
+	if err := db.Collection("applications").FindOne(context.TODO(), bson.M{"_id": job.ApplicationID}).Decode(&app); err != nil {
+		return fmt.Errorf("error getting the application: %v", err)
+	}
+
+	student, err := GetStudentFromID(job.StudentID, db)
+	if err != nil {
+		return fmt.Errorf("error getting the student: %v", err)
+	}
+
+	runtime, found := GetRuntime(app.Lang)
+	if !found {
+		return fmt.Errorf("language %s not supported, the supported langs are: %v", app.Lang, Langs)
+	}
+	limits := GetResourceLimits(student, runtime.Limits)
+
+	port, err := strconv.Atoi(app.Port)
+	if err != nil {
+		return fmt.Errorf("error converting the port to an int: %v", err)
+	}
+
+	if err := setJobPhase(job.ID, JobPhaseCloning, nil); err != nil {
+		return err
+	}
+
+	//download the repo
+	repo, name, hash, err := h.util.DownloadGithubRepo(job.StudentID, app.GithubBranch, app.GithubRepo)
+	if err != nil {
+		return fmt.Errorf("error downloading the repo: %v", err)
+	}
+	defer os.RemoveAll(repo)
+
+	if err := setJobPhase(job.ID, JobPhaseBuilding, nil); err != nil {
+		return err
+	}
+
+	imageName, imageID, err := h.cc.createApplicationImage(job.StudentID, port, name, app.GithubBranch, repo, runtime, app.DockerfilePath, limits, buildLog)
+	if err != nil {
+		return fmt.Errorf("error creating the image: %w", err)
+	}
+
+	//the image is kept tagged with the commit so the release can be rolled back
+	image, err := h.cc.TagReleaseImage(imageName, imageID, hash, job.ID.Hex())
+	if err != nil {
+		h.cc.RemoveImage(imageID)
+		return fmt.Errorf("error tagging the image: %v", err)
+	}
+
+	if err := setJobPhase(job.ID, JobPhaseStarting, nil); err != nil {
+		return err
+	}
+
+	containerName := applicationContainerName(job.StudentID, name, app.Lang)
+	id, err := h.startNextContainer(app, containerName, image, limits, buildLog)
+	if err != nil {
+		h.cc.RemoveImage(imageID)
+		return err
+	}
+
+	status, err := h.cc.GetContainerStatus(id)
+	if err != nil {
+		h.cc.DeleteContainer(id)
+		h.cc.RemoveImage(imageID)
+		return fmt.Errorf("error getting the status of the container: %v", err)
+	}
+
+	//the requests are sent to the new container once it's saved on the application
+	fields := bson.M{
+		"containerID":    id,
+		"status":         status,
+		"health":         HealthHealthy,
+		"lastCommitHash": hash,
+		"limits":         limits,
+	}
+	if err := h.switchApplicationContainer(&app, fields, db); err != nil {
+		h.cc.DeleteContainer(id)
+		h.cc.RemoveImage(imageID)
+		return err
+	}
+	h.retireContainer(app.ContainerID, id, containerName, buildLog)
+
+	if err := h.saveRelease(Release{
+		ApplicationID: app.ID,
+		StudentID:     app.StudentID,
+		CommitHash:    hash,
+		Image:         image,
+		ImageID:       imageID,
+		Envs:          app.Envs,
+	}, db); err != nil {
+		//the application already runs the new container, only the history misses it
+		log.Printf("[ERROR] Error saving the release of application %s: %v", app.ID.Hex(), err)
+	}
+
+	return setJobPhase(job.ID, JobPhaseSucceeded, bson.M{
+		"containerID": id,
+		"url":         app.URL,
+	})
+}
+
+// startNextContainer is the first half of a blue/green deploy: the new container of an application is created from
+// the image (with the envs of app and of its linked databases) and started next to the current one, then it's health checked. If it fails it's
+// removed and the current container keeps running, the requests are sent to the current one until switchApplicationContainer.
+// It returns the id of the new container
+func (h Handler) startNextContainer(app Application, containerName, image string, limits ResourceLimits, buildLog io.Writer) (string, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return "", err
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	envs, err := h.cc.ContainerEnvs(app, db)
+	if err != nil {
+		return "", fmt.Errorf("error getting the envs of the container: %v", err)
+	}
+	//a deploy interrupted by a restart of the platform could have left its new container, it never received requests
+	if err := h.cc.DeleteContainer(containerName + "-next"); err != nil && !client.IsErrNotFound(err) {
+		return "", fmt.Errorf("error removing the container of an interrupted deploy: %v", err)
+	}
+	nextID, err := h.cc.CreateNewApplicationFromRepo(app.StudentID, containerName+"-next", image, envs, limits, app.RestartPolicy)
+	if err != nil {
+		return "", fmt.Errorf("error creating the container: %v", err)
+	}
+	if err := h.cc.cli.ContainerStart(h.cc.ctx, nextID, types.ContainerStartOptions{}); err != nil {
+		h.cc.DeleteContainer(nextID)
+		return "", fmt.Errorf("error starting the container: %v", err)
+	}
+	fmt.Fprintln(buildLog, "waiting for the new version to be healthy")
+	if err := h.cc.WaitUntilHealthy(nextID, app.Port, deployHealthTimeout, app.HealthCheck); err != nil {
+		h.cc.DeleteContainer(nextID)
+		return "", fmt.Errorf("the new version is not healthy, the old one is still running: %v", err)
+	}
+	return nextID, nil
+}
+
+// switchApplicationContainer saves the new container (and the other fields) on the application and reloads the proxy
+// routes so the requests are sent to it. The applications created before the proxy get their url here
+func (h Handler) switchApplicationContainer(app *Application, fields bson.M, db *mongo.Database) error {
+	update := bson.M{"$set": fields}
+	if app.Slug == "" {
+		name := app.Name
+		if _, repoName, err := h.util.GetUserAndNameFromRepoUrl(app.GithubRepo); err == nil {
+			name = repoName
+		}
+		slug, err := uniqueAppSlug(app.StudentID, name, db)
+		if err != nil {
+			return fmt.Errorf("error choosing the url of the application: %v", err)
+		}
+		app.Slug = slug
+		app.URL = h.proxy.AppURL(app.StudentID, slug)
+		fields["slug"] = app.Slug
+		fields["url"] = app.URL
+		//the new container doesn't publish any port
+		update["$unset"] = bson.M{"externalPort": ""}
+	}
+
+	if _, err := db.Collection("applications").UpdateOne(context.TODO(), bson.M{"_id": app.ID}, update); err != nil {
+		return fmt.Errorf("error updating the application in the database: %v", err)
+	}
+	if err := h.proxy.Refresh(); err != nil {
+		log.Printf("[ERROR] Error refreshing the proxy routes: %v", err)
+	}
+	return nil
+}
+
+// retireContainer is the last half of a blue/green deploy: when the requests are sent to the new container
+// the old one is stopped (so it can finish the requests it's serving) and removed, then the new one gets its name
+func (h Handler) retireContainer(oldID, newID, containerName string, buildLog io.Writer) {
+	fmt.Fprintln(buildLog, "removing the old version")
+	if err := h.cc.StopContainer(oldID); err != nil {
+		log.Printf("[ERROR] can't stop the old container %s: %v", oldID, err)
+	}
+	if err := h.cc.DeleteContainer(oldID); err != nil {
+		log.Printf("[ERROR] can't remove the old container %s: %v", oldID, err)
+	}
+	if err := h.cc.cli.ContainerRename(h.cc.ctx, newID, containerName); err != nil {
+		log.Printf("[ERROR] can't rename container %s: %v", newID, err)
+	}
+}
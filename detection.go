@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// AutoDetectLanguage can be used as AppPost.Language to let the platform choose the runtime
+const AutoDetectLanguage = "auto"
+
+// RuntimeDetection is the result of the inspection of a repository
+type RuntimeDetection struct {
+	Lang       string   `bson:"lang,omitempty" json:"lang,omitempty"`             //runtime suggested, empty if nothing was found
+	Candidates []string `bson:"candidates,omitempty" json:"candidates,omitempty"` //all the runtimes that matched, in order of priority
+	Markers    []string `bson:"markers,omitempty" json:"markers,omitempty"`       //marker files found in the repo
+}
+
+// Detected returns true if at least one runtime matched
+func (d RuntimeDetection) Detected() bool {
+	return d.Lang != ""
+}
+
+// Has returns true if the given runtime is one of the candidates
+func (d RuntimeDetection) Has(lang string) bool {
+	for _, c := range d.Candidates {
+		if c == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectRuntime checks the files in the root of a repository against the markers
+// of the supported runtimes, the first runtime that matches is the suggested one
+func DetectRuntime(files []string) RuntimeDetection {
+	//the markers are compared case insensitive (Pipfile, pipfile)
+	found := make(map[string]string)
+	for _, f := range files {
+		found[strings.ToLower(f)] = f
+	}
+
+	var detection RuntimeDetection
+	for _, runtime := range Runtimes {
+		matched := false
+		for _, marker := range runtime.Markers {
+			if f, ok := found[strings.ToLower(marker)]; ok {
+				detection.Markers = append(detection.Markers, f)
+				matched = true
+			}
+		}
+		if matched {
+			detection.Candidates = append(detection.Candidates, runtime.Lang)
+		}
+	}
+
+	if len(detection.Candidates) > 0 {
+		detection.Lang = detection.Candidates[0]
+	}
+	return detection
+}
+
+// DetectRuntimeFromPath runs the detection on a repository downloaded in path
+func DetectRuntimeFromPath(path string) (RuntimeDetection, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return RuntimeDetection{}, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			files = append(files, e.Name())
+		}
+	}
+	return DetectRuntime(files), nil
+}
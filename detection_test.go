@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestDetectRuntime(t *testing.T) {
+	Runtimes = defaultRuntimes
+
+	tests := []struct {
+		name     string
+		files    []string
+		expected string
+	}{
+		{"Go module", []string{"go.mod", "go.sum", "main.go"}, "go"},
+		{"Python requirements", []string{"requirements.txt", "main.py"}, "python"},
+		{"Python pyproject", []string{"pyproject.toml"}, "python"},
+		{"Node with an index.html", []string{"index.html", "package.json"}, "node"},
+		{"Maven", []string{"pom.xml"}, "java-maven"},
+		{"Gradle kotlin dsl", []string{"build.gradle.kts"}, "java-gradle"},
+		{"Rust", []string{"Cargo.toml", "Cargo.lock"}, "rust"},
+		{"Static site", []string{"index.html", "style.css"}, "static"},
+		{"Unknown", []string{"README.md"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detection := DetectRuntime(test.files)
+			if detection.Lang != test.expected {
+				t.Errorf("expected %q, got %q (candidates: %v)", test.expected, detection.Lang, detection.Candidates)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DockerfileRuntime is the lang used to build the repo with its own dockerfile
+const DockerfileRuntime = "dockerfile"
+
+// default dockerfile used by the dockerfile runtime if the user doesn't choose one
+const defaultDockerfilePath = "Dockerfile"
+
+// base images allowed in the users' dockerfiles, can be changed with ALLOWED_BASE_IMAGES (comma separated)
+var defaultAllowedBaseImages = []string{
+	"scratch",
+	"alpine",
+	"debian",
+	"ubuntu",
+	"busybox",
+	"golang",
+	"python",
+	"node",
+	"maven",
+	"gradle",
+	"openjdk",
+	"eclipse-temurin",
+	"php",
+	"composer",
+	"rust",
+	"nginx",
+	"httpd",
+}
+
+// DockerfileInstruction is a single instruction of a dockerfile (continuations already joined)
+type DockerfileInstruction struct {
+	Line  int      //line where the instruction starts
+	Cmd   string   //instruction in upper case (FROM, RUN, ...)
+	Flags []string //flags of the instruction (--network=host)
+	Args  string   //everything after the instruction and the flags
+}
+
+// Dockerfile is a parsed dockerfile
+type Dockerfile struct {
+	Directives   map[string]string //parser directives at the top of the file (# syntax=...), the keys are in lower case
+	Instructions []DockerfileInstruction
+}
+
+// parser directive, a comment like # key=value before any other comment, empty line or instruction
+var dockerfileDirectivePattern = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.*?)\s*$`)
+
+// DockerfilePolicyError is returned when a dockerfile doesn't respect the platform policy,
+// it contains all the violations found
+type DockerfilePolicyError struct {
+	Violations []string `bson:"violations" json:"violations"`
+}
+
+func (e *DockerfilePolicyError) Error() string {
+	return "the dockerfile doesn't respect the policy: " + strings.Join(e.Violations, "; ")
+}
+
+// ParseDockerfile reads a dockerfile, the parser directives are saved, comments and empty lines are skipped
+// and the lines ending with \ are joined
+func ParseDockerfile(r io.Reader) (Dockerfile, error) {
+	dockerfile := Dockerfile{Directives: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+
+	lineNumber := 0
+	startLine := 0
+	//the directives are only read before the first comment, empty line or instruction
+	readingDirectives := true
+	var current strings.Builder
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if readingDirectives {
+			if match := dockerfileDirectivePattern.FindStringSubmatch(line); match != nil {
+				dockerfile.Directives[strings.ToLower(match[1])] = match[2]
+				continue
+			}
+			readingDirectives = false
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if current.Len() == 0 {
+			startLine = lineNumber
+		}
+
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\") + " ")
+			continue
+		}
+		current.WriteString(line)
+		dockerfile.Instructions = append(dockerfile.Instructions, parseDockerfileInstruction(startLine, current.String()))
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return Dockerfile{}, err
+	}
+	if current.Len() > 0 {
+		dockerfile.Instructions = append(dockerfile.Instructions, parseDockerfileInstruction(startLine, current.String()))
+	}
+	return dockerfile, nil
+}
+
+// ParseDockerfileFromPath reads and parses the dockerfile at the given path
+func ParseDockerfileFromPath(path string) (Dockerfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Dockerfile{}, err
+	}
+	defer f.Close()
+	return ParseDockerfile(f)
+}
+
+func parseDockerfileInstruction(line int, text string) DockerfileInstruction {
+	fields := strings.Fields(text)
+	instruction := DockerfileInstruction{
+		Line: line,
+		Cmd:  strings.ToUpper(fields[0]),
+	}
+
+	rest := fields[1:]
+	for len(rest) > 0 && strings.HasPrefix(rest[0], "--") {
+		instruction.Flags = append(instruction.Flags, rest[0])
+		rest = rest[1:]
+	}
+	instruction.Args = strings.Join(rest, " ")
+	return instruction
+}
+
+// ExposedPorts returns the ports of the EXPOSE instructions without the protocol
+func (d Dockerfile) ExposedPorts() []string {
+	var ports []string
+	for _, i := range d.Instructions {
+		if i.Cmd != "EXPOSE" {
+			continue
+		}
+		for _, p := range strings.Fields(i.Args) {
+			ports = append(ports, strings.Split(p, "/")[0])
+		}
+	}
+	return ports
+}
+
+// imageRepository returns the name of an image without the tag, the digest and the docker hub prefixes
+func imageRepository(image string) string {
+	image = strings.Split(image, "@")[0]
+	//the tag is after the last : but only if it's after the last / (registry:port/image)
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	image = strings.TrimPrefix(image, "docker.io/")
+	image = strings.TrimPrefix(image, "library/")
+	return strings.ToLower(image)
+}
+
+// allowedBaseImages returns the base images allowed by the configuration
+func allowedBaseImages() []string {
+	env := os.Getenv("ALLOWED_BASE_IMAGES")
+	if env == "" {
+		return defaultAllowedBaseImages
+	}
+
+	var images []string
+	for _, image := range strings.Split(env, ",") {
+		if image = strings.TrimSpace(image); image != "" {
+			images = append(images, imageRepository(image))
+		}
+	}
+	return images
+}
+
+// mountOption returns the value of an option of a RUN --mount flag (--mount=type=bind,from=builder,target=/src)
+func mountOption(flag, key string) (string, bool) {
+	for _, option := range strings.Split(flag[len("--mount="):], ",") {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), key) {
+			return strings.TrimSpace(parts[1]), true
+		}
+	}
+	return "", false
+}
+
+// CheckPolicy validates the dockerfile against the platform policy:
+// 1) no syntax directive, it would build the dockerfile with a frontend image chosen by the user,
+// and only the default escape character (the continuations are joined on \)
+// 2) the images must be allowed, in FROM, COPY --from and RUN --mount=from (the stages defined earlier can be used too)
+// 3) no privileged build options (insecure security mode, host network, secrets and ssh mounts)
+// 4) the port of the application must be exposed
+func (d Dockerfile) CheckPolicy(port string, allowedImages []string) error {
+	var violations []string
+
+	if syntax, found := d.Directives["syntax"]; found {
+		violations = append(violations, fmt.Sprintf("the syntax directive (%s) is not allowed, the dockerfile is built with the default frontend", syntax))
+	}
+	if escape, found := d.Directives["escape"]; found && escape != "\\" {
+		violations = append(violations, fmt.Sprintf("the escape directive (%s) is not allowed, only \\ can be used", escape))
+	}
+
+	allowed := make(map[string]bool)
+	for _, image := range allowedImages {
+		allowed[image] = true
+	}
+	stages := make(map[string]bool)
+	stagesCount := 0
+	//the sources of COPY --from and RUN --mount=from can be an earlier stage, by name or index, or an allowed image
+	allowedSource := func(source string) bool {
+		if stages[strings.ToLower(source)] {
+			return true
+		}
+		if index, err := strconv.Atoi(source); err == nil {
+			return index >= 0 && index < stagesCount
+		}
+		return allowed[imageRepository(source)]
+	}
+
+	for _, i := range d.Instructions {
+		switch i.Cmd {
+		case "FROM":
+			args := strings.Fields(i.Args)
+			if len(args) == 0 {
+				violations = append(violations, fmt.Sprintf("line %d: FROM without an image", i.Line))
+				continue
+			}
+			image := args[0]
+			if !stages[strings.ToLower(image)] && !allowed[imageRepository(image)] {
+				violations = append(violations, fmt.Sprintf("line %d: base image %s is not allowed, the allowed ones are: %v", i.Line, image, allowedImages))
+			}
+			if len(args) == 3 && strings.EqualFold(args[1], "as") {
+				stages[strings.ToLower(args[2])] = true
+			}
+			stagesCount++
+		case "COPY":
+			for _, flag := range i.Flags {
+				if !strings.HasPrefix(strings.ToLower(flag), "--from=") {
+					continue
+				}
+				if source := flag[len("--from="):]; !allowedSource(source) {
+					violations = append(violations, fmt.Sprintf("line %d: COPY from %s is not allowed, it must be an earlier stage or one of: %v", i.Line, source, allowedImages))
+				}
+			}
+		case "RUN":
+			for _, flag := range i.Flags {
+				lower := strings.ToLower(flag)
+				switch {
+				case lower == "--security=insecure",
+					lower == "--network=host",
+					strings.HasPrefix(lower, "--mount=") && (strings.Contains(lower, "type=secret") || strings.Contains(lower, "type=ssh")):
+					violations = append(violations, fmt.Sprintf("line %d: RUN %s is not allowed", i.Line, lower))
+				case strings.HasPrefix(lower, "--mount="):
+					if source, found := mountOption(flag, "from"); found && !allowedSource(source) {
+						violations = append(violations, fmt.Sprintf("line %d: RUN mount from %s is not allowed, it must be an earlier stage or one of: %v", i.Line, source, allowedImages))
+					}
+				}
+			}
+		}
+	}
+
+	exposed := false
+	for _, p := range d.ExposedPorts() {
+		if p == port {
+			exposed = true
+			break
+		}
+	}
+	if !exposed {
+		violations = append(violations, fmt.Sprintf("the port %s must be exposed with EXPOSE %s", port, port))
+	}
+
+	if len(violations) > 0 {
+		return &DockerfilePolicyError{Violations: violations}
+	}
+	return nil
+}
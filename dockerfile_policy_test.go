@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDockerfileCheckPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		port       string
+		valid      bool
+	}{
+		{
+			name: "Valid multi stage",
+			dockerfile: `FROM golang:1.19-alpine AS builder
+WORKDIR /app
+COPY . .
+RUN go build \
+    -o app
+FROM alpine:3.16
+COPY --from=builder /app/app /app
+EXPOSE 8080/tcp
+CMD ["/app"]`,
+			port:  "8080",
+			valid: true,
+		},
+		{
+			name:       "Base image not allowed",
+			dockerfile: "FROM someone/miner:latest\nEXPOSE 8080",
+			port:       "8080",
+			valid:      false,
+		},
+		{
+			name:       "Insecure run",
+			dockerfile: "FROM alpine\nRUN --security=insecure echo hi\nEXPOSE 8080",
+			port:       "8080",
+			valid:      false,
+		},
+		{
+			name:       "Host network",
+			dockerfile: "FROM alpine\nRUN --network=host wget example.com\nEXPOSE 8080",
+			port:       "8080",
+			valid:      false,
+		},
+		{
+			name:       "Port not exposed",
+			dockerfile: "FROM python:3.10\nEXPOSE 5000",
+			port:       "8080",
+			valid:      false,
+		},
+		{
+			name:       "Syntax directive",
+			dockerfile: "# syntax=someone/frontend:latest\nFROM alpine\nEXPOSE 8080",
+			port:       "8080",
+			valid:      false,
+		},
+		{
+			name:       "Escape directive",
+			dockerfile: "# escape=`\nFROM alpine\nEXPOSE 8080",
+			port:       "8080",
+			valid:      false,
+		},
+		{
+			name:       "Directive after a comment",
+			dockerfile: "# build the app\n# syntax=someone/frontend:latest\nFROM alpine\nEXPOSE 8080",
+			port:       "8080",
+			valid:      true,
+		},
+		{
+			name:       "Copy from an allowed image",
+			dockerfile: "FROM alpine\nCOPY --from=nginx:1.23 /etc/nginx/nginx.conf /etc/nginx.conf\nEXPOSE 8080",
+			port:       "8080",
+			valid:      true,
+		},
+		{
+			name:       "Copy from an image not allowed",
+			dockerfile: "FROM alpine\nCOPY --from=someone/miner:latest /miner /miner\nEXPOSE 8080",
+			port:       "8080",
+			valid:      false,
+		},
+		{
+			name:       "Copy from a stage index",
+			dockerfile: "FROM golang:1.19\nRUN go build -o /app\nFROM alpine\nCOPY --from=0 /app /app\nEXPOSE 8080",
+			port:       "8080",
+			valid:      true,
+		},
+		{
+			name:       "Copy from a later stage index",
+			dockerfile: "FROM alpine\nCOPY --from=1 /app /app\nEXPOSE 8080",
+			port:       "8080",
+			valid:      false,
+		},
+		{
+			name:       "Mount from a stage",
+			dockerfile: "FROM golang:1.19 AS deps\nFROM golang:1.19\nRUN --mount=type=bind,from=deps,source=/go,target=/deps go build\nEXPOSE 8080",
+			port:       "8080",
+			valid:      true,
+		},
+		{
+			name:       "Mount from an image not allowed",
+			dockerfile: "FROM alpine\nRUN --mount=type=bind,from=someone/miner,target=/m /m/run\nEXPOSE 8080",
+			port:       "8080",
+			valid:      false,
+		},
+		{
+			name:       "Cache mount",
+			dockerfile: "FROM python:3.10\nRUN --mount=type=cache,target=/root/.cache pip install flask\nEXPOSE 8080",
+			port:       "8080",
+			valid:      true,
+		},
+		{
+			name:       "Docker hub prefix",
+			dockerfile: "# comment\nFROM docker.io/library/node:18\nEXPOSE 3000",
+			port:       "3000",
+			valid:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(strings.NewReader(test.dockerfile))
+			if err != nil {
+				t.Fatalf("error has been generated: %s", err)
+			}
+			err = dockerfile.CheckPolicy(test.port, defaultAllowedBaseImages)
+			if test.valid && err != nil {
+				t.Errorf("expected a valid dockerfile, got: %s", err)
+			}
+			var policyErr *DockerfilePolicyError
+			if !test.valid && !errors.As(err, &policyErr) {
+				t.Errorf("expected a policy error, got: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// method used to verify the ownership of a custom domain, only the dns can prove it: an http token would be
+// answered by the platform itself for every hostname that points to the server
+const DomainVerificationTXT = "txt"
+
+const (
+	//the txt record is searched on <prefix>.<hostname>
+	domainTXTPrefix = "_ipaas-challenge"
+	//max time waited for the dns checks
+	domainVerificationTimeout = 10 * time.Second
+)
+
+// CustomDomain is a hostname attached to an application by its owner, the proxy routes it
+// to the application once verified and terminates the tls if a certificate has been uploaded
+type CustomDomain struct {
+	ID            primitive.ObjectID `bson:"_id" json:"id"`
+	ApplicationID primitive.ObjectID `bson:"applicationID" json:"-"`
+	StudentID     int                `bson:"studentID" json:"-"`
+	Hostname      string             `bson:"hostname" json:"hostname"`
+	Method        string             `bson:"method" json:"method"` //txt
+	Token         string             `bson:"token" json:"token"`
+	Verified      bool               `bson:"verified" json:"verified"`
+	VerifiedAt    *time.Time         `bson:"verifiedAt,omitempty" json:"verifiedAt,omitempty"`
+	Certificate   string             `bson:"certificate,omitempty" json:"-"` //pem chain
+	Key           string             `bson:"key,omitempty" json:"-"`         //pem private key, encrypted with the secret store
+	CertExpiry    *time.Time         `bson:"certExpiry,omitempty" json:"certExpiry,omitempty"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// DomainCertificate is the certificate uploaded by the user for a custom domain
+type DomainCertificate struct {
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+}
+
+// DomainVerifier checks the tokens of the custom domains, the lookups go to Resolver
+// so that a local dns server can be used in place of the public ones
+type DomainVerifier struct {
+	Resolver *net.Resolver
+}
+
+// NewDomainVerifier creates a verifier that uses the dns server at address (host:port),
+// the system resolver is used if the address is empty
+func NewDomainVerifier(address string) DomainVerifier {
+	if address == "" {
+		return DomainVerifier{Resolver: net.DefaultResolver}
+	}
+	return DomainVerifier{Resolver: &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}}
+}
+
+// PlatformHosts returns the hosts where the platform itself is served: the host of REDIRECT_URI,
+// IP and the ones in PLATFORM_HOSTS (comma separated)
+func PlatformHosts() []string {
+	var hosts []string
+	if u, err := url.Parse(os.Getenv("REDIRECT_URI")); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, u.Hostname())
+	}
+	if ip := os.Getenv("IP"); ip != "" {
+		hosts = append(hosts, ip)
+	}
+	for _, host := range strings.Split(os.Getenv("PLATFORM_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	for i, host := range hosts {
+		hosts[i] = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	return hosts
+}
+
+// NormalizeHostname validates a hostname chosen by a user and returns it in lower case,
+// the reserved hosts (the base domain and the hosts of the platform) and their subdomains can't be used
+func NormalizeHostname(hostname string, reserved []string) (string, error) {
+	hostname = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(hostname), "."))
+	if hostname == "" || len(hostname) > 253 {
+		return "", fmt.Errorf("invalid hostname")
+	}
+	if net.ParseIP(hostname) != nil {
+		return "", fmt.Errorf("the hostname can't be an ip address")
+	}
+
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return "", fmt.Errorf("the hostname must be a fully qualified domain name")
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", fmt.Errorf("invalid hostname")
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", fmt.Errorf("invalid hostname")
+			}
+		}
+	}
+
+	for _, host := range reserved {
+		if host != "" && (hostname == host || strings.HasSuffix(hostname, "."+host)) {
+			return "", fmt.Errorf("the hostnames under %s are reserved", host)
+		}
+	}
+	return hostname, nil
+}
+
+// newDomainToken returns a random token for the verification of a domain
+func newDomainToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// Instructions explains to the user how to prove the ownership of the domain
+func (d CustomDomain) Instructions() string {
+	return fmt.Sprintf("create a TXT record on %s.%s with the value %s", domainTXTPrefix, d.Hostname, d.Token)
+}
+
+// Verify checks that the token of the domain is published in a TXT record
+func (v DomainVerifier) Verify(domain CustomDomain) error {
+	if domain.Method != DomainVerificationTXT {
+		return fmt.Errorf("invalid verification method %q, add the domain again to verify it with a TXT record", domain.Method)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), domainVerificationTimeout)
+	defer cancel()
+
+	records, err := v.Resolver.LookupTXT(ctx, domainTXTPrefix+"."+domain.Hostname)
+	if err != nil {
+		return fmt.Errorf("can't read the TXT records of %s.%s: %v", domainTXTPrefix, domain.Hostname, err)
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == domain.Token {
+			return nil
+		}
+	}
+	return fmt.Errorf("no TXT record of %s.%s has the token", domainTXTPrefix, domain.Hostname)
+}
+
+// ParseDomainCertificate checks that the certificate and the key are a pair, that the certificate
+// is valid for the hostname and not expired, it returns the certificate expiry
+func ParseDomainCertificate(cert DomainCertificate, hostname string) (time.Time, error) {
+	pair, err := tls.X509KeyPair([]byte(cert.Certificate), []byte(cert.Key))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid certificate or key: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid certificate: %v", err)
+	}
+	if err := leaf.VerifyHostname(hostname); err != nil {
+		return time.Time{}, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return time.Time{}, fmt.Errorf("the certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return leaf.NotAfter, nil
+}
+
+// isHostnameTaken checks if another application already verified the hostname
+func isHostnameTaken(hostname string, db *mongo.Database) (bool, error) {
+	count, err := db.Collection("domains").CountDocuments(context.TODO(), bson.M{"hostname": hostname, "verified": true})
+	return count > 0, err
+}
+
+// GetDomains returns the custom domains of an application
+func GetDomains(applicationID primitive.ObjectID, db *mongo.Database) ([]CustomDomain, error) {
+	cur, err := db.Collection("domains").Find(context.TODO(), bson.M{"applicationID": applicationID})
+	if err != nil {
+		return nil, err
+	}
+	domains := []CustomDomain{}
+	if err := cur.All(context.TODO(), &domains); err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
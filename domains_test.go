@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNormalizeHostname(t *testing.T) {
+	reserved := []string{"apps.example.com", "ipaas.example.org", "203.0.113.7"}
+	valid := map[string]string{
+		"Example.com":         "example.com",
+		"www.my-site.dev.":    "www.my-site.dev",
+		"  portfolio.io  ":    "portfolio.io",
+		"a.b.c.d.example.org": "a.b.c.d.example.org",
+	}
+	for hostname, expected := range valid {
+		normalized, err := NormalizeHostname(hostname, reserved)
+		if err != nil {
+			t.Errorf("NormalizeHostname(%q): unexpected error: %v", hostname, err)
+			continue
+		}
+		if normalized != expected {
+			t.Errorf("NormalizeHostname(%q): expected %q, got %q", hostname, expected, normalized)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"localhost",
+		"127.0.0.1",
+		"-bad.example.com",
+		"bad-.example.com",
+		"under_score.example.com",
+		"double..dot.com",
+		"apps.example.com",
+		"blog.18008.apps.example.com",
+		"ipaas.example.org",
+		"www.ipaas.example.org",
+		"203.0.113.7",
+	}
+	for _, hostname := range invalid {
+		if _, err := NormalizeHostname(hostname, reserved); err == nil {
+			t.Errorf("NormalizeHostname(%q): expected an error", hostname)
+		}
+	}
+}
+
+// selfSignedCertificate generates a certificate for the hostname and its key in pem
+func selfSignedCertificate(t *testing.T, hostname string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    notAfter.Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return string(cert), string(keyPem)
+}
+
+func TestParseDomainCertificate(t *testing.T) {
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	cert, key := selfSignedCertificate(t, "portfolio.example.org", notAfter)
+
+	expiry, err := ParseDomainCertificate(DomainCertificate{Certificate: cert, Key: key}, "portfolio.example.org")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !expiry.Equal(notAfter) {
+		t.Errorf("expected expiry %v, got %v", notAfter, expiry)
+	}
+
+	if _, err := ParseDomainCertificate(DomainCertificate{Certificate: cert, Key: key}, "other.example.org"); err == nil {
+		t.Errorf("expected an error for a certificate of another hostname")
+	}
+
+	_, otherKey := selfSignedCertificate(t, "portfolio.example.org", notAfter)
+	if _, err := ParseDomainCertificate(DomainCertificate{Certificate: cert, Key: otherKey}, "portfolio.example.org"); err == nil {
+		t.Errorf("expected an error for a key that doesn't match the certificate")
+	}
+
+	expiredCert, expiredKey := selfSignedCertificate(t, "portfolio.example.org", time.Now().Add(-time.Hour))
+	if _, err := ParseDomainCertificate(DomainCertificate{Certificate: expiredCert, Key: expiredKey}, "portfolio.example.org"); err == nil {
+		t.Errorf("expected an error for an expired certificate")
+	}
+}
+
+// serveTXTRecords starts a dns server on a local udp port that answers the TXT queries with the records
+// of the name (without the final dot), the other names don't exist. It returns the address of the server
+func serveTXTRecords(t *testing.T, records map[string][]string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var parser dnsmessage.Parser
+			header, err := parser.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			question, err := parser.Question()
+			if err != nil {
+				continue
+			}
+			name := strings.TrimSuffix(strings.ToLower(question.Name.String()), ".")
+			txt, found := records[name]
+
+			header.Response = true
+			header.Authoritative = true
+			header.RCode = dnsmessage.RCodeSuccess
+			if !found {
+				header.RCode = dnsmessage.RCodeNameError
+			}
+			builder := dnsmessage.NewBuilder(nil, header)
+			builder.EnableCompression()
+			builder.StartQuestions()
+			builder.Question(question)
+			builder.StartAnswers()
+			if found && question.Type == dnsmessage.TypeTXT {
+				for _, record := range txt {
+					builder.TXTResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.TXTResource{TXT: []string{record}})
+				}
+			}
+			msg, err := builder.Finish()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDomainVerifierVerify(t *testing.T) {
+	address := serveTXTRecords(t, map[string][]string{
+		"_ipaas-challenge.portfolio.example.org": {"v=spf1 -all", "right-token"},
+		"_ipaas-challenge.other.example.org":     {"another-token"},
+	})
+	verifier := NewDomainVerifier(address)
+
+	domain := CustomDomain{Hostname: "portfolio.example.org", Method: DomainVerificationTXT, Token: "right-token"}
+	if err := verifier.Verify(domain); err != nil {
+		t.Errorf("expected the domain to be verified, got %v", err)
+	}
+
+	tests := map[string]CustomDomain{
+		"wrong token":    {Hostname: "other.example.org", Method: DomainVerificationTXT, Token: "right-token"},
+		"missing record": {Hostname: "missing.example.org", Method: DomainVerificationTXT, Token: "right-token"},
+		"http method":    {Hostname: "portfolio.example.org", Method: "http", Token: "right-token"},
+	}
+	for name, domain := range tests {
+		if err := verifier.Verify(domain); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
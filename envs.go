@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	//max number of envs of an application
+	maxEnvs = 100
+	//value shown in place of the secret envs
+	maskedSecret = "********"
+)
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidateEnvs checks that the keys are valid names of environment variables and that they aren't repeated,
+// the values can contain anything (spaces and new lines too) since they are not written in a dockerfile
+func ValidateEnvs(envs []Env) error {
+	if len(envs) > maxEnvs {
+		return fmt.Errorf("an application can have at most %d envs", maxEnvs)
+	}
+	keys := make(map[string]bool)
+	for _, env := range envs {
+		if !envKeyPattern.MatchString(env.Key) {
+			return fmt.Errorf("invalid env key %s, it can only have letters, numbers and _ and can't start with a number", env.Key)
+		}
+		if keys[env.Key] {
+			return fmt.Errorf("the env %s is repeated", env.Key)
+		}
+		keys[env.Key] = true
+		if strings.ContainsRune(env.Value, 0) {
+			return fmt.Errorf("the value of the env %s contains a null character", env.Key)
+		}
+	}
+	return nil
+}
+
+// storedEnv is how an env is saved on the database, the value is encrypted
+type storedEnv struct {
+	Key    string `bson:"key"`
+	Value  string `bson:"value"`
+	Secret bool   `bson:"secret,omitempty"`
+}
+
+// MarshalBSON encrypts the value of the env with the secret store, so every env saved on the database
+// (applications, releases and jobs) is encrypted
+func (e Env) MarshalBSON() ([]byte, error) {
+	value, err := secretStore.Encrypt(e.Value)
+	if err != nil {
+		return nil, err
+	}
+	return bson.Marshal(storedEnv{Key: e.Key, Value: value, Secret: e.Secret})
+}
+
+// UnmarshalBSON decrypts the value of the env read from the database
+func (e *Env) UnmarshalBSON(data []byte) error {
+	var stored storedEnv
+	if err := bson.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	value, err := secretStore.Decrypt(stored.Value)
+	if err != nil {
+		return fmt.Errorf("error decrypting the env %s: %v", stored.Key, err)
+	}
+	*e = Env{Key: stored.Key, Value: value, Secret: stored.Secret}
+	return nil
+}
+
+// MarshalJSON masks the value of the secret envs in the responses
+func (e Env) MarshalJSON() ([]byte, error) {
+	type env Env
+	if e.Secret {
+		e.Value = maskedSecret
+	}
+	return json.Marshal(env(e))
+}
+
+// EnvList converts the envs in the KEY=value list used by docker
+func EnvList(envs []Env) []string {
+	list := make([]string, 0, len(envs))
+	for _, env := range envs {
+		list = append(list, env.Key+"="+env.Value)
+	}
+	return list
+}
+
+// SetEnvs returns the envs replaced by the ones in updates with the same key, the keys not in envs are added at the end
+func SetEnvs(envs, updates []Env) []Env {
+	result := make([]Env, len(envs))
+	copy(result, envs)
+	for _, update := range updates {
+		found := false
+		for i := range result {
+			if result[i].Key == update.Key {
+				result[i] = update
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, update)
+		}
+	}
+	return result
+}
+
+// UnmaskEnvs returns the updates with the masked values (sent back as the api returned them) replaced by the saved
+// values of the secret envs with the same key, so they are kept unchanged. A masked value for an env that isn't
+// a saved secret is an error, it would replace the real value
+func UnmaskEnvs(envs, updates []Env) ([]Env, error) {
+	result := make([]Env, len(updates))
+	for i, update := range updates {
+		result[i] = update
+		if update.Value != maskedSecret {
+			continue
+		}
+		found := false
+		for _, env := range envs {
+			if env.Key == update.Key && env.Secret {
+				result[i].Value = env.Value
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("the value of the env %s is masked, set its real value", update.Key)
+		}
+	}
+	return result, nil
+}
+
+// RemoveEnvs returns the envs without the keys, the keys that weren't found are returned too
+func RemoveEnvs(envs []Env, keys []string) ([]Env, []string) {
+	remove := make(map[string]bool)
+	for _, key := range keys {
+		remove[key] = true
+	}
+
+	result := []Env{}
+	for _, env := range envs {
+		if remove[env.Key] {
+			delete(remove, env.Key)
+			continue
+		}
+		result = append(result, env)
+	}
+
+	var missing []string
+	for _, key := range keys {
+		if remove[key] {
+			missing = append(missing, key)
+		}
+	}
+	return result, missing
+}
+
+// runEnvsJob recreates the container of an application from its current image with the envs (and the links) of the job,
+// with a blue/green deploy like the updates. The new envs are saved as a new release, the envs and the links are saved
+// on the application only when the new container is running
+func (h Handler) runEnvsJob(job DeployJob, buildLog io.Writer) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	var app Application
+	if err := db.Collection("applications").FindOne(context.TODO(), bson.M{"_id": job.ApplicationID}).Decode(&app); err != nil {
+		return fmt.Errorf("error getting the application: %v", err)
+	}
+
+	student, err := GetStudentFromID(job.StudentID, db)
+	if err != nil {
+		return fmt.Errorf("error getting the student: %v", err)
+	}
+	limits := ApplicationLimits(student, app)
+
+	//the image of the running container is used, nothing is rebuilt
+	current, err := h.cc.cli.ContainerInspect(h.cc.ctx, app.ContainerID)
+	if err != nil {
+		return fmt.Errorf("error getting the current container: %v", err)
+	}
+	containerName := currentContainerName(current)
+
+	if err := setJobPhase(job.ID, JobPhaseStarting, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(buildLog, "recreating the container with %d envs\n", len(job.Envs))
+
+	app.Envs = job.Envs
+	if job.Links != nil {
+		app.Links = *job.Links
+	}
+	id, err := h.startNextContainer(app, containerName, current.Image, limits, buildLog)
+	if err != nil {
+		return err
+	}
+
+	status, err := h.cc.GetContainerStatus(id)
+	if err != nil {
+		h.cc.DeleteContainer(id)
+		return fmt.Errorf("error getting the status of the container: %v", err)
+	}
+
+	if err := h.switchApplicationContainer(&app, bson.M{
+		"containerID": id,
+		"status":      status,
+		"health":      HealthHealthy,
+		"envs":        job.Envs,
+		"links":       app.Links,
+		"limits":      limits,
+	}, db); err != nil {
+		h.cc.DeleteContainer(id)
+		return err
+	}
+	h.retireContainer(app.ContainerID, id, containerName, buildLog)
+
+	if err := h.saveRelease(Release{
+		ApplicationID: app.ID,
+		StudentID:     app.StudentID,
+		CommitHash:    app.LastCommitHash,
+		Image:         current.Config.Image,
+		ImageID:       current.Image,
+		Envs:          job.Envs,
+	}, db); err != nil {
+		return err
+	}
+
+	return setJobPhase(job.ID, JobPhaseSucceeded, bson.M{
+		"containerID": id,
+		"url":         app.URL,
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestValidateEnvs(t *testing.T) {
+	tests := []struct {
+		name    string
+		envs    []Env
+		wantErr bool
+	}{
+		{"valid", []Env{{Key: "PORT", Value: "8080"}, {Key: "_DEBUG", Value: "a b\nc"}}, false},
+		{"empty", nil, false},
+		{"starts with a number", []Env{{Key: "1KEY", Value: "x"}}, true},
+		{"invalid character", []Env{{Key: "MY-KEY", Value: "x"}}, true},
+		{"empty key", []Env{{Key: "", Value: "x"}}, true},
+		{"repeated", []Env{{Key: "A", Value: "1"}, {Key: "A", Value: "2"}}, true},
+		{"null character", []Env{{Key: "A", Value: "a\x00b"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateEnvs(tt.envs); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateEnvs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetEnvs(t *testing.T) {
+	envs := []Env{{Key: "A", Value: "1"}, {Key: "B", Value: "2"}}
+	got := SetEnvs(envs, []Env{{Key: "B", Value: "3"}, {Key: "C", Value: "4"}})
+	want := []Env{{Key: "A", Value: "1"}, {Key: "B", Value: "3"}, {Key: "C", Value: "4"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SetEnvs() = %v, want %v", got, want)
+	}
+	if envs[1].Value != "2" {
+		t.Errorf("SetEnvs() modified the original envs")
+	}
+}
+
+func TestUnmaskEnvs(t *testing.T) {
+	envs := []Env{{Key: "TOKEN", Value: "s3cret", Secret: true}, {Key: "MODE", Value: "dev"}}
+	got, err := UnmaskEnvs(envs, []Env{{Key: "TOKEN", Value: maskedSecret, Secret: true}, {Key: "MODE", Value: "prod"}})
+	if err != nil {
+		t.Fatalf("UnmaskEnvs() unexpected error: %v", err)
+	}
+	want := []Env{{Key: "TOKEN", Value: "s3cret", Secret: true}, {Key: "MODE", Value: "prod"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UnmaskEnvs() = %v, want %v", got, want)
+	}
+
+	//a masked value can't be set on a new env or on one that isn't secret
+	for _, update := range []Env{{Key: "NEW", Value: maskedSecret}, {Key: "MODE", Value: maskedSecret}} {
+		if _, err := UnmaskEnvs(envs, []Env{update}); err == nil {
+			t.Errorf("UnmaskEnvs(%s): expected an error", update.Key)
+		}
+	}
+}
+
+func TestRemoveEnvs(t *testing.T) {
+	envs := []Env{{Key: "A", Value: "1"}, {Key: "B", Value: "2"}}
+	got, missing := RemoveEnvs(envs, []string{"A", "C"})
+	if !reflect.DeepEqual(got, []Env{{Key: "B", Value: "2"}}) {
+		t.Errorf("RemoveEnvs() = %v", got)
+	}
+	if !reflect.DeepEqual(missing, []string{"C"}) {
+		t.Errorf("RemoveEnvs() missing = %v, want [C]", missing)
+	}
+}
+
+func TestEnvList(t *testing.T) {
+	got := EnvList([]Env{{Key: "A", Value: "x=y"}})
+	if !reflect.DeepEqual(got, []string{"A=x=y"}) {
+		t.Errorf("EnvList() = %v", got)
+	}
+}
+
+func TestEnvEncoding(t *testing.T) {
+	var err error
+	secretStore, err = NewSecretStore(testSecretsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := Application{Envs: []Env{{Key: "PORT", Value: "8080"}, {Key: "TOKEN", Value: "s3cr3t", Secret: true}}}
+	data, err := bson.Marshal(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cr3t") || strings.Contains(string(data), "8080") {
+		t.Errorf("the envs are saved in plain text")
+	}
+
+	var decoded Application
+	if err := bson.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Envs, app.Envs) {
+		t.Errorf("decoded envs = %v, want %v", decoded.Envs, app.Envs)
+	}
+
+	body, err := json.Marshal(app.Envs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"key":"PORT","value":"8080"},{"key":"TOKEN","value":"********","secret":true}]`
+	if string(body) != want {
+		t.Errorf("json = %s, want %s", body, want)
+	}
+}
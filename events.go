@@ -1,32 +1,210 @@
 package main
 
 import (
-	"github.com/docker/docker/api/types"
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// statuses of an application set by the event handler, the other ones are the docker states
+const (
+	AppStatusRunning   = "running"
+	AppStatusExited    = "exited"
+	AppStatusOOMKilled = "oom-killed"
+	//set by the user with the container api, the die events don't change them
+	AppStatusStopped    = "stopped"
+	AppStatusRestarting = "restarting"
+)
+
+// max time waited before subscribing again to the docker events after an error
+const maxEventsReconnectDelay = 30 * time.Second
+
+// default value of EVENTS_RETENTION
+const defaultEventsRetention = 30 * 24 * time.Hour
+
+// eventsRetention returns how long the events of the applications are kept (EVENTS_RETENTION),
+// the non valid values fallback to the default and it's never shorter than the crash loop window
+func eventsRetention() time.Duration {
+	retention, err := time.ParseDuration(os.Getenv("EVENTS_RETENTION"))
+	if err != nil || retention <= 0 {
+		retention = defaultEventsRetention
+	}
+	if retention < CrashLoopWindow {
+		retention = CrashLoopWindow
+	}
+	return retention
+}
+
+// AppEvent is an event of the container of an application saved in the appEvents collection
+type AppEvent struct {
+	ID            primitive.ObjectID `bson:"_id" json:"-"`
+	ApplicationID primitive.ObjectID `bson:"applicationID" json:"-"`
+	ContainerID   string             `bson:"containerID" json:"containerID"`
+	Action        string             `bson:"action" json:"action"`                         //docker action (start, die, oom, health_status)
+	Status        string             `bson:"status" json:"status"`                         //status of the application after the event
+	Health        string             `bson:"health,omitempty" json:"health,omitempty"`     //health of the container for the health_status events
+	ExitCode      string             `bson:"exitCode,omitempty" json:"exitCode,omitempty"` //exit code of the container for the die events
+	Time          time.Time          `bson:"time" json:"time"`
+}
+
+// EventHandler listens to the events of the containers and saves them on the applications they belong to,
+// if the stream of events fails it subscribes again from the last event received so none is lost
 func (c ContainerController) EventHandler() {
-	eventChan, errChan := c.cli.Events(c.ctx, types.EventsOptions{})
+	//the events before the start are already reflected in the status saved at creation
+	last := time.Now().UnixNano()
+	delay := time.Second
+	for {
+		received, err := c.listenEvents(last)
+		if received > last {
+			last = received
+			delay = time.Second
+		}
+		log.Printf("[ERROR] Error in event handler, reconnecting in %v: %v", delay, err)
+
+		time.Sleep(delay)
+		if delay *= 2; delay > maxEventsReconnectDelay {
+			delay = maxEventsReconnectDelay
+		}
+	}
+}
+
+// listenEvents subscribes to the container events since the given time (unix nano) until the stream fails,
+// it returns the time of the last event handled and the error of the stream
+func (c ContainerController) listenEvents(since int64) (int64, error) {
+	args := filters.NewArgs(
+		filters.Arg("type", events.ContainerEventType),
+		filters.Arg("event", "start"),
+		filters.Arg("event", "die"),
+		filters.Arg("event", "oom"),
+		filters.Arg("event", "health_status"),
+	)
+	eventChan, errChan := c.cli.Events(c.ctx, types.EventsOptions{
+		Since:   fmt.Sprintf("%d.%09d", since/int64(time.Second), since%int64(time.Second)),
+		Filters: args,
+	})
+
+	last := since
 	for {
 		select {
 		case event := <-eventChan:
-			//log.Println(event)
-			switch event.Type {
-			case "container":
-				//log.Println("container event\n\n")
-				switch event.Action {
-				case "die":
-					log.Println("[EVENT] Container died:", event.Actor.ID)
-				case "health_status":
-					log.Println("[EVENT] Container health status:", event.Actor.ID)
-				case "kill":
-					log.Println("[EVENT] Container killed:", event.Actor.ID)
-				case "update":
-					log.Println("[EVENT] Container updated:", event.Actor.ID)
-				}
+			//since is inclusive so the last event of the previous stream is sent again
+			if event.TimeNano <= since {
+				continue
 			}
+			if err := c.handleContainerEvent(event); err != nil {
+				log.Printf("[ERROR] Error saving the event %s of container %s: %v", event.Action, event.Actor.ID, err)
+			}
+			last = event.TimeNano
 		case err := <-errChan:
-			log.Println("[errore] Error in event handler: ", err)
+			return last, err
+		}
+	}
+}
+
+// isStoppedByPlatform checks if the container of an application with the given status
+// has been stopped on purpose (by the crash loop detection, the idle reaper or the user)
+func isStoppedByPlatform(status string) bool {
+	switch status {
+	case AppStatusCrashLooping, AppStatusSleeping, AppStatusStopped, AppStatusRestarting:
+		return true
+	}
+	return false
+}
+
+// handleContainerEvent updates the status of the application that owns the container
+// and appends the event to its timeline, the containers that aren't applications are ignored
+func (c ContainerController) handleContainerEvent(event events.Message) error {
+	db := c.db
+
+	var app Application
+	err := db.Collection("applications").FindOne(context.TODO(), bson.M{"containerID": event.Actor.ID}).Decode(&app)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}
+
+	appEvent := AppEvent{
+		ID:            primitive.NewObjectID(),
+		ApplicationID: app.ID,
+		ContainerID:   event.Actor.ID,
+		Action:        event.Action,
+		Status:        app.Status,
+		Time:          time.Unix(0, event.TimeNano),
+	}
+	update := bson.M{}
+
+	switch event.Action {
+	case "start":
+		appEvent.Status = AppStatusRunning
+		update["crashLoop"] = nil
+	case "die":
+		appEvent.Status = AppStatusExited
+		//the container stopped by the crash loop detection stays crashlooping and the ones stopped
+		//or restarted by the user aren't crashing
+		if isStoppedByPlatform(app.Status) {
+			appEvent.Status = app.Status
+		}
+		appEvent.ExitCode = event.Actor.Attributes["exitCode"]
+		//the die event follows the oom one, the reason of the exit is kept
+		if container, err := c.cli.ContainerInspect(c.ctx, event.Actor.ID); err == nil && container.State.OOMKilled {
+			appEvent.Status = AppStatusOOMKilled
 		}
+	case "oom":
+		appEvent.Status = AppStatusOOMKilled
+	default:
+		//the action is "health_status: healthy" or "health_status: unhealthy"
+		if strings.HasPrefix(event.Action, "health_status: ") {
+			appEvent.Action = "health_status"
+			appEvent.Health = strings.TrimPrefix(event.Action, "health_status: ")
+			update["health"] = appEvent.Health
+		}
+	}
+	update["status"] = appEvent.Status
+
+	if _, err := db.Collection("appEvents").InsertOne(context.TODO(), appEvent); err != nil {
+		return err
+	}
+
+	//the web applications that keep dying are stopped
+	if event.Action == "die" && app.Type == "web" && !isStoppedByPlatform(app.Status) {
+		crashLooping, err := c.checkCrashLoop(app, appEvent.ExitCode, db)
+		if err != nil {
+			return err
+		}
+		if crashLooping {
+			log.Printf("[EVENT] Application %s is crashlooping, it has been stopped", app.ID.Hex())
+			return nil
+		}
+	}
+	//the container is checked again since it could have been replaced by an update in the meantime
+	_, err = db.Collection("applications").UpdateOne(context.TODO(), bson.M{"_id": app.ID, "containerID": event.Actor.ID}, bson.M{"$set": update})
+	return err
+}
+
+// GetAppEvents returns the last events of an application, the newest first
+func GetAppEvents(applicationID primitive.ObjectID, limit int64, db *mongo.Database) ([]AppEvent, error) {
+	cur, err := db.Collection("appEvents").Find(context.TODO(), bson.M{"applicationID": applicationID},
+		options.Find().SetSort(bson.M{"time": -1}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	appEvents := []AppEvent{}
+	if err := cur.All(context.TODO(), &appEvents); err != nil {
+		return nil, err
 	}
+	return appEvents, nil
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/websocket"
+)
+
+// command run in the exec sessions
+var execCommand = []string{"/bin/sh"}
+
+const (
+	//default value of EXEC_IDLE_TIMEOUT
+	defaultExecIdleTimeout = 10 * time.Minute
+	//max bytes of the input saved in the audit log of a session
+	maxExecAuditInput = 64 * 1024
+	//time given to the client to open the websocket with a ticket
+	execTicketTTL = 30 * time.Second
+)
+
+// ExecMessage is a message sent by the client of an exec session
+type ExecMessage struct {
+	Type string `json:"type"`           //stdin or resize
+	Data string `json:"data,omitempty"` //for stdin
+	Cols uint   `json:"cols,omitempty"` //for resize
+	Rows uint   `json:"rows,omitempty"` //for resize
+}
+
+// ExecSession is the audit log of a terminal opened in a container, saved in the execSessions collection
+type ExecSession struct {
+	ID            primitive.ObjectID `bson:"_id" json:"id"`
+	ApplicationID primitive.ObjectID `bson:"applicationID" json:"-"`
+	ContainerID   string             `bson:"containerID" json:"containerID"`
+	StudentID     int                `bson:"studentID" json:"studentID"`
+	Command       []string           `bson:"command" json:"command"`
+	RemoteAddr    string             `bson:"remoteAddr" json:"remoteAddr"`
+	Input         string             `bson:"input" json:"input"` //what the user typed (truncated after maxExecAuditInput bytes)
+	BytesIn       int                `bson:"bytesIn" json:"bytesIn"`
+	BytesOut      int                `bson:"bytesOut" json:"bytesOut"`
+	ExitCode      int                `bson:"exitCode" json:"exitCode"`
+	EndReason     string             `bson:"endReason" json:"endReason"` //exited, disconnected, idle or the error
+	StartedAt     time.Time          `bson:"startedAt" json:"startedAt"`
+	EndedAt       time.Time          `bson:"endedAt" json:"endedAt"`
+}
+
+// ExecTickets are the one time tickets needed to open a terminal. The browsers send the cookies of the user with the
+// websockets opened by any site (even the applications on the other hosts of the platform) and the handshake can't
+// have custom headers, so the ticket is asked with an api call first: the other sites can send it but can't read the response
+type ExecTickets struct {
+	mu      sync.Mutex
+	tickets map[string]execTicket
+}
+
+type execTicket struct {
+	applicationID primitive.ObjectID
+	studentID     int
+	expires       time.Time
+}
+
+// NewExecTickets creates an empty store of tickets
+func NewExecTickets() *ExecTickets {
+	return &ExecTickets{tickets: make(map[string]execTicket)}
+}
+
+// Issue returns a new ticket to open a terminal in the application, valid for execTicketTTL
+func (t *ExecTickets) Issue(applicationID primitive.ObjectID, studentID int) string {
+	ticket := generateRandomString(32)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	//the expired tickets are removed when new ones are issued
+	for key, old := range t.tickets {
+		if time.Now().After(old.expires) {
+			delete(t.tickets, key)
+		}
+	}
+	t.tickets[ticket] = execTicket{applicationID: applicationID, studentID: studentID, expires: time.Now().Add(execTicketTTL)}
+	return ticket
+}
+
+// Consume checks that the ticket was issued for the application and the student and that it's not expired,
+// a ticket can be used only once
+func (t *ExecTickets) Consume(ticket string, applicationID primitive.ObjectID, studentID int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	issued, found := t.tickets[ticket]
+	if !found {
+		return false
+	}
+	delete(t.tickets, ticket)
+	return issued.applicationID == applicationID && issued.studentID == studentID && time.Now().Before(issued.expires)
+}
+
+// checkSameOrigin refuses the websockets opened by other sites, the browsers send the cookies
+// of the user with them so they could open a terminal in the user's containers
+func checkSameOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return fmt.Errorf("origin %s not allowed", origin)
+	}
+	config.Origin = u
+	return nil
+}
+
+// RunExecSession opens a shell with a tty in the container and connects it to the websocket: the output
+// is sent as binary messages and the client sends ExecMessage as json. The session ends when the shell exits,
+// the client disconnects or nothing is typed for idleTimeout, then it's saved in the audit log
+func (c ContainerController) RunExecSession(ws *websocket.Conn, session *ExecSession, idleTimeout time.Duration) {
+	defer ws.Close()
+	session.StartedAt = time.Now()
+	session.EndReason = c.execSession(ws, session, idleTimeout)
+	session.EndedAt = time.Now()
+
+	if err := saveExecSession(*session); err != nil {
+		log.Printf("[ERROR] can't save the exec session %s: %v", session.ID.Hex(), err)
+	}
+	log.Printf("[EXEC] session %s of %d on %s ended: %s", session.ID.Hex(), session.StudentID, session.ContainerID, session.EndReason)
+}
+
+// execSession runs the session and returns why it ended
+func (c ContainerController) execSession(ws *websocket.Conn, session *ExecSession, idleTimeout time.Duration) string {
+	exec, err := c.cli.ContainerExecCreate(c.ctx, session.ContainerID, types.ExecConfig{
+		Tty:          true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          []string{"TERM=xterm"},
+		Cmd:          session.Command,
+	})
+	if err != nil {
+		websocket.Message.Send(ws, "error creating the exec: "+err.Error())
+		return err.Error()
+	}
+	attach, err := c.cli.ContainerExecAttach(c.ctx, exec.ID, types.ExecStartCheck{Tty: true})
+	if err != nil {
+		websocket.Message.Send(ws, "error attaching to the exec: "+err.Error())
+		return err.Error()
+	}
+
+	reason := pumpExecSession(ws, execStream{
+		output: attach.Reader,
+		input:  attach.Conn,
+		close:  attach.Close,
+		resize: func(cols, rows uint) error {
+			return c.cli.ContainerExecResize(c.ctx, exec.ID, types.ResizeOptions{Width: cols, Height: rows})
+		},
+	}, session, idleTimeout)
+	if inspect, err := c.cli.ContainerExecInspect(c.ctx, exec.ID); err == nil {
+		session.ExitCode = inspect.ExitCode
+	}
+	return reason
+}
+
+// execStream is the tty of an exec attached to the session
+type execStream struct {
+	output io.Reader
+	input  io.Writer
+	close  func()
+	resize func(cols, rows uint) error
+}
+
+// pumpExecSession copies the output of the tty to the websocket and the messages of the client to the tty
+// until one of the sides ends or the session is idle, it returns why the session ended
+func pumpExecSession(ws *websocket.Conn, stream execStream, session *ExecSession, idleTimeout time.Duration) string {
+	var wg sync.WaitGroup
+	var once sync.Once
+	reason := make(chan string, 1)
+	end := func(r string) {
+		once.Do(func() { reason <- r })
+	}
+
+	idle := time.AfterFunc(idleTimeout, func() { end("idle") })
+	defer idle.Stop()
+
+	//container -> websocket
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stream.output.Read(buf)
+			if n > 0 {
+				session.BytesOut += n
+				if err := websocket.Message.Send(ws, buf[:n]); err != nil {
+					end("disconnected")
+					return
+				}
+			}
+			if err == io.EOF {
+				end("exited")
+				return
+			}
+			if err != nil {
+				end(err.Error())
+				return
+			}
+		}
+	}()
+
+	//websocket -> container
+	go func() {
+		defer wg.Done()
+		for {
+			var msg ExecMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				end("disconnected")
+				return
+			}
+			switch msg.Type {
+			case "stdin":
+				idle.Reset(idleTimeout)
+				session.BytesIn += len(msg.Data)
+				if len(session.Input) < maxExecAuditInput {
+					session.Input += msg.Data
+				}
+				if _, err := stream.input.Write([]byte(msg.Data)); err != nil {
+					end(err.Error())
+					return
+				}
+			case "resize":
+				if msg.Cols == 0 || msg.Rows == 0 {
+					continue
+				}
+				if err := stream.resize(msg.Cols, msg.Rows); err != nil {
+					log.Printf("[ERROR] can't resize the exec of session %s: %v", session.ID.Hex(), err)
+				}
+			}
+		}
+	}()
+
+	r := <-reason
+	if r == "idle" {
+		websocket.Message.Send(ws, "\r\nsession closed after "+idleTimeout.String()+" of inactivity\r\n")
+	}
+	//closing both sides stops the goroutines, then the session can be read
+	stream.close()
+	ws.Close()
+	wg.Wait()
+	if len(session.Input) > maxExecAuditInput {
+		session.Input = session.Input[:maxExecAuditInput]
+	}
+	return r
+}
+
+// ExecCommand runs a command in a container without a tty and waits for it to end,
+// it returns the output (stdout and stderr) and the exit code
+func (c ContainerController) ExecCommand(containerID string, cmd, env []string) (string, int, error) {
+	exec, err := c.cli.ContainerExecCreate(c.ctx, containerID, types.ExecConfig{
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          env,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	attach, err := c.cli.ContainerExecAttach(c.ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return "", 0, err
+	}
+	defer attach.Close()
+
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, attach.Reader); err != nil {
+		return "", 0, err
+	}
+	inspect, err := c.cli.ContainerExecInspect(c.ctx, exec.ID)
+	if err != nil {
+		return "", 0, err
+	}
+	return output.String(), inspect.ExitCode, nil
+}
+
+// saveExecSession writes the session in the audit log
+func saveExecSession(session ExecSession) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	_, err = db.Collection("execSessions").InsertOne(context.TODO(), session)
+	return err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/websocket"
+)
+
+func TestCheckSameOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		valid  bool
+	}{
+		{"", true},
+		{"http://ipaas.example.com", true},
+		{"https://ipaas.example.com", true},
+		{"http://evil.example.org", false},
+		{"http://blog.18008.apps.example.com", false},
+		{"http://ipaas.example.com.evil.org", false},
+		{"://not an url", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://ipaas.example.com/api/app/abc/exec", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		err := checkSameOrigin(&websocket.Config{}, r)
+		if test.valid && err != nil {
+			t.Errorf("checkSameOrigin(%q): unexpected error: %v", test.origin, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("checkSameOrigin(%q): expected an error", test.origin)
+		}
+	}
+}
+
+func TestExecTickets(t *testing.T) {
+	tickets := NewExecTickets()
+	appID := primitive.NewObjectID()
+
+	ticket := tickets.Issue(appID, 18008)
+	if tickets.Consume(ticket, primitive.NewObjectID(), 18008) {
+		t.Errorf("a ticket was accepted for another application")
+	}
+	//the ticket is removed even when it's used for the wrong application
+	if tickets.Consume(ticket, appID, 18008) {
+		t.Errorf("a ticket was accepted twice")
+	}
+
+	ticket = tickets.Issue(appID, 18008)
+	if tickets.Consume(ticket, appID, 18009) {
+		t.Errorf("a ticket was accepted for another student")
+	}
+	ticket = tickets.Issue(appID, 18008)
+	if !tickets.Consume(ticket, appID, 18008) {
+		t.Errorf("a valid ticket was refused")
+	}
+	if tickets.Consume("", appID, 18008) {
+		t.Errorf("an empty ticket was accepted")
+	}
+
+	ticket = tickets.Issue(appID, 18008)
+	tickets.tickets[ticket] = execTicket{applicationID: appID, studentID: 18008, expires: time.Now().Add(-time.Second)}
+	if tickets.Consume(ticket, appID, 18008) {
+		t.Errorf("an expired ticket was accepted")
+	}
+}
+
+// startExecSession runs a session on a fake tty and connects a websocket client to it, it returns the client,
+// the container side of the tty and the channel with the reason the session ended
+func startExecSession(t *testing.T, session *ExecSession, idleTimeout time.Duration) (*websocket.Conn, net.Conn, chan string) {
+	container, tty := net.Pipe()
+	reason := make(chan string, 1)
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		reason <- pumpExecSession(ws, execStream{
+			output: tty,
+			input:  tty,
+			close:  func() { tty.Close() },
+			resize: func(cols, rows uint) error { return nil },
+		}, session, idleTimeout)
+	}))
+	t.Cleanup(server.Close)
+
+	ws, err := websocket.Dial(strings.Replace(server.URL, "http", "ws", 1), "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws, container, reason
+}
+
+func waitReason(t *testing.T, reason chan string) string {
+	select {
+	case r := <-reason:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session didn't end")
+		return ""
+	}
+}
+
+func TestExecSessionExited(t *testing.T) {
+	session := &ExecSession{}
+	ws, container, reason := startExecSession(t, session, time.Minute)
+
+	go container.Write([]byte("$ "))
+	var output []byte
+	if err := websocket.Message.Receive(ws, &output); err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "$ " {
+		t.Errorf("expected the prompt on the websocket, got %q", output)
+	}
+
+	if err := websocket.JSON.Send(ws, ExecMessage{Type: "stdin", Data: "ls\n"}); err != nil {
+		t.Fatal(err)
+	}
+	input := make([]byte, 3)
+	if _, err := container.Read(input); err != nil {
+		t.Fatal(err)
+	}
+	if string(input) != "ls\n" {
+		t.Errorf("expected the input on the tty, got %q", input)
+	}
+
+	//the shell exits
+	container.Close()
+	if r := waitReason(t, reason); r != "exited" {
+		t.Errorf("expected the session to end as exited, got %s", r)
+	}
+	if session.Input != "ls\n" || session.BytesIn != 3 || session.BytesOut != 2 {
+		t.Errorf("wrong audit of the session: input %q, %d bytes in, %d bytes out", session.Input, session.BytesIn, session.BytesOut)
+	}
+}
+
+func TestExecSessionDisconnected(t *testing.T) {
+	ws, _, reason := startExecSession(t, &ExecSession{}, time.Minute)
+	ws.Close()
+	if r := waitReason(t, reason); r != "disconnected" {
+		t.Errorf("expected the session to end as disconnected, got %s", r)
+	}
+}
+
+func TestExecSessionIdle(t *testing.T) {
+	ws, _, reason := startExecSession(t, &ExecSession{}, 50*time.Millisecond)
+	var message []byte
+	if err := websocket.Message.Receive(ws, &message); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(message), "inactivity") {
+		t.Errorf("expected the idle message, got %q", message)
+	}
+	if r := waitReason(t, reason); r != "idle" {
+		t.Errorf("expected the session to end as idle, got %s", r)
+	}
+}
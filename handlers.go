@@ -24,9 +24,20 @@ import (
 )
 
 type Handler struct {
-	cc   *ContainerController
-	sess *sessions.CookieStore
-	util *Util
+	cc        *ContainerController
+	sess      *sessions.CookieStore
+	util      *Util
+	queue     *DeployQueue
+	buildLogs *BuildLogStore
+	//number of release images kept for each application
+	releasesToKeep int
+	proxy          *Proxy
+	//checks the ownership of the custom domains
+	domainVerifier DomainVerifier
+	metrics        *MetricsCollector
+	//the exec sessions are closed after this time without input
+	execIdleTimeout time.Duration
+	execTickets     *ExecTickets
 }
 
 //!===========================GENERICS HANDLERS
@@ -94,16 +105,18 @@ func (h Handler) OauthHandler(w http.ResponseWriter, r *http.Request) {
 
 		//!should set domain and path
 		http.SetCookie(w, &http.Cookie{
-			Name:    "ipaas-access-token",
-			Path:    "/",
-			Value:   ipaasAccessToken,
-			Expires: time.Now().Add(time.Hour),
+			Name:     "ipaas-access-token",
+			Path:     "/",
+			Value:    ipaasAccessToken,
+			Expires:  time.Now().Add(time.Hour),
+			HttpOnly: true,
 		})
 		http.SetCookie(w, &http.Cookie{
-			Name:    "ipaas-refresh-token",
-			Path:    "/",
-			Value:   ipaasRefreshToken,
-			Expires: time.Now().Add(time.Hour * 24 * 7),
+			Name:     "ipaas-refresh-token",
+			Path:     "/",
+			Value:    ipaasRefreshToken,
+			Expires:  time.Now().Add(time.Hour * 24 * 7),
+			HttpOnly: true,
 		})
 		http.SetCookie(w, &http.Cookie{
 			Name:    "ipaas-session",
@@ -329,31 +342,35 @@ func (h Handler) NewTokenPairFromRefreshTokenHandler(w http.ResponseWriter, r *h
 
 	//delete the old tokens from the cookies
 	http.SetCookie(w, &http.Cookie{
-		Name:    "ipaas-access-token",
-		Path:    "/",
-		Value:   "",
-		Expires: time.Unix(0, 0),
+		Name:     "ipaas-access-token",
+		Path:     "/",
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
 	})
 	http.SetCookie(w, &http.Cookie{
-		Name:    "ipaas-refresh-token",
-		Path:    "/",
-		Value:   "",
-		Expires: time.Unix(0, 0),
+		Name:     "ipaas-refresh-token",
+		Path:     "/",
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
 	})
 
 	//set the new tokens
 	//!should set domain and path
 	http.SetCookie(w, &http.Cookie{
-		Name:    "ipaas-access-token",
-		Path:    "/",
-		Value:   accessToken,
-		Expires: time.Now().Add(time.Hour),
+		Name:     "ipaas-access-token",
+		Path:     "/",
+		Value:    accessToken,
+		Expires:  time.Now().Add(time.Hour),
+		HttpOnly: true,
 	})
 	http.SetCookie(w, &http.Cookie{
-		Name:    "ipaas-refresh-token",
-		Path:    "/",
-		Value:   newRefreshToken,
-		Expires: time.Now().Add(time.Hour * 24 * 7),
+		Name:     "ipaas-refresh-token",
+		Path:     "/",
+		Value:    newRefreshToken,
+		Expires:  time.Now().Add(time.Hour * 24 * 7),
+		HttpOnly: true,
 	})
 
 	//we also respond with the new tokens so the client doesn't have to depend on from the cookies
@@ -364,6 +381,49 @@ func (h Handler) NewTokenPairFromRefreshTokenHandler(w http.ResponseWriter, r *h
 	resp.SuccessParse(w, http.StatusOK, "New token pair generated", response)
 }
 
+// logs the user out deleting the token cookies, they are http only so the pages can't delete them
+func (h Handler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{"ipaas-access-token", "ipaas-refresh-token"} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			Value:    "",
+			Expires:  time.Unix(0, 0),
+			HttpOnly: true,
+		})
+	}
+	resp.Success(w, http.StatusOK, "logged out")
+}
+
+// returns the quota of the user and how much of it is used
+func (h Handler) GetQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := connectToDB()
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error connecting to the database: %v", err.Error())
+		return
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	//get the student from the cookies
+	student, err := h.util.GetUserFromCookie(r, db)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error getting the user from cookies: %v", err.Error())
+		return
+	}
+
+	usage, err := h.cc.GetQuotaUsage(student.ID, db)
+	if err != nil {
+		resp.Errorf(w, http.StatusInternalServerError, "error getting the quota usage: %v", err.Error())
+		return
+	}
+
+	response := map[string]interface{}{
+		"quota": GetQuota(student),
+		"usage": usage,
+	}
+	resp.SuccessParse(w, http.StatusOK, "quota", response)
+}
+
 func (h Handler) ValidGithubUrlAndGetBranchesHandler(w http.ResponseWriter, r *http.Request) {
 	//read the body and conver to string
 	body, err := io.ReadAll(r.Body)
@@ -373,7 +433,8 @@ func (h Handler) ValidGithubUrlAndGetBranchesHandler(w http.ResponseWriter, r *h
 	}
 
 	type Body struct {
-		Repo string `json:"repo"`
+		Repo   string `json:"repo"`
+		Branch string `json:"branch,omitempty"`
 	}
 
 	var bodyStruct Body
@@ -400,6 +461,18 @@ func (h Handler) ValidGithubUrlAndGetBranchesHandler(w http.ResponseWriter, r *h
 	response["branches"] = branches
 	response["valid"] = true
 
+	//suggest a runtime looking at the files of the repo, an error here doesn't make the repo invalid
+	branch := bodyStruct.Branch
+	if branch == "" {
+		branch = defaultBranch
+	}
+	files, err := h.util.GetRootFilesFromRepo(bodyStruct.Repo, branch)
+	if err != nil {
+		log.Printf("[ERROR] Error getting the files of %s: %v\n", bodyStruct.Repo, err)
+	} else {
+		response["detection"] = DetectRuntime(files)
+	}
+
 	resp.SuccessParse(w, http.StatusOK, "valid github url", response)
 }
 
@@ -508,16 +581,18 @@ func (h Handler) MockRegisterUserHandler(w http.ResponseWriter, r *http.Request)
 
 	//set the cookies
 	http.SetCookie(w, &http.Cookie{
-		Name:    "ipaas-access-token",
-		Path:    "/",
-		Value:   accessToken,
-		Expires: time.Now().Add(time.Hour),
+		Name:     "ipaas-access-token",
+		Path:     "/",
+		Value:    accessToken,
+		Expires:  time.Now().Add(time.Hour),
+		HttpOnly: true,
 	})
 	http.SetCookie(w, &http.Cookie{
-		Name:    "ipaas-refresh-token",
-		Path:    "/",
-		Value:   refreshToken,
-		Expires: time.Now().Add(time.Hour * 24 * 7),
+		Name:     "ipaas-refresh-token",
+		Path:     "/",
+		Value:    refreshToken,
+		Expires:  time.Now().Add(time.Hour * 24 * 7),
+		HttpOnly: true,
 	})
 
 	resp.Success(w, http.StatusCreated, "Mock user created")
@@ -593,16 +668,18 @@ func (h Handler) MockLoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	//set the cookies
 	http.SetCookie(w, &http.Cookie{
-		Name:    "ipaas-access-token",
-		Path:    "/",
-		Value:   accessToken,
-		Expires: time.Now().Add(time.Hour),
+		Name:     "ipaas-access-token",
+		Path:     "/",
+		Value:    accessToken,
+		Expires:  time.Now().Add(time.Hour),
+		HttpOnly: true,
 	})
 	http.SetCookie(w, &http.Cookie{
-		Name:    "ipaas-refresh-token",
-		Path:    "/",
-		Value:   refreshToken,
-		Expires: time.Now().Add(time.Hour * 24 * 7),
+		Name:     "ipaas-refresh-token",
+		Path:     "/",
+		Value:    refreshToken,
+		Expires:  time.Now().Add(time.Hour * 24 * 7),
+		HttpOnly: true,
 	})
 
 	http.Redirect(w, r, "/user/", http.StatusSeeOther)
@@ -619,9 +696,38 @@ func NewHandler() (*Handler, error) {
 	if err != nil {
 		return nil, err
 	}
+	//the containers created before the networks of the students are isolated too
+	if err := h.cc.MoveToStudentNetworks(); err != nil {
+		return nil, fmt.Errorf("error moving the containers to the networks of the students: %v", err)
+	}
 	h.util, err = NewUtil(h.cc.ctx)
 	if err != nil {
 		return nil, err
 	}
+	//a non valid value will fallback to the default
+	maxBuilds, _ := strconv.Atoi(os.Getenv("MAX_CONCURRENT_BUILDS"))
+	h.queue = NewDeployQueue(maxBuilds)
+	h.buildLogs = NewBuildLogStore()
+	//an empty or non valid value disables the scale to zero of the idle applications
+	idleTimeout, _ := time.ParseDuration(os.Getenv("IDLE_TIMEOUT"))
+	//the applications are served only on their own hosts, never on the one of the platform
+	if os.Getenv("PROXY_BASE_DOMAIN") == "" {
+		return nil, fmt.Errorf("PROXY_BASE_DOMAIN must be set, the applications are reached on <app>.<studentID>.<domain>")
+	}
+	h.proxy = NewProxy(h.cc, os.Getenv("PROXY_BASE_DOMAIN"), PlatformHosts(), idleTimeout)
+	h.domainVerifier = NewDomainVerifier(os.Getenv("DOMAIN_RESOLVER"))
+	//the non valid values fallback to the defaults
+	metricsInterval, _ := time.ParseDuration(os.Getenv("METRICS_INTERVAL"))
+	metricsRetention, _ := time.ParseDuration(os.Getenv("METRICS_RETENTION"))
+	h.metrics = NewMetricsCollector(h.cc, metricsInterval, metricsRetention)
+	h.execIdleTimeout, _ = time.ParseDuration(os.Getenv("EXEC_IDLE_TIMEOUT"))
+	if h.execIdleTimeout <= 0 {
+		h.execIdleTimeout = defaultExecIdleTimeout
+	}
+	h.execTickets = NewExecTickets()
+	h.releasesToKeep, _ = strconv.Atoi(os.Getenv("RELEASES_TO_KEEP"))
+	if h.releasesToKeep <= 0 {
+		h.releasesToKeep = defaultReleasesToKeep
+	}
 	return &h, nil
 }
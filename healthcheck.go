@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// health of an application
+const (
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// default values of the health checks
+const (
+	defaultHealthInterval = 30 //seconds
+	defaultHealthTimeout  = 5  //seconds
+	//consecutive failed probes after which an application is unhealthy
+	healthFailureThreshold = 3
+	//how often the prober looks for the applications to check
+	healthProberTick = 5 * time.Second
+)
+
+// HealthCheck is the http check the platform runs against an application,
+// it's used to decide if a deploy succeeded and then periodically by the prober
+type HealthCheck struct {
+	Path           string `bson:"path" json:"path"`                                         //path requested, must start with /
+	ExpectedStatus int    `bson:"expectedStatus,omitempty" json:"expectedStatus,omitempty"` //status code expected, if not set any 2xx or 3xx is fine
+	Interval       int    `bson:"interval,omitempty" json:"interval,omitempty"`             //seconds between two checks (default 30)
+	Timeout        int    `bson:"timeout,omitempty" json:"timeout,omitempty"`               //seconds to wait for the response (default 5)
+}
+
+// HealthResult is the result of the last check of an application
+type HealthResult struct {
+	Healthy   bool      `bson:"healthy" json:"healthy"`
+	Status    int       `bson:"status,omitempty" json:"status,omitempty"` //status code returned by the application
+	Error     string    `bson:"error,omitempty" json:"error,omitempty"`
+	Failures  int       `bson:"failures" json:"failures"` //consecutive failed checks
+	CheckedAt time.Time `bson:"checkedAt" json:"checkedAt"`
+}
+
+// Validate checks the health check and sets the default values of the fields not set
+func (hc *HealthCheck) Validate() error {
+	if !strings.HasPrefix(hc.Path, "/") {
+		return fmt.Errorf("the path of the health check must start with /")
+	}
+	if hc.ExpectedStatus != 0 && (hc.ExpectedStatus < 100 || hc.ExpectedStatus > 599) {
+		return fmt.Errorf("the expected status of the health check must be a valid http status code")
+	}
+
+	if hc.Interval == 0 {
+		hc.Interval = defaultHealthInterval
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = defaultHealthTimeout
+	}
+	if hc.Interval < 5 || hc.Interval > 3600 {
+		return fmt.Errorf("the interval of the health check must be between 5 and 3600 seconds")
+	}
+	if hc.Timeout < 1 || hc.Timeout > hc.Interval {
+		return fmt.Errorf("the timeout of the health check must be between 1 second and the interval")
+	}
+	return nil
+}
+
+// Probe requests the path of the health check to the application listening on host:port,
+// it returns the status code received and an error if the application is not healthy
+func (hc HealthCheck) Probe(host, port string) (int, error) {
+	client := http.Client{
+		Timeout: time.Duration(hc.Timeout) * time.Second,
+		//the redirects are a valid answer, they are not followed
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Get("http://" + net.JoinHostPort(host, port) + hc.Path)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	if hc.ExpectedStatus != 0 {
+		if res.StatusCode != hc.ExpectedStatus {
+			return res.StatusCode, fmt.Errorf("expected status %d, got %d", hc.ExpectedStatus, res.StatusCode)
+		}
+		return res.StatusCode, nil
+	}
+	if res.StatusCode >= 400 {
+		return res.StatusCode, fmt.Errorf("got status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// HealthProber periodically runs the health checks of the running applications that have one,
+// the result is saved on the application and the changes of health are added to its events
+func (c ContainerController) HealthProber() {
+	for range time.Tick(healthProberTick) {
+		if err := c.probeApplications(); err != nil {
+			log.Printf("[ERROR] Error probing the applications: %v", err)
+		}
+	}
+}
+
+func (c ContainerController) probeApplications() error {
+	db := c.db
+
+	cur, err := db.Collection("applications").Find(context.TODO(), bson.M{
+		"healthCheck": bson.M{"$exists": true},
+		"status":      AppStatusRunning,
+	})
+	if err != nil {
+		return err
+	}
+	var apps []Application
+	if err := cur.All(context.TODO(), &apps); err != nil {
+		return err
+	}
+
+	for _, app := range apps {
+		previous := HealthResult{}
+		if app.HealthResult != nil {
+			previous = *app.HealthResult
+		}
+		if time.Since(previous.CheckedAt) < time.Duration(app.HealthCheck.Interval)*time.Second {
+			continue
+		}
+
+		result := HealthResult{CheckedAt: time.Now()}
+		ip, err := c.AppIP(app.ContainerID)
+		if err == nil {
+			result.Status, err = app.HealthCheck.Probe(ip, app.Port)
+		}
+		if err != nil {
+			result.Error = err.Error()
+			result.Failures = previous.Failures + 1
+		} else {
+			result.Healthy = true
+		}
+
+		health := app.Health
+		switch {
+		case result.Healthy:
+			health = HealthHealthy
+		case result.Failures >= healthFailureThreshold:
+			health = HealthUnhealthy
+		}
+
+		if _, err := db.Collection("applications").UpdateOne(context.TODO(), bson.M{"_id": app.ID, "containerID": app.ContainerID}, bson.M{"$set": bson.M{
+			"health":       health,
+			"healthResult": result,
+		}}); err != nil {
+			return err
+		}
+
+		if health != app.Health {
+			if _, err := db.Collection("appEvents").InsertOne(context.TODO(), AppEvent{
+				ID:            primitive.NewObjectID(),
+				ApplicationID: app.ID,
+				ContainerID:   app.ContainerID,
+				Action:        "health_status",
+				Status:        app.Status,
+				Health:        health,
+				Time:          result.CheckedAt,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
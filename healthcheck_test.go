@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthCheckValidate(t *testing.T) {
+	check := HealthCheck{Path: "/health"}
+	if err := check.Validate(); err != nil {
+		t.Fatalf("expected a valid health check, got %v", err)
+	}
+	if check.Interval != defaultHealthInterval || check.Timeout != defaultHealthTimeout {
+		t.Errorf("expected the default interval and timeout, got %d and %d", check.Interval, check.Timeout)
+	}
+
+	invalid := []HealthCheck{
+		{Path: "health"},
+		{Path: "/health", ExpectedStatus: 42},
+		{Path: "/health", Interval: 1},
+		{Path: "/health", Interval: 10, Timeout: 20},
+	}
+	for _, check := range invalid {
+		if err := check.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", check)
+		}
+	}
+}
+
+func TestHealthCheckProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			w.WriteHeader(http.StatusOK)
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		case "/moved":
+			http.Redirect(w, r, "/health", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	tests := []struct {
+		name    string
+		check   HealthCheck
+		healthy bool
+	}{
+		{"Any success", HealthCheck{Path: "/health"}, true},
+		{"Redirect", HealthCheck{Path: "/moved"}, true},
+		{"Server error", HealthCheck{Path: "/broken"}, false},
+		{"Expected status", HealthCheck{Path: "/created", ExpectedStatus: http.StatusCreated}, true},
+		{"Unexpected status", HealthCheck{Path: "/health", ExpectedStatus: http.StatusCreated}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.check.Validate()
+			_, err := test.check.Probe(host, port)
+			if test.healthy && err != nil {
+				t.Errorf("expected the application to be healthy, got %v", err)
+			}
+			if !test.healthy && err == nil {
+				t.Errorf("expected the application to be unhealthy")
+			}
+		})
+	}
+}
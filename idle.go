@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// status of an application stopped since it didn't receive requests, it's started again by the next request
+const AppStatusSleeping = "sleeping"
+
+const (
+	//how often the idle applications are searched
+	idleCheckInterval = time.Minute
+	//seconds after which the holding page reloads itself
+	holdingPageRefresh = 3
+)
+
+const holdingPage = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta http-equiv="refresh" content="%d">
+	<title>%s is starting</title>
+	<style>
+		body { font-family: sans-serif; text-align: center; margin-top: 20vh; color: #333; }
+	</style>
+</head>
+<body>
+	<h2>%s is waking up</h2>
+	<p>the application was stopped since nobody used it for a while, the page will reload in a few seconds</p>
+</body>
+</html>`
+
+// serveHoldingPage answers while a sleeping application is being started
+func serveHoldingPage(w http.ResponseWriter, slug string) {
+	name := html.EscapeString(slug)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", fmt.Sprint(holdingPageRefresh))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, holdingPage, holdingPageRefresh, name, name)
+}
+
+// wakeIfSleeping records the request to the application and, if it's sleeping, starts it in background.
+// It returns true if the application can't answer yet
+func (p *Proxy) wakeIfSleeping(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	route, found := p.routes[key]
+	if !found {
+		return false
+	}
+	p.lastRequests[key] = time.Now()
+	if route.status != AppStatusSleeping {
+		return false
+	}
+	if !p.waking[key] {
+		p.waking[key] = true
+		go p.wake(key, route)
+	}
+	return true
+}
+
+// transitionLock returns the lock that serializes the sleep and the wake of an application,
+// so a container is never started while it's being stopped
+func (p *Proxy) transitionLock(key string) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lock, found := p.transitions[key]
+	if !found {
+		lock = new(sync.Mutex)
+		p.transitions[key] = lock
+	}
+	return lock
+}
+
+// setRouteStatus changes the status of the route if its container wasn't replaced in the meantime
+func (p *Proxy) setRouteStatus(key, containerID, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if current, found := p.routes[key]; found && current.containerID == containerID {
+		current.status = status
+		p.routes[key] = current
+	}
+}
+
+// wake starts the container of a sleeping application and waits until it's ready to receive the requests,
+// if the application is being put to sleep it waits for the container to be stopped first
+func (p *Proxy) wake(key string, route proxyRoute) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.waking, key)
+		p.mu.Unlock()
+	}()
+	lock := p.transitionLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	log.Printf("[PROXY] waking up application %s", key)
+
+	if err := p.cc.StartContainer(route.containerID); err != nil {
+		log.Printf("[ERROR] can't start the sleeping application %s: %v", key, err)
+		return
+	}
+	//the event handler sets the application as running on the start event
+	if err := p.cc.WaitUntilHealthy(route.containerID, route.port, deployHealthTimeout, route.healthCheck); err != nil {
+		log.Printf("[ERROR] the application %s is not healthy after waking up: %v", key, err)
+	}
+
+	//the container could have been replaced while it was starting
+	p.setRouteStatus(key, route.containerID, AppStatusRunning)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	//the ip could have changed
+	delete(p.ips, route.containerID)
+	p.lastRequests[key] = time.Now()
+}
+
+// RunIdleReaper periodically stops the running applications that didn't receive requests for the idle timeout
+func (p *Proxy) RunIdleReaper() {
+	if p.idleTimeout <= 0 {
+		return
+	}
+	for range time.Tick(idleCheckInterval) {
+		p.mu.RLock()
+		var idle []string
+		for key, route := range p.routes {
+			if route.status == AppStatusRunning && !p.waking[key] && time.Since(p.lastRequests[key]) > p.idleTimeout {
+				idle = append(idle, key)
+			}
+		}
+		p.mu.RUnlock()
+
+		for _, key := range idle {
+			if err := p.sleep(key); err != nil {
+				log.Printf("[ERROR] can't stop the idle application %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// sleep stops the container of an idle application, the requests that arrive while it's being stopped
+// get the holding page and wake it up again once it's stopped
+func (p *Proxy) sleep(key string) error {
+	lock := p.transitionLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	//a request could have arrived after the application was found idle, the route is set as sleeping
+	//in the same critical section of the check so the next requests wake it up
+	p.mu.Lock()
+	route, found := p.routes[key]
+	if !found || route.status != AppStatusRunning || p.waking[key] || time.Since(p.lastRequests[key]) <= p.idleTimeout {
+		p.mu.Unlock()
+		return nil
+	}
+	route.status = AppStatusSleeping
+	p.routes[key] = route
+	p.mu.Unlock()
+
+	db := p.cc.db
+
+	//the status is set before stopping so the die event isn't taken for a crash,
+	//nothing is done if the application has been stopped or replaced in the meantime
+	res, err := db.Collection("applications").UpdateOne(context.TODO(),
+		bson.M{"_id": route.appID, "containerID": route.containerID, "status": AppStatusRunning},
+		bson.M{"$set": bson.M{"status": AppStatusSleeping}})
+	if err != nil {
+		p.setRouteStatus(key, route.containerID, AppStatusRunning)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		p.setRouteStatus(key, route.containerID, AppStatusRunning)
+		return nil
+	}
+
+	log.Printf("[PROXY] application %s is idle, stopping it", key)
+	stopping := time.Now()
+	if err := p.cc.StopContainer(route.containerID); err != nil {
+		if _, err := db.Collection("applications").UpdateOne(context.TODO(), bson.M{"_id": route.appID}, bson.M{"$set": bson.M{"status": AppStatusRunning}}); err != nil {
+			log.Printf("[ERROR] can't restore the status of application %s: %v", key, err)
+		}
+		p.setRouteStatus(key, route.containerID, AppStatusRunning)
+		return err
+	}
+
+	//the requests arrived during the stop are waiting on the holding page, the wake up starts when the lock is released
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lastRequests[key].After(stopping) && !p.waking[key] {
+		log.Printf("[PROXY] application %s received requests while it was stopped, waking it up", key)
+		p.waking[key] = true
+		go p.wake(key, route)
+	}
+	return nil
+}
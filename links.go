@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DatabaseLink is a database linked to an application, the envs to connect to it
+// are injected in the container of the application when it's created
+type DatabaseLink struct {
+	DatabaseID primitive.ObjectID `bson:"databaseID" json:"-"`
+	//containerID of the database, only set in the responses
+	ContainerID string `bson:"-" json:"containerID,omitempty"`
+	//prefix of the injected envs (PREFIX_DATABASE_URL), needed to link more than one database
+	Prefix string `bson:"prefix,omitempty" json:"prefix,omitempty"`
+}
+
+// LinkPost is the body of a request to link a database to an application
+type LinkPost struct {
+	Database string `json:"database"` //containerID of the database
+	Prefix   string `json:"prefix,omitempty"`
+}
+
+// databaseHostname returns the hostname of a database on the network of its owner
+func databaseHostname(db Application) string {
+	return "db-" + db.ID.Hex()
+}
+
+// engineEnvPrefix returns the prefix of the engine specific envs (MYSQL_HOST, MONGO_HOST...)
+func engineEnvPrefix(engine string) string {
+	if engine == "mongodb" {
+		return "MONGO"
+	}
+	//mariadb uses the same variables as mysql, the clients are compatible
+	return "MYSQL"
+}
+
+// ValidateLink checks the prefix of a new link, the envs of two links can't have the same names
+func ValidateLink(link DatabaseLink, links []DatabaseLink) error {
+	if link.Prefix != "" && !envKeyPattern.MatchString(link.Prefix) {
+		return fmt.Errorf("invalid prefix %s, it can only have letters, numbers and _ and can't start with a number", link.Prefix)
+	}
+	for _, l := range links {
+		if l.DatabaseID == link.DatabaseID {
+			return fmt.Errorf("the database is already linked to the application")
+		}
+		if l.Prefix == link.Prefix {
+			if link.Prefix == "" {
+				return fmt.Errorf("another database is linked without prefix, set a prefix for the envs of this one")
+			}
+			return fmt.Errorf("another database is linked with the prefix %s", link.Prefix)
+		}
+	}
+	return nil
+}
+
+// LinkEnvs returns the envs to connect to the database from the network of its owner: DATABASE_URL and the engine
+// specific ones (MYSQL_HOST, MYSQL_PORT, MYSQL_USER, MYSQL_PASSWORD, MYSQL_DATABASE or the MONGO_ ones).
+// If the prefix is set the names start with PREFIX_
+func LinkEnvs(db Application, prefix string) ([]Env, error) {
+	credentials, err := GetDatabaseCredentials(db, databaseHostname(db), db.Port)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "_"
+	}
+	engine := prefix + engineEnvPrefix(db.Lang)
+	return []Env{
+		{Key: prefix + "DATABASE_URL", Value: credentials.URI, Secret: true},
+		{Key: engine + "_HOST", Value: credentials.Host},
+		{Key: engine + "_PORT", Value: credentials.Port},
+		{Key: engine + "_USER", Value: credentials.User},
+		{Key: engine + "_PASSWORD", Value: credentials.Password, Secret: true},
+		{Key: engine + "_DATABASE", Value: credentials.Database},
+	}, nil
+}
+
+// ContainerEnvs returns the envs of the container of an application: the envs of the linked databases
+// and the ones set by the user, which override the injected ones with the same key
+func (c ContainerController) ContainerEnvs(app Application, conn *mongo.Database) ([]Env, error) {
+	var envs []Env
+	if len(app.Links) > 0 {
+		network, err := c.EnsureStudentNetwork(app.StudentID)
+		if err != nil {
+			return nil, fmt.Errorf("error creating the network of the student: %v", err)
+		}
+		for _, link := range app.Links {
+			var db Application
+			if err := conn.Collection("applications").FindOne(context.TODO(), bson.M{"_id": link.DatabaseID, "type": "database"}).Decode(&db); err != nil {
+				if err == mongo.ErrNoDocuments {
+					continue
+				}
+				return nil, fmt.Errorf("error getting the linked database: %v", err)
+			}
+			//the database could have been created before the network of the student
+			if err := c.ConnectToNetwork(network, db.ContainerID, databaseHostname(db)); err != nil {
+				return nil, fmt.Errorf("error connecting the database to the network of the student: %v", err)
+			}
+			linkEnvs, err := LinkEnvs(db, link.Prefix)
+			if err != nil {
+				return nil, err
+			}
+			envs = append(envs, linkEnvs...)
+		}
+	}
+	return SetEnvs(envs, app.Envs), nil
+}
+
+// updateLinkedApplications queues an envs job for each application linked to the database,
+// so their containers are recreated with the new credentials
+func (h Handler) updateLinkedApplications(databaseID primitive.ObjectID, conn *mongo.Database) {
+	cur, err := conn.Collection("applications").Find(context.TODO(), bson.M{"links.databaseID": databaseID})
+	if err != nil {
+		log.Printf("[ERROR] can't get the applications linked to database %s: %v", databaseID.Hex(), err)
+		return
+	}
+	var apps []Application
+	if err := cur.All(context.TODO(), &apps); err != nil {
+		log.Printf("[ERROR] can't get the applications linked to database %s: %v", databaseID.Hex(), err)
+		return
+	}
+
+	for _, app := range apps {
+		//only one job at a time can replace the container
+		if updating, err := hasRunningJob(app.ID, conn); err != nil || updating {
+			log.Printf("[ERROR] can't update the linked application %s while it's being updated, it could have the old credentials", app.ID.Hex())
+			continue
+		}
+		if _, err := h.NewEnvsJob(app.StudentID, app.ID, app.Envs, nil); err != nil {
+			log.Printf("[ERROR] can't queue the update of the linked application %s: %v", app.ID.Hex(), err)
+		}
+	}
+}
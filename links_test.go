@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidateLink(t *testing.T) {
+	first := primitive.NewObjectID()
+	links := []DatabaseLink{{DatabaseID: first}}
+
+	tests := []struct {
+		name    string
+		link    DatabaseLink
+		wantErr bool
+	}{
+		{"with prefix", DatabaseLink{DatabaseID: primitive.NewObjectID(), Prefix: "CACHE"}, false},
+		{"already linked", DatabaseLink{DatabaseID: first, Prefix: "OTHER"}, true},
+		{"same prefix", DatabaseLink{DatabaseID: primitive.NewObjectID()}, true},
+		{"invalid prefix", DatabaseLink{DatabaseID: primitive.NewObjectID(), Prefix: "1-DB"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateLink(tt.link, links); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateLink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLinkEnvs(t *testing.T) {
+	db := Application{
+		ID:   primitive.NewObjectID(),
+		Lang: "mysql",
+		Port: "3306",
+		Envs: []Env{
+			{Key: "MYSQL_ROOT_PASSWORD", Value: "pass", Secret: true},
+			{Key: "MYSQL_DATABASE", Value: "shop"},
+		},
+	}
+	host := databaseHostname(db)
+
+	envs, err := LinkEnvs(db, "SHOP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]Env)
+	for _, env := range envs {
+		values[env.Key] = env
+	}
+	if url := values["SHOP_DATABASE_URL"]; url.Value != "mysql://root:pass@"+host+":3306/shop" || !url.Secret {
+		t.Errorf("SHOP_DATABASE_URL = %+v", url)
+	}
+	if values["SHOP_MYSQL_HOST"].Value != host || values["SHOP_MYSQL_PORT"].Value != "3306" {
+		t.Errorf("wrong host or port: %+v", envs)
+	}
+	if password := values["SHOP_MYSQL_PASSWORD"]; password.Value != "pass" || !password.Secret {
+		t.Errorf("SHOP_MYSQL_PASSWORD = %+v", password)
+	}
+
+	//the databases created before the credentials were saved can't be linked
+	if _, err := LinkEnvs(Application{ID: primitive.NewObjectID(), Lang: "mongodb"}, ""); err == nil {
+		t.Errorf("LinkEnvs() without credentials didn't fail")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// default number of lines returned by the logs api
+const defaultLogsTail = "100"
+
+// LogsOptions are the filters of the logs of a container
+type LogsOptions struct {
+	Tail   string //number of lines from the end or "all"
+	Since  string //timestamp (rfc3339 or unix) or duration relative to now (10m)
+	Stdout bool
+	Stderr bool
+	Follow bool
+}
+
+// LogLine is a line written by a container
+type LogLine struct {
+	Stream string    `json:"stream"` //stdout or stderr
+	Time   time.Time `json:"time"`
+	Text   string    `json:"text"`
+}
+
+// ParseLogsOptions reads the options from the query of a request (tail, since, stream and follow)
+func ParseLogsOptions(tail, since, stream, follow string) (LogsOptions, error) {
+	opts := LogsOptions{Tail: defaultLogsTail, Since: since}
+
+	if tail != "" {
+		if n, err := strconv.Atoi(tail); tail != "all" && (err != nil || n < 0) {
+			return LogsOptions{}, fmt.Errorf("tail must be a positive number or all")
+		}
+		opts.Tail = tail
+	}
+
+	switch stream {
+	case "":
+		opts.Stdout, opts.Stderr = true, true
+	case "stdout":
+		opts.Stdout = true
+	case "stderr":
+		opts.Stderr = true
+	default:
+		return LogsOptions{}, fmt.Errorf("stream must be stdout or stderr")
+	}
+
+	if follow != "" {
+		value, err := strconv.ParseBool(follow)
+		if err != nil {
+			return LogsOptions{}, fmt.Errorf("follow must be true or false")
+		}
+		opts.Follow = value
+	}
+	return opts, nil
+}
+
+// logLineWriter splits what is written in lines and sends them to emit,
+// the docker timestamp at the start of each line is parsed
+type logLineWriter struct {
+	stream  string
+	emit    func(LogLine) error
+	partial []byte
+}
+
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(w.partial[:i])
+		w.partial = w.partial[i+1:]
+		if err := w.emit(parseLogLine(w.stream, line)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// flush sends the last line if it didn't end with a new line
+func (w *logLineWriter) flush() error {
+	if len(w.partial) == 0 {
+		return nil
+	}
+	line := string(w.partial)
+	w.partial = nil
+	return w.emit(parseLogLine(w.stream, line))
+}
+
+func parseLogLine(stream, line string) LogLine {
+	logLine := LogLine{Stream: stream, Text: strings.TrimSuffix(line, "\r")}
+	if i := strings.IndexByte(line, ' '); i > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, line[:i]); err == nil {
+			logLine.Time = t
+			logLine.Text = strings.TrimSuffix(line[i+1:], "\r")
+		}
+	}
+	return logLine
+}
+
+// StreamContainerLogs sends the logs of a container to emit one line at a time, stdout and stderr are demultiplexed.
+// In follow mode it returns when the container stops or ctx is canceled
+func (c ContainerController) StreamContainerLogs(ctx context.Context, containerID string, opts LogsOptions, emit func(LogLine) error) error {
+	container, err := c.cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return err
+	}
+
+	reader, err := c.cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+		ShowStdout: opts.Stdout,
+		ShowStderr: opts.Stderr,
+		Since:      opts.Since,
+		Tail:       opts.Tail,
+		Follow:     opts.Follow,
+		Timestamps: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	stdout := &logLineWriter{stream: "stdout", emit: emit}
+	stderr := &logLineWriter{stream: "stderr", emit: emit}
+	//the containers with a tty have a single raw stream
+	if container.Config.Tty {
+		_, err = io.Copy(stdout, reader)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, reader)
+	}
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+	if err := stdout.flush(); err != nil {
+		return err
+	}
+	return stderr.flush()
+}
+
+// GetContainerLogs returns the lines of the logs of a container (without following them)
+func (c ContainerController) GetContainerLogs(containerID string, opts LogsOptions) ([]LogLine, error) {
+	opts.Follow = false
+	lines := []LogLine{}
+	err := c.StreamContainerLogs(c.ctx, containerID, opts, func(line LogLine) error {
+		lines = append(lines, line)
+		return nil
+	})
+	return lines, err
+}
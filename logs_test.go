@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+func TestParseLogsOptions(t *testing.T) {
+	opts, err := ParseLogsOptions("", "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.Tail != defaultLogsTail || !opts.Stdout || !opts.Stderr || opts.Follow {
+		t.Errorf("unexpected default options: %+v", opts)
+	}
+
+	opts, err = ParseLogsOptions("all", "10m", "stderr", "true")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.Tail != "all" || opts.Since != "10m" || opts.Stdout || !opts.Stderr || !opts.Follow {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+
+	invalid := [][4]string{
+		{"-1", "", "", ""},
+		{"many", "", "", ""},
+		{"", "", "both", ""},
+		{"", "", "", "yes please"},
+	}
+	for _, query := range invalid {
+		if _, err := ParseLogsOptions(query[0], query[1], query[2], query[3]); err == nil {
+			t.Errorf("expected an error for %v", query)
+		}
+	}
+}
+
+func TestLogLineWriterDemux(t *testing.T) {
+	//multiplexed stream like the one returned by docker, the lines are split between frames
+	var stream bytes.Buffer
+	stdout := stdcopy.NewStdWriter(&stream, stdcopy.Stdout)
+	stderr := stdcopy.NewStdWriter(&stream, stdcopy.Stderr)
+	stdout.Write([]byte("2022-10-01T10:00:00.000000001Z listening on 8080\n2022-10-01T10:00:01Z first "))
+	stdout.Write([]byte("request\n"))
+	stderr.Write([]byte("2022-10-01T10:00:02Z something went wrong\r\n"))
+	stdout.Write([]byte("no timestamp"))
+
+	var lines []LogLine
+	emit := func(line LogLine) error {
+		lines = append(lines, line)
+		return nil
+	}
+	outWriter := &logLineWriter{stream: "stdout", emit: emit}
+	errWriter := &logLineWriter{stream: "stderr", emit: emit}
+	if _, err := stdcopy.StdCopy(outWriter, errWriter, &stream); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	outWriter.flush()
+	errWriter.flush()
+
+	expected := []LogLine{
+		{Stream: "stdout", Time: time.Date(2022, 10, 1, 10, 0, 0, 1, time.UTC), Text: "listening on 8080"},
+		{Stream: "stdout", Time: time.Date(2022, 10, 1, 10, 0, 1, 0, time.UTC), Text: "first request"},
+		{Stream: "stderr", Time: time.Date(2022, 10, 1, 10, 0, 2, 0, time.UTC), Text: "something went wrong"},
+		{Stream: "stdout", Text: "no timestamp"},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d: %+v", len(expected), len(lines), lines)
+	}
+	for i, line := range lines {
+		if line.Stream != expected[i].Stream || line.Text != expected[i].Text || !line.Time.Equal(expected[i].Time) {
+			t.Errorf("line %d: expected %+v, got %+v", i, expected[i], line)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -28,25 +30,51 @@ import (
 *public api endpoints:
 /api/oauth -> oauth endpoint (generate the oauth url)
 /api/tokens/new -> get a new token pair from a refresh token
+/api/logout -> delete the token cookies
 /api/{studentID}/all -> get all the public applications of a student
 /api/{studentID}/{appID} -> get the info of a public application
 
 *user api endpoints:
 /api/user/ -> get the info of the user
 /api/user/getApps/{type} -> get all the applications of a user (private or public) with the type of application (database, web, all, updatable)
+/api/user/quota -> get the quota of the user and how much of it is used
 
 *container api endpoints:
 /api/container/delete/{containerID} -> delete a container
 /api/container/publish/{containerID} -> publish a container
 /api/container/revoke/{containerID} -> revoke a container
+/api/container/start/{containerID} -> start a stopped container (application or database)
+/api/container/stop/{containerID} -> stop a container
+/api/container/restart/{containerID} -> restart a container
 
 *api endpoints for database:
-/api/db/new -> create a new database
+/api/db/new -> create a new database (private unless public is set, then its port is published on the host)
+/api/db/{containerID}/credentials -> get the root credentials of a database
+/api/db/{containerID}/credentials/rotate -> generate a new root password for a database
 ! not implemented /api/db/export/{containerID}/{dbName} -> export a database
 
 *api endpoints for applications:
-/api/app/new -> create a new application
-/api/app/update/{containerID} -> update an application if the repo is changed
+/api/app/new -> queue the deploy of a new application
+/api/app/runtimes -> get the supported runtimes (languages)
+/api/app/jobs/{jobID} -> get the phase of a deploy job
+/api/app/jobs/{jobID}/logs -> get the build log of a deploy job
+/api/app/jobs/{jobID}/logs/stream -> stream the build log of a deploy job (server sent events)
+/api/app/update/{containerID} -> queue a blue/green update of an application if the repo is changed
+/api/app/{containerID}/releases -> get the releases of an application
+/api/app/{applicationID}/rollback/{releaseID} -> queue the rollback of an application to a previous release (the id of the application, it doesn't change with the deploys)
+/api/app/{containerID}/envs -> get (GET), set (PUT) or remove (DELETE ?key=) the envs of an application, the changes recreate its container
+/api/app/{containerID}/links -> get (GET), add (POST) or remove (DELETE ?database=) the databases linked to an application, their connection envs are injected in its container
+/api/app/{containerID}/logs -> get the logs of the container of an application (or database), follow=true streams them (server sent events)
+/api/app/{containerID}/metrics -> get the cpu, memory, network and disk usage of an application (or database) over time
+/api/app/{containerID}/exec/ticket -> get a one time ticket to open a terminal
+/api/app/{containerID}/exec?ticket= -> open a terminal in the container of an application (or database) over a websocket
+/api/app/{containerID}/events -> get the timeline of the container events of an application (or database)
+/api/app/{containerID}/restart-policy -> change the restart policy of an application
+/api/app/{containerID}/health-check -> set (PUT) or remove (DELETE) the health check of an application
+/api/app/{containerID}/domains -> get (GET) or attach (POST) the custom domains of an application
+/api/app/{containerID}/domains/{domainID} -> detach a custom domain
+/api/app/{containerID}/domains/{domainID}/verify -> check the txt record with the token of a custom domain
+/api/app/{containerID}/domains/{domainID}/certificate -> upload the certificate and key of a custom domain
 */
 
 func main() {
@@ -78,6 +106,7 @@ func main() {
 	api.HandleFunc("/oauth", handler.OauthHandler).Methods("GET")
 	api.HandleFunc("/oauth/check/{randomID}", handler.CheckOauthState).Methods("GET")
 	api.HandleFunc("/tokens/new", handler.NewTokenPairFromRefreshTokenHandler).Methods("GET")
+	api.HandleFunc("/logout", handler.LogoutHandler).Methods("POST")
 	api.HandleFunc("/{studentID}/all", handler.GetAllApplicationsOfStudentPublic).Methods("GET")
 	// api.HandleFunc("/{studentID}/{appID}", handler.GetInfoApplication).Methods("GET")
 
@@ -91,6 +120,8 @@ func main() {
 	userApiRouter.HandleFunc("/validate", handler.ValidGithubUrlAndGetBranchesHandler).Methods("POST")
 	//get all the applications (even the private one) must define the type (database, web, all)
 	userApiRouter.HandleFunc("/getApps/{type}", handler.GetAllApplicationsOfStudentPrivate).Methods("GET")
+	//get the quota of the user and its usage
+	userApiRouter.HandleFunc("/quota", handler.GetQuotaHandler).Methods("GET")
 	//update an application
 	userApiRouter.HandleFunc("/application/update/{containerID}", handler.UpdateApplicationHandler).Methods("GET")
 
@@ -103,6 +134,10 @@ func main() {
 	containerApiRouter.HandleFunc("/publish/{containerID}", handler.PublishApplicationHandler).Methods("GET")
 	//revoke a container
 	containerApiRouter.HandleFunc("/revoke/{containerID}", handler.RevokeApplicationHandler).Methods("GET")
+	//start, stop and restart a container
+	containerApiRouter.HandleFunc("/start/{containerID}", handler.StartContainerHandler).Methods("POST")
+	containerApiRouter.HandleFunc("/stop/{containerID}", handler.StopContainerHandler).Methods("POST")
+	containerApiRouter.HandleFunc("/restart/{containerID}", handler.RestartContainerHandler).Methods("POST")
 
 	//! DBaaS HANDLERS
 	//DBaaS router (subrouter of user area router so it has access token middleware)
@@ -110,6 +145,9 @@ func main() {
 	dbApiRouter.Use(handler.TokensMiddleware)
 	//let the user create a new database
 	dbApiRouter.HandleFunc("/new", handler.NewDBHandler).Methods("POST")
+	//read or rotate the credentials of a database
+	dbApiRouter.HandleFunc("/{containerID}/credentials", handler.GetDBCredentialsHandler).Methods("GET")
+	dbApiRouter.HandleFunc("/{containerID}/credentials/rotate", handler.RotateDBCredentialsHandler).Methods("POST")
 	//export a database
 	//dbApiRouter.HandleFunc("/export/{containerID}/{dbName}")
 
@@ -118,16 +156,53 @@ func main() {
 	appApiRouter := api.PathPrefix("/app").Subrouter()
 	appApiRouter.Use(handler.TokensMiddleware)
 	appApiRouter.HandleFunc("/new", handler.NewApplicationHandler).Methods("POST")
+	appApiRouter.HandleFunc("/runtimes", handler.GetRuntimesHandler).Methods("GET")
 	appApiRouter.HandleFunc("/update/{containerID}", handler.UpdateApplicationHandler).Methods("POST")
+	appApiRouter.HandleFunc("/jobs/{jobID}", handler.GetDeployJobHandler).Methods("GET")
+	appApiRouter.HandleFunc("/jobs/{jobID}/logs", handler.GetDeployJobLogsHandler).Methods("GET")
+	appApiRouter.HandleFunc("/jobs/{jobID}/logs/stream", handler.StreamDeployJobLogsHandler).Methods("GET")
+	appApiRouter.HandleFunc("/{containerID}/releases", handler.GetReleasesHandler).Methods("GET")
+	appApiRouter.HandleFunc("/{applicationID}/rollback/{releaseID}", handler.RollbackApplicationHandler).Methods("POST")
+	appApiRouter.HandleFunc("/{containerID}/envs", handler.EnvsHandler).Methods("GET", "PUT", "DELETE")
+	appApiRouter.HandleFunc("/{containerID}/links", handler.LinksHandler).Methods("GET", "POST", "DELETE")
+	appApiRouter.HandleFunc("/{containerID}/logs", handler.GetContainerLogsHandler).Methods("GET")
+	appApiRouter.HandleFunc("/{containerID}/metrics", handler.GetMetricsHandler).Methods("GET")
+	appApiRouter.HandleFunc("/{containerID}/exec/ticket", handler.ExecTicketHandler).Methods("POST")
+	appApiRouter.HandleFunc("/{containerID}/exec", handler.ExecHandler).Methods("GET")
+	appApiRouter.HandleFunc("/{containerID}/events", handler.GetAppEventsHandler).Methods("GET")
+	appApiRouter.HandleFunc("/{containerID}/restart-policy", handler.UpdateRestartPolicyHandler).Methods("PUT")
+	appApiRouter.HandleFunc("/{containerID}/health-check", handler.UpdateHealthCheckHandler).Methods("PUT", "DELETE")
+	appApiRouter.HandleFunc("/{containerID}/domains", handler.GetDomainsHandler).Methods("GET")
+	appApiRouter.HandleFunc("/{containerID}/domains", handler.AddDomainHandler).Methods("POST")
+	appApiRouter.HandleFunc("/{containerID}/domains/{domainID}", handler.DeleteDomainHandler).Methods("DELETE")
+	appApiRouter.HandleFunc("/{containerID}/domains/{domainID}/verify", handler.VerifyDomainHandler).Methods("POST")
+	appApiRouter.HandleFunc("/{containerID}/domains/{domainID}/certificate", handler.UploadDomainCertificateHandler).Methods("PUT")
 
 	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With"})
 	originsOk := handlers.AllowedOrigins([]string{"*"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "POST"})
+	methodsOk := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE"})
 
 	//start event handler
 	log.Println("starting event handler")
 	go handler.cc.EventHandler()
 
+	//start the proxy of the applications
+	log.Println("starting the applications proxy")
+	go handler.proxy.Run()
+	go handler.proxy.RunIdleReaper()
+
+	//start the prober of the health checks
+	log.Println("starting health prober")
+	go handler.cc.HealthProber()
+
+	//start the collector of the containers metrics
+	log.Println("starting metrics collector")
+	go handler.metrics.Run()
+
+	//start the deploy workers
+	log.Println("starting deploy workers")
+	handler.StartDeployWorkers()
+
 	go RunExecutor(
 		oauthStateCleaningInterval,
 		refreshTokenCleaningInterval,
@@ -138,6 +213,21 @@ func main() {
 
 	go CheckExpiries(executeCleaning)
 
+	server := handler.proxy.Middleware(handlers.CORS(originsOk, headersOk, methodsOk)(mainRouter))
+
+	//the custom domains with a certificate are served with tls, the certificate is chosen with sni
+	if tlsAddr := os.Getenv("PROXY_TLS_ADDR"); tlsAddr != "" {
+		log.Println("starting the tls server on " + tlsAddr)
+		tlsServer := &http.Server{
+			Addr:      tlsAddr,
+			Handler:   server,
+			TLSConfig: &tls.Config{GetCertificate: handler.proxy.GetCertificate},
+		}
+		go func() {
+			log.Fatal(tlsServer.ListenAndServeTLS("", ""))
+		}()
+	}
+
 	log.Println("starting the server on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", handlers.CORS(originsOk, headersOk, methodsOk)(mainRouter)))
+	log.Fatal(http.ListenAndServe(":8080", server))
 }
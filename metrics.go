@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the samples are averaged in points of a minute, after metricsMinuteRetention the minute points
+// are merged in points of an hour that are kept for the retention of the collector
+const (
+	metricsMinute          = 60 //seconds
+	metricsMinuteRetention = 24 * time.Hour
+	//how often the minute points are merged and the old points removed
+	metricsCompactInterval = time.Hour
+	//max number of containers sampled at the same time
+	metricsConcurrentSamples = 8
+	//max number of points returned by the api
+	maxMetricsPoints = 1000
+	//number of points returned by the api if the step is not set
+	defaultMetricsPoints = 300
+)
+
+// default values of METRICS_INTERVAL and METRICS_RETENTION
+const (
+	defaultMetricsInterval  = 15 * time.Second
+	defaultMetricsRetention = 7 * 24 * time.Hour
+)
+
+// MetricsPoint is the usage of the container of an application in a period of time,
+// cpu and memory are averages, the network and disk io are the bytes of the whole period
+type MetricsPoint struct {
+	ID            primitive.ObjectID `bson:"_id" json:"-"`
+	ApplicationID primitive.ObjectID `bson:"applicationID" json:"-"`
+	Time          time.Time          `bson:"time" json:"time"`               //start of the period
+	Resolution    int                `bson:"resolution" json:"-"`            //seconds covered by the point
+	Samples       int                `bson:"samples" json:"-"`               //samples averaged in the point
+	CPU           float64            `bson:"cpu" json:"cpu"`                 //percentage of a cpu (200 is two full cpus)
+	Memory        uint64             `bson:"memory" json:"memory"`           //bytes
+	MemoryLimit   uint64             `bson:"memoryLimit" json:"memoryLimit"` //bytes
+	NetRx         uint64             `bson:"netRx" json:"netRx"`
+	NetTx         uint64             `bson:"netTx" json:"netTx"`
+	BlockRead     uint64             `bson:"blockRead" json:"blockRead"`
+	BlockWrite    uint64             `bson:"blockWrite" json:"blockWrite"`
+}
+
+// containerCounters are the cumulative counters of a container, the points store their difference
+type containerCounters struct {
+	netRx, netTx, blockRead, blockWrite uint64
+}
+
+// MetricsCollector periodically samples the stats of the running containers of the applications and databases
+type MetricsCollector struct {
+	cc        *ContainerController
+	interval  time.Duration
+	retention time.Duration
+
+	mu       sync.Mutex
+	counters map[string]containerCounters         //containerID -> counters of the last sample
+	pending  map[primitive.ObjectID]*MetricsPoint //applicationID -> minute point being filled
+	complete []MetricsPoint                       //minute points to save
+}
+
+// NewMetricsCollector creates a collector, the non positive values fallback to the defaults
+func NewMetricsCollector(cc *ContainerController, interval, retention time.Duration) *MetricsCollector {
+	if interval <= 0 {
+		interval = defaultMetricsInterval
+	}
+	if retention <= 0 {
+		retention = defaultMetricsRetention
+	}
+	return &MetricsCollector{
+		cc:        cc,
+		interval:  interval,
+		retention: retention,
+		counters:  make(map[string]containerCounters),
+		pending:   make(map[primitive.ObjectID]*MetricsPoint),
+	}
+}
+
+// Run samples the containers every interval and compacts the saved points every metricsCompactInterval
+func (m *MetricsCollector) Run() {
+	lastCompact := time.Time{}
+	for range time.Tick(m.interval) {
+		if err := m.collect(); err != nil {
+			log.Printf("[ERROR] Error collecting the metrics: %v", err)
+		}
+		if time.Since(lastCompact) >= metricsCompactInterval {
+			if err := m.compact(); err != nil {
+				log.Printf("[ERROR] Error compacting the metrics: %v", err)
+			}
+			lastCompact = time.Now()
+		}
+	}
+}
+
+// collect samples the running containers and saves the minute points that are complete
+func (m *MetricsCollector) collect() error {
+	db := m.cc.db
+
+	cur, err := db.Collection("applications").Find(context.TODO(), bson.M{"status": AppStatusRunning})
+	if err != nil {
+		return err
+	}
+	var apps []Application
+	if err := cur.All(context.TODO(), &apps); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, metricsConcurrentSamples)
+	for _, app := range apps {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(app Application) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := m.sample(app); err != nil {
+				log.Printf("[ERROR] can't sample the container %s: %v", app.ContainerID, err)
+			}
+		}(app)
+	}
+	wg.Wait()
+
+	//the minute points of the past minutes won't get other samples
+	minute := time.Now().Truncate(time.Minute)
+	m.mu.Lock()
+	for appID, point := range m.pending {
+		if point.Time.Before(minute) {
+			m.complete = append(m.complete, *point)
+			delete(m.pending, appID)
+		}
+	}
+	var complete []interface{}
+	for _, point := range m.complete {
+		complete = append(complete, point)
+	}
+	m.complete = nil
+	//the counters of the removed containers are forgotten
+	running := make(map[string]bool)
+	for _, app := range apps {
+		running[app.ContainerID] = true
+	}
+	for id := range m.counters {
+		if !running[id] {
+			delete(m.counters, id)
+		}
+	}
+	m.mu.Unlock()
+
+	if len(complete) == 0 {
+		return nil
+	}
+	_, err = db.Collection("metrics").InsertMany(context.TODO(), complete)
+	return err
+}
+
+// sample reads the stats of the container of an application and adds them to its minute point
+func (m *MetricsCollector) sample(app Application) error {
+	//without streaming docker waits for two reads so the cpu usage can be calculated
+	stats, err := m.cc.cli.ContainerStats(m.cc.ctx, app.ContainerID, false)
+	if err != nil {
+		return err
+	}
+	defer stats.Body.Close()
+	var s types.StatsJSON
+	if err := json.NewDecoder(stats.Body).Decode(&s); err != nil {
+		return err
+	}
+
+	counters := statsCounters(s)
+	now := time.Now()
+	sample := MetricsPoint{
+		ApplicationID: app.ID,
+		Time:          now.Truncate(time.Minute),
+		Resolution:    metricsMinute,
+		Samples:       1,
+		CPU:           cpuPercent(s),
+		Memory:        memoryUsage(s),
+		MemoryLimit:   s.MemoryStats.Limit,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	//the first sample of a container has nothing to compare the counters with
+	if previous, found := m.counters[app.ContainerID]; found {
+		sample.NetRx = counterDelta(previous.netRx, counters.netRx)
+		sample.NetTx = counterDelta(previous.netTx, counters.netTx)
+		sample.BlockRead = counterDelta(previous.blockRead, counters.blockRead)
+		sample.BlockWrite = counterDelta(previous.blockWrite, counters.blockWrite)
+	}
+	m.counters[app.ContainerID] = counters
+
+	point, found := m.pending[app.ID]
+	if !found || !point.Time.Equal(sample.Time) {
+		//the point of the previous minute is complete
+		if found {
+			m.complete = append(m.complete, *point)
+		}
+		sample.ID = primitive.NewObjectID()
+		m.pending[app.ID] = &sample
+		return nil
+	}
+	*point = mergeMetricsPoints(point.Time, metricsMinute, []MetricsPoint{*point, sample})
+	return nil
+}
+
+// cpuPercent calculates the cpu usage from the difference with the previous read (like docker stats)
+func cpuPercent(s types.StatsJSON) float64 {
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+	cpus := float64(s.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(s.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+	return cpuDelta / systemDelta * cpus * 100
+}
+
+// memoryUsage returns the memory used without the page cache (like docker stats)
+func memoryUsage(s types.StatsJSON) uint64 {
+	cache := s.MemoryStats.Stats["total_inactive_file"] //cgroup v1
+	if v, found := s.MemoryStats.Stats["inactive_file"]; found && cache == 0 {
+		cache = v //cgroup v2
+	}
+	if cache > s.MemoryStats.Usage {
+		return 0
+	}
+	return s.MemoryStats.Usage - cache
+}
+
+// statsCounters sums the network and disk io of all the interfaces and devices
+func statsCounters(s types.StatsJSON) containerCounters {
+	var counters containerCounters
+	for _, network := range s.Networks {
+		counters.netRx += network.RxBytes
+		counters.netTx += network.TxBytes
+	}
+	for _, entry := range s.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			counters.blockRead += entry.Value
+		case "write":
+			counters.blockWrite += entry.Value
+		}
+	}
+	return counters
+}
+
+// counterDelta returns the increase of a counter, the counters restart from 0 when the container is restarted
+func counterDelta(previous, current uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+// mergeMetricsPoints merges the points in one that starts at t and covers resolution seconds,
+// cpu and memory are averaged on the samples of the points, the io is summed
+func mergeMetricsPoints(t time.Time, resolution int, points []MetricsPoint) MetricsPoint {
+	merged := MetricsPoint{
+		ID:         primitive.NewObjectID(),
+		Time:       t,
+		Resolution: resolution,
+	}
+	if len(points) == 0 {
+		return merged
+	}
+	merged.ApplicationID = points[0].ApplicationID
+
+	var cpu, memory float64
+	for _, point := range points {
+		merged.Samples += point.Samples
+		cpu += point.CPU * float64(point.Samples)
+		memory += float64(point.Memory) * float64(point.Samples)
+		if point.MemoryLimit > merged.MemoryLimit {
+			merged.MemoryLimit = point.MemoryLimit
+		}
+		merged.NetRx += point.NetRx
+		merged.NetTx += point.NetTx
+		merged.BlockRead += point.BlockRead
+		merged.BlockWrite += point.BlockWrite
+	}
+	if merged.Samples > 0 {
+		merged.CPU = cpu / float64(merged.Samples)
+		merged.Memory = uint64(memory / float64(merged.Samples))
+	}
+	return merged
+}
+
+// DownsampleMetrics groups the points in steps starting from from, the points must be sorted by time
+func DownsampleMetrics(points []MetricsPoint, from time.Time, step time.Duration) []MetricsPoint {
+	downsampled := []MetricsPoint{}
+	var bucket []MetricsPoint
+	var bucketTime time.Time
+	for _, point := range points {
+		t := from.Add(point.Time.Sub(from) / step * step)
+		if len(bucket) > 0 && !t.Equal(bucketTime) {
+			downsampled = append(downsampled, mergeMetricsPoints(bucketTime, int(step/time.Second), bucket))
+			bucket = nil
+		}
+		bucketTime = t
+		bucket = append(bucket, point)
+	}
+	if len(bucket) > 0 {
+		downsampled = append(downsampled, mergeMetricsPoints(bucketTime, int(step/time.Second), bucket))
+	}
+	return downsampled
+}
+
+// compact merges the minute points older than metricsMinuteRetention in hour points
+// and removes the points older than the retention
+func (m *MetricsCollector) compact() error {
+	db := m.cc.db
+	metrics := db.Collection("metrics")
+
+	cutoff := time.Now().Add(-metricsMinuteRetention).Truncate(time.Hour)
+	cur, err := metrics.Find(context.TODO(), bson.M{"resolution": metricsMinute, "time": bson.M{"$lt": cutoff}},
+		options.Find().SetSort(bson.M{"time": 1}))
+	if err != nil {
+		return err
+	}
+	var minutes []MetricsPoint
+	if err := cur.All(context.TODO(), &minutes); err != nil {
+		return err
+	}
+
+	byApp := make(map[primitive.ObjectID][]MetricsPoint)
+	for _, point := range minutes {
+		byApp[point.ApplicationID] = append(byApp[point.ApplicationID], point)
+	}
+	for _, points := range byApp {
+		//the hour points are upserted and only the merged minute points are removed, so if a compaction fails
+		//halfway the next one merges the same points again without counting them twice
+		var writes []mongo.WriteModel
+		for _, hour := range DownsampleMetrics(points, points[0].Time.Truncate(time.Hour), time.Hour) {
+			writes = append(writes, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"applicationID": hour.ApplicationID, "resolution": hour.Resolution, "time": hour.Time}).
+				SetUpdate(bson.M{"$set": bson.M{
+					"samples":     hour.Samples,
+					"cpu":         hour.CPU,
+					"memory":      hour.Memory,
+					"memoryLimit": hour.MemoryLimit,
+					"netRx":       hour.NetRx,
+					"netTx":       hour.NetTx,
+					"blockRead":   hour.BlockRead,
+					"blockWrite":  hour.BlockWrite,
+				}}).
+				SetUpsert(true))
+		}
+		if _, err := metrics.BulkWrite(context.TODO(), writes); err != nil {
+			return err
+		}
+
+		ids := make([]primitive.ObjectID, len(points))
+		for i, point := range points {
+			ids[i] = point.ID
+		}
+		if _, err := metrics.DeleteMany(context.TODO(), bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+			return err
+		}
+	}
+
+	_, err = metrics.DeleteMany(context.TODO(), bson.M{"time": bson.M{"$lt": time.Now().Add(-m.retention)}})
+	return err
+}
+
+// parseMetricsTime reads a time of the metrics api, it can be rfc3339 or a unix timestamp (seconds)
+func parseMetricsTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// ParseMetricsRange reads the range of the metrics api: from and to (default the last hour)
+// and step (a duration like 5m or seconds, by default the range is divided in defaultMetricsPoints)
+func ParseMetricsRange(fromQuery, toQuery, stepQuery string, now time.Time) (time.Time, time.Time, time.Duration, error) {
+	to := now
+	if toQuery != "" {
+		t, err := parseMetricsTime(toQuery)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid to, must be rfc3339 or a unix timestamp")
+		}
+		to = t
+	}
+	from := to.Add(-time.Hour)
+	if fromQuery != "" {
+		t, err := parseMetricsTime(fromQuery)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid from, must be rfc3339 or a unix timestamp")
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("from must be before to")
+	}
+
+	var step time.Duration
+	if stepQuery == "" {
+		step = (to.Sub(from) / defaultMetricsPoints).Truncate(time.Minute) + time.Minute
+	} else if seconds, err := strconv.Atoi(stepQuery); err == nil {
+		step = time.Duration(seconds) * time.Second
+	} else if step, err = time.ParseDuration(stepQuery); err != nil {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid step, must be a duration or a number of seconds")
+	}
+	if step < time.Minute {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("the step must be at least a minute")
+	}
+	if to.Sub(from)/step > maxMetricsPoints {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("too many points, the step must be at least %v", (to.Sub(from) / maxMetricsPoints).Round(time.Second))
+	}
+	return from, to, step, nil
+}
+
+// GetMetrics returns the points of an application between from and to grouped in steps
+func GetMetrics(applicationID primitive.ObjectID, from, to time.Time, step time.Duration, db *mongo.Database) ([]MetricsPoint, error) {
+	cur, err := db.Collection("metrics").Find(context.TODO(), bson.M{
+		"applicationID": applicationID,
+		"time":          bson.M{"$gte": from, "$lt": to},
+	}, options.Find().SetSort(bson.M{"time": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var points []MetricsPoint
+	if err := cur.All(context.TODO(), &points); err != nil {
+		return nil, err
+	}
+	return DownsampleMetrics(points, from, step), nil
+}
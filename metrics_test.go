@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestCPUPercent(t *testing.T) {
+	var s types.StatsJSON
+	s.PreCPUStats.CPUUsage.TotalUsage = 1000
+	s.PreCPUStats.SystemUsage = 10000
+	s.CPUStats.CPUUsage.TotalUsage = 1500
+	s.CPUStats.SystemUsage = 12000
+	s.CPUStats.OnlineCPUs = 4
+
+	//500 of 2000 on 4 cpus is one full cpu
+	if cpu := cpuPercent(s); math.Abs(cpu-100) > 0.001 {
+		t.Errorf("expected 100%%, got %v", cpu)
+	}
+
+	//the first read has no previous one
+	s.PreCPUStats = types.CPUStats{}
+	s.CPUStats.SystemUsage = 0
+	if cpu := cpuPercent(s); cpu != 0 {
+		t.Errorf("expected 0%%, got %v", cpu)
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	if delta := counterDelta(100, 150); delta != 50 {
+		t.Errorf("expected 50, got %d", delta)
+	}
+	//the container restarted
+	if delta := counterDelta(100, 30); delta != 30 {
+		t.Errorf("expected 30, got %d", delta)
+	}
+}
+
+func TestDownsampleMetrics(t *testing.T) {
+	from := time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)
+	points := []MetricsPoint{
+		{Time: from, Samples: 4, CPU: 10, Memory: 100, MemoryLimit: 1000, NetRx: 5},
+		{Time: from.Add(time.Minute), Samples: 4, CPU: 30, Memory: 300, MemoryLimit: 1000, NetRx: 10},
+		{Time: from.Add(4 * time.Minute), Samples: 2, CPU: 50, Memory: 200, MemoryLimit: 1000, NetTx: 7},
+		{Time: from.Add(6 * time.Minute), Samples: 1, CPU: 5, Memory: 50, MemoryLimit: 2000, BlockWrite: 3},
+	}
+
+	downsampled := DownsampleMetrics(points, from, 5*time.Minute)
+	if len(downsampled) != 2 {
+		t.Fatalf("expected 2 points, got %d: %+v", len(downsampled), downsampled)
+	}
+
+	first := downsampled[0]
+	if !first.Time.Equal(from) || first.Samples != 10 || first.Resolution != 300 {
+		t.Errorf("unexpected first point: %+v", first)
+	}
+	//the averages are weighted on the samples
+	if math.Abs(first.CPU-26) > 0.001 || first.Memory != 200 {
+		t.Errorf("expected cpu 26 and memory 200, got %v and %d", first.CPU, first.Memory)
+	}
+	if first.NetRx != 15 || first.NetTx != 7 || first.MemoryLimit != 1000 {
+		t.Errorf("unexpected io of the first point: %+v", first)
+	}
+
+	second := downsampled[1]
+	if !second.Time.Equal(from.Add(5*time.Minute)) || second.CPU != 5 || second.BlockWrite != 3 || second.MemoryLimit != 2000 {
+		t.Errorf("unexpected second point: %+v", second)
+	}
+
+	if empty := DownsampleMetrics(nil, from, time.Minute); len(empty) != 0 {
+		t.Errorf("expected no points, got %+v", empty)
+	}
+}
+
+func TestParseMetricsRange(t *testing.T) {
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	from, to, step, err := ParseMetricsRange("", "", "", now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !to.Equal(now) || !from.Equal(now.Add(-time.Hour)) || step != time.Minute {
+		t.Errorf("unexpected default range: %v %v %v", from, to, step)
+	}
+
+	from, to, step, err = ParseMetricsRange("2022-10-01T00:00:00Z", "1664625600", "1h", now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !from.Equal(time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)) || !to.Equal(now) || step != time.Hour {
+		t.Errorf("unexpected range: %v %v %v", from, to, step)
+	}
+
+	if _, _, step, err = ParseMetricsRange("", "", "300", now); err != nil || step != 5*time.Minute {
+		t.Errorf("expected a step of 5 minutes, got %v (%v)", step, err)
+	}
+
+	invalid := [][3]string{
+		{"yesterday", "", ""},
+		{"", "", "30s"},
+		{"", "", "often"},
+		{"1664629200", "1664625600", ""},
+		{"2022-09-01T00:00:00Z", "", "1m"},
+	}
+	for _, query := range invalid {
+		if _, _, _, err := ParseMetricsRange(query[0], query[1], query[2], now); err == nil {
+			t.Errorf("expected an error for %v", query)
+		}
+	}
+}
@@ -78,31 +78,35 @@ func (h Handler) UserPageHandler(w http.ResponseWriter, r *http.Request) {
 
 			//delete the old tokens from the cookies
 			http.SetCookie(w, &http.Cookie{
-				Name:    "ipaas-access-token",
-				Path:    "/",
-				Value:   "",
-				Expires: time.Unix(0, 0),
+				Name:     "ipaas-access-token",
+				Path:     "/",
+				Value:    "",
+				Expires:  time.Unix(0, 0),
+				HttpOnly: true,
 			})
 			http.SetCookie(w, &http.Cookie{
-				Name:    "ipaas-refresh-token",
-				Path:    "/",
-				Value:   "",
-				Expires: time.Unix(0, 0),
+				Name:     "ipaas-refresh-token",
+				Path:     "/",
+				Value:    "",
+				Expires:  time.Unix(0, 0),
+				HttpOnly: true,
 			})
 
 			//set the new tokens
 			//!should set domain and path
 			http.SetCookie(w, &http.Cookie{
-				Name:    "ipaas-access-token",
-				Path:    "/",
-				Value:   accessToken,
-				Expires: time.Now().Add(time.Hour),
+				Name:     "ipaas-access-token",
+				Path:     "/",
+				Value:    accessToken,
+				Expires:  time.Now().Add(time.Hour),
+				HttpOnly: true,
 			})
 			http.SetCookie(w, &http.Cookie{
-				Name:    "ipaas-refresh-token",
-				Path:    "/",
-				Value:   newRefreshToken,
-				Expires: time.Now().Add(time.Hour * 24 * 7),
+				Name:     "ipaas-refresh-token",
+				Path:     "/",
+				Value:    newRefreshToken,
+				Expires:  time.Now().Add(time.Hour * 24 * 7),
+				HttpOnly: true,
 			})
 			//make the user refresh the page
 			http.Redirect(w, r, "/user/", http.StatusFound)
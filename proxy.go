@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// how often the routes are reloaded from the database (they are also reloaded after every deploy)
+const proxyRefreshInterval = 30 * time.Second
+
+// max length of the name of an application in the urls
+const maxSlugLength = 40
+
+var slugInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// proxyRoute is where the requests for an application are sent
+type proxyRoute struct {
+	appID       primitive.ObjectID
+	containerID string
+	port        string
+	status      string
+	healthCheck *HealthCheck
+}
+
+// Proxy is the reverse proxy that routes the requests to the applications over the apps network,
+// an application is reached with <app>.<studentID>.<base domain> or with its verified custom domains.
+// The applications are never served on the host of the platform, so their pages can't use the cookies of the users
+// (the apps hosts are different origins and the cookies of the platform are only sent to its host)
+type Proxy struct {
+	cc            *ContainerController
+	baseDomain    string
+	platformHosts []string      //hosts of the platform, never routed to the applications
+	idleTimeout   time.Duration //the applications without requests for this time are stopped (0 to never stop them)
+
+	mu      sync.RWMutex
+	routes  map[string]proxyRoute       //<studentID>/<slug> -> route
+	ips     map[string]string           //containerID -> ip on the apps network
+	domains map[string]string           //verified custom hostname -> <studentID>/<slug>
+	certs   map[string]*tls.Certificate //custom hostname -> certificate uploaded by the user
+
+	lastRequests map[string]time.Time   //<studentID>/<slug> -> time of the last request
+	waking       map[string]bool        //<studentID>/<slug> of the sleeping applications being started
+	transitions  map[string]*sync.Mutex //<studentID>/<slug> -> lock held while the application is put to sleep or woken up
+}
+
+// NewProxy creates a proxy with no routes, they are loaded by Refresh
+func NewProxy(cc *ContainerController, baseDomain string, platformHosts []string, idleTimeout time.Duration) *Proxy {
+	return &Proxy{
+		cc:            cc,
+		baseDomain:    strings.ToLower(strings.Trim(baseDomain, ".")),
+		platformHosts: platformHosts,
+		idleTimeout:   idleTimeout,
+		routes:        make(map[string]proxyRoute),
+		ips:           make(map[string]string),
+		domains:       make(map[string]string),
+		certs:         make(map[string]*tls.Certificate),
+		lastRequests:  make(map[string]time.Time),
+		waking:        make(map[string]bool),
+		transitions:   make(map[string]*sync.Mutex),
+	}
+}
+
+// ReservedHosts returns the hosts that can't be used as custom domains: the base domain of the apps
+// and the hosts of the platform (their subdomains are reserved too)
+func (p *Proxy) ReservedHosts() []string {
+	return append([]string{p.baseDomain}, p.platformHosts...)
+}
+
+// isPlatformHost reports if the host is one of the hosts of the platform
+func (p *Proxy) isPlatformHost(host string) bool {
+	host = normalizeHost(host)
+	for _, platformHost := range p.platformHosts {
+		if host == platformHost {
+			return true
+		}
+	}
+	return false
+}
+
+func routeKey(studentID, slug string) string {
+	return studentID + "/" + slug
+}
+
+// AppSlug converts the name of an application in the one used in the urls (lower case letters, numbers and -)
+func AppSlug(name string) string {
+	slug := strings.Trim(slugInvalidChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(slug) > maxSlugLength {
+		slug = strings.TrimRight(slug[:maxSlugLength], "-")
+	}
+	if slug == "" {
+		slug = "app"
+	}
+	return slug
+}
+
+// uniqueAppSlug returns the slug of the name that isn't used by the other applications of the student,
+// a number is added to the slug if it's already used (app, app-2, app-3...)
+func uniqueAppSlug(studentID int, name string, db *mongo.Database) (string, error) {
+	base := AppSlug(name)
+	slug := base
+	for i := 2; ; i++ {
+		used, err := db.Collection("applications").CountDocuments(context.TODO(), bson.M{"studentID": studentID, "slug": slug})
+		if err != nil {
+			return "", err
+		}
+		if used == 0 {
+			return slug, nil
+		}
+		slug = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// normalizeHost removes the port from the host of a request and converts it in lower case
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// parseAppHost returns the student id and the slug of the application from a host like <app>.<studentID>.<base domain>
+func parseAppHost(host, baseDomain string) (string, string, bool) {
+	if baseDomain == "" {
+		return "", "", false
+	}
+	host = normalizeHost(host)
+
+	if !strings.HasSuffix(host, "."+baseDomain) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimSuffix(host, "."+baseDomain), ".")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", false
+	}
+	if _, err := strconv.Atoi(parts[1]); err != nil {
+		return "", "", false
+	}
+	return parts[1], parts[0], true
+}
+
+// AppURL returns the public url of an application
+func (p *Proxy) AppURL(studentID int, slug string) string {
+	return fmt.Sprintf("http://%s.%d.%s/", slug, studentID, p.baseDomain)
+}
+
+// stripPlatformCookies removes the cookies of the platform (the tokens of the user) from a request sent to an application
+func stripPlatformCookies(req *http.Request) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if !strings.HasPrefix(cookie.Name, "ipaas-") {
+			req.AddCookie(cookie)
+		}
+	}
+}
+
+// Refresh reloads the routes of the web applications and their custom domains from the database
+func (p *Proxy) Refresh() error {
+	db := p.cc.db
+
+	cur, err := db.Collection("applications").Find(context.TODO(), bson.M{"type": "web", "slug": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	var apps []Application
+	if err := cur.All(context.TODO(), &apps); err != nil {
+		return err
+	}
+
+	routes := make(map[string]proxyRoute)
+	keys := make(map[primitive.ObjectID]string)
+	for _, app := range apps {
+		//the applications created when they were served on the paths of the platform get the url of their host
+		if appURL := p.AppURL(app.StudentID, app.Slug); app.URL != appURL {
+			if _, err := db.Collection("applications").UpdateOne(context.TODO(), bson.M{"_id": app.ID}, bson.M{"$set": bson.M{"url": appURL}}); err != nil {
+				log.Printf("[ERROR] can't update the url of application %s: %v", app.ID.Hex(), err)
+			}
+		}
+		key := routeKey(strconv.Itoa(app.StudentID), app.Slug)
+		routes[key] = proxyRoute{
+			appID:       app.ID,
+			containerID: app.ContainerID,
+			port:        app.Port,
+			status:      app.Status,
+			healthCheck: app.HealthCheck,
+		}
+		keys[app.ID] = key
+	}
+
+	cur, err = db.Collection("domains").Find(context.TODO(), bson.M{})
+	if err != nil {
+		return err
+	}
+	var customDomains []CustomDomain
+	if err := cur.All(context.TODO(), &customDomains); err != nil {
+		return err
+	}
+
+	domains := make(map[string]string)
+	certs := make(map[string]*tls.Certificate)
+	for _, domain := range customDomains {
+		if !domain.Verified {
+			continue
+		}
+		key, found := keys[domain.ApplicationID]
+		if !found {
+			continue
+		}
+		//the domains attached before a host was reserved are never routed
+		if _, err := NormalizeHostname(domain.Hostname, p.ReservedHosts()); err != nil {
+			log.Printf("[ERROR] The domain %s of application %s can't be routed: %v", domain.Hostname, domain.ApplicationID.Hex(), err)
+			continue
+		}
+		domains[domain.Hostname] = key
+		if domain.Certificate != "" {
+			privateKey, err := secretStore.Decrypt(domain.Key)
+			if err != nil {
+				log.Printf("[ERROR] Can't decrypt the key of the domain %s: %v", domain.Hostname, err)
+				continue
+			}
+			cert, err := tls.X509KeyPair([]byte(domain.Certificate), []byte(privateKey))
+			if err != nil {
+				log.Printf("[ERROR] Invalid certificate of the domain %s: %v", domain.Hostname, err)
+				continue
+			}
+			certs[domain.Hostname] = &cert
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, route := range routes {
+		//the holding page is shown until the application is started
+		if p.waking[key] {
+			route.status = AppStatusSleeping
+			routes[key] = route
+		}
+		//the idle time of the new applications (and of all of them after a restart of the platform) starts now
+		if _, found := p.lastRequests[key]; !found {
+			p.lastRequests[key] = time.Now()
+		}
+	}
+	for key := range p.lastRequests {
+		if _, found := routes[key]; !found {
+			delete(p.lastRequests, key)
+		}
+	}
+	p.routes = routes
+	p.domains = domains
+	p.certs = certs
+	//the ips of the removed containers are forgotten
+	used := make(map[string]bool)
+	for _, r := range routes {
+		used[r.containerID] = true
+	}
+	for id := range p.ips {
+		if !used[id] {
+			delete(p.ips, id)
+		}
+	}
+	return nil
+}
+
+// Run refreshes the routes periodically
+func (p *Proxy) Run() {
+	for {
+		if err := p.Refresh(); err != nil {
+			log.Printf("[ERROR] Error refreshing the proxy routes: %v", err)
+		}
+		time.Sleep(proxyRefreshInterval)
+	}
+}
+
+// target returns the address of the container of an application
+func (p *Proxy) target(studentID, slug string) (*url.URL, error) {
+	p.mu.RLock()
+	route, found := p.routes[routeKey(studentID, slug)]
+	ip := p.ips[route.containerID]
+	p.mu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("application not found")
+	}
+
+	if ip == "" {
+		var err error
+		ip, err = p.cc.AppIP(route.containerID)
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		p.ips[route.containerID] = ip
+		p.mu.Unlock()
+	}
+	return &url.URL{Scheme: "http", Host: net.JoinHostPort(ip, route.port)}, nil
+}
+
+// serveApp sends the request to the application
+func (p *Proxy) serveApp(w http.ResponseWriter, r *http.Request, studentID, slug string) {
+	//the stopped idle applications are started again, the user waits on the holding page
+	if p.wakeIfSleeping(routeKey(studentID, slug)) {
+		serveHoldingPage(w, slug)
+		return
+	}
+
+	target, err := p.target(studentID, slug)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("application %s of %s not available: %v", slug, studentID, err), http.StatusNotFound)
+		return
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		stripPlatformCookies(req)
+		req.Header.Set("X-Forwarded-Host", r.Host)
+		if r.TLS != nil {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		log.Printf("[ERROR] Error proxying to application %s of %s: %v", slug, studentID, err)
+		//the container could have been replaced, its ip is asked again on the next request
+		p.mu.Lock()
+		delete(p.ips, p.routes[routeKey(studentID, slug)].containerID)
+		p.mu.Unlock()
+		http.Error(w, "the application is not answering", http.StatusBadGateway)
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// customDomainRoute returns the student id and the slug of the application a custom hostname is attached to
+func (p *Proxy) customDomainRoute(host string) (string, string, bool) {
+	p.mu.RLock()
+	key, found := p.domains[normalizeHost(host)]
+	p.mu.RUnlock()
+	if !found {
+		return "", "", false
+	}
+	parts := strings.SplitN(key, "/", 2)
+	return parts[0], parts[1], true
+}
+
+// GetCertificate returns the certificate uploaded for the server name of the tls handshake
+func (p *Proxy) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mu.RLock()
+	cert, found := p.certs[normalizeHost(hello.ServerName)]
+	p.mu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return cert, nil
+}
+
+// Middleware sends the requests with the host of an application (or one of its custom domains)
+// to the application, the other requests are handled by next
+func (p *Proxy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if studentID, slug, ok := parseAppHost(r.Host, p.baseDomain); ok {
+			p.serveApp(w, r, studentID, slug)
+			return
+		}
+		//the requests to the platform are never sent to an application
+		if p.isPlatformHost(r.Host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if studentID, slug, ok := p.customDomainRoute(r.Host); ok {
+			p.serveApp(w, r, studentID, slug)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAppSlug(t *testing.T) {
+	tests := map[string]string{
+		"ipaas":           "ipaas",
+		"My_Cool.App":     "my-cool-app",
+		"--weird--name--": "weird-name",
+		"":                "app",
+		"àèì":             "app",
+		"a-very-long-repository-name-that-goes-on":        "a-very-long-repository-name-that-goes-on",
+		"a-very-long-repository-name-that-goes-on-and-on": "a-very-long-repository-name-that-goes-on",
+	}
+
+	for name, expected := range tests {
+		if slug := AppSlug(name); slug != expected {
+			t.Errorf("AppSlug(%q): expected %q, got %q", name, expected, slug)
+		}
+	}
+}
+
+func TestParseAppHost(t *testing.T) {
+	tests := []struct {
+		host      string
+		studentID string
+		slug      string
+		ok        bool
+	}{
+		{"blog.18008.apps.example.com", "18008", "blog", true},
+		{"blog.18008.apps.example.com:8080", "18008", "blog", true},
+		{"Blog.18008.Apps.Example.com.", "18008", "blog", true},
+		{"apps.example.com", "", "", false},
+		{"18008.apps.example.com", "", "", false},
+		{"blog.student.apps.example.com", "", "", false},
+		{"api.blog.18008.apps.example.com", "", "", false},
+		{"blog.18008.example.com", "", "", false},
+	}
+
+	for _, test := range tests {
+		studentID, slug, ok := parseAppHost(test.host, "apps.example.com")
+		if ok != test.ok || studentID != test.studentID || slug != test.slug {
+			t.Errorf("parseAppHost(%q): expected (%q, %q, %v), got (%q, %q, %v)", test.host, test.studentID, test.slug, test.ok, studentID, slug, ok)
+		}
+	}
+
+	if _, _, ok := parseAppHost("blog.18008.apps.example.com", ""); ok {
+		t.Errorf("expected no match without a base domain")
+	}
+}
+
+func TestStripPlatformCookies(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://blog.18008.apps.example.com/", nil)
+	req.Header.Set("Cookie", "ipaas-access-token=a; theme=dark; ipaas-refresh-token=b; session=c")
+
+	stripPlatformCookies(req)
+
+	if cookie := req.Header.Get("Cookie"); cookie != "theme=dark; session=c" {
+		t.Errorf("expected only the cookies of the application, got %q", cookie)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// label used to mark the docker resources (volumes) owned by a student
+const ownerLabel = "matricola"
+
+// time the disk usage of the volumes is cached for, the disk usage api walks all the images,
+// containers, volumes and build cache of the host so it can't be called on every request
+const volumeUsageTTL = time.Minute
+
+// quotaState is shared by the copies of the controller, the locks serialize the quota check of a student
+// with the creation of what it allows and the disk usage of the volumes is cached
+type quotaState struct {
+	mu    sync.Mutex
+	locks map[int]*sync.Mutex //student id -> lock of its quota
+
+	volumesMu        sync.Mutex
+	volumes          map[string]int64 //student id -> bytes used by its volumes
+	volumesUpdatedAt time.Time
+}
+
+func newQuotaState() *quotaState {
+	return &quotaState{
+		locks: make(map[int]*sync.Mutex),
+	}
+}
+
+// LockQuota locks the quota of the student until the returned function is called, the check of the quota and
+// the creation of the resource must happen under the lock or two requests sent together could both pass the check
+func (c ContainerController) LockQuota(studentID int) func() {
+	c.quota.mu.Lock()
+	lock, found := c.quota.locks[studentID]
+	if !found {
+		lock = new(sync.Mutex)
+		c.quota.locks[studentID] = lock
+	}
+	c.quota.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// volumeDiskUsage returns the disk used by the volumes of the student, the usage of all the students
+// is read again only if it's older than volumeUsageTTL
+func (c ContainerController) volumeDiskUsage(studentID int) (int64, error) {
+	c.quota.volumesMu.Lock()
+	defer c.quota.volumesMu.Unlock()
+
+	if c.quota.volumes == nil || time.Since(c.quota.volumesUpdatedAt) > volumeUsageTTL {
+		//the size of the volumes is only returned by the disk usage api
+		diskUsage, err := c.cli.DiskUsage(c.ctx)
+		if err != nil {
+			return 0, err
+		}
+		volumes := make(map[string]int64)
+		for _, v := range diskUsage.Volumes {
+			if v.Labels[ownerLabel] == "" || v.UsageData == nil || v.UsageData.Size < 0 {
+				continue
+			}
+			volumes[v.Labels[ownerLabel]] += v.UsageData.Size
+		}
+		c.quota.volumes = volumes
+		c.quota.volumesUpdatedAt = time.Now()
+	}
+	return c.quota.volumes[strconv.Itoa(studentID)], nil
+}
+
+// Quota are the maximum resources a student can use, a zero value means no limit
+type Quota struct {
+	MaxApps       int   `bson:"maxApps,omitempty" json:"maxApps"`             //number of web applications (deploys in the queue included)
+	MaxDatabases  int   `bson:"maxDatabases,omitempty" json:"maxDatabases"`   //number of databases
+	MaxMemory     int64 `bson:"maxMemory,omitempty" json:"maxMemory"`         //memory reserved by all the containers in bytes
+	MaxVolumeDisk int64 `bson:"maxVolumeDisk,omitempty" json:"maxVolumeDisk"` //disk used by all the volumes in bytes
+}
+
+// QuotaUsage are the resources currently used by a student
+type QuotaUsage struct {
+	Apps       int   `json:"apps"`
+	Databases  int   `json:"databases"`
+	Memory     int64 `json:"memory"`
+	VolumeDisk int64 `json:"volumeDisk"`
+}
+
+// QuotaError is returned when a student asks for more resources than the quota allows
+type QuotaError struct {
+	Resource string
+	Used     int64
+	Limit    int64
+}
+
+func (e *QuotaError) Error() string {
+	switch e.Resource {
+	case "memory", "volume disk":
+		return fmt.Sprintf("%s quota exceeded: %s used out of %s", e.Resource, units.BytesSize(float64(e.Used)), units.BytesSize(float64(e.Limit)))
+	}
+	return fmt.Sprintf("%s quota exceeded: %d used out of %d", e.Resource, e.Used, e.Limit)
+}
+
+// default quota, the values are read from the enviroment variables in loadDefaultQuota
+var DefaultQuota = Quota{
+	MaxApps:       5,
+	MaxDatabases:  3,
+	MaxMemory:     2 * units.GiB,
+	MaxVolumeDisk: 2 * units.GiB,
+}
+
+// GetQuota returns the quota of a student, the values set on the student override the default ones
+func GetQuota(student Student) Quota {
+	quota := DefaultQuota
+	if student.Quota == nil {
+		return quota
+	}
+	if student.Quota.MaxApps != 0 {
+		quota.MaxApps = student.Quota.MaxApps
+	}
+	if student.Quota.MaxDatabases != 0 {
+		quota.MaxDatabases = student.Quota.MaxDatabases
+	}
+	if student.Quota.MaxMemory != 0 {
+		quota.MaxMemory = student.Quota.MaxMemory
+	}
+	if student.Quota.MaxVolumeDisk != 0 {
+		quota.MaxVolumeDisk = student.Quota.MaxVolumeDisk
+	}
+	return quota
+}
+
+// GetQuotaUsage counts the applications, the databases, the memory reserved and the volumes disk usage of a student.
+// The deploys that are not finished are counted as applications (with the memory they reserved) so the quota can't be bypassed queueing them
+func (c ContainerController) GetQuotaUsage(studentID int, db *mongo.Database) (QuotaUsage, error) {
+	var usage QuotaUsage
+
+	cur, err := db.Collection("applications").Find(context.TODO(), bson.M{"studentID": studentID})
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	var apps []Application
+	if err := cur.All(context.TODO(), &apps); err != nil {
+		return QuotaUsage{}, err
+	}
+	for _, app := range apps {
+		switch app.Type {
+		case "web":
+			usage.Apps++
+		case "database":
+			usage.Databases++
+		}
+		//the applications created before the limits were saved use the default memory
+		memory := app.Limits.Memory
+		if memory == 0 {
+			memory = DefaultLimits.Memory
+		}
+		usage.Memory += memory
+	}
+
+	cur, err = db.Collection("deployJobs").Find(context.TODO(), bson.M{
+		"studentID": studentID,
+		"type":      bson.M{"$nin": []string{JobTypeUpdate, JobTypeRollback, JobTypeEnvs}},
+		"phase":     bson.M{"$nin": []string{JobPhaseFailed, JobPhaseSucceeded}},
+	})
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	var pending []DeployJob
+	if err := cur.All(context.TODO(), &pending); err != nil {
+		return QuotaUsage{}, err
+	}
+	for _, job := range pending {
+		usage.Apps++
+		//the jobs queued before the limits were saved reserve the default memory
+		memory := DefaultLimits.Memory
+		if job.Limits != nil && job.Limits.Memory != 0 {
+			memory = job.Limits.Memory
+		}
+		usage.Memory += memory
+	}
+
+	usage.VolumeDisk, err = c.volumeDiskUsage(studentID)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+
+	return usage, nil
+}
+
+// CheckQuota returns a *QuotaError if the student can't create a new resource of the given type ("web" or "database")
+// that reserves the given memory, the caller must hold the lock of LockQuota until the resource is saved
+func (c ContainerController) CheckQuota(student Student, appType string, memory int64, db *mongo.Database) error {
+	quota := GetQuota(student)
+	usage, err := c.GetQuotaUsage(student.ID, db)
+	if err != nil {
+		return err
+	}
+
+	switch appType {
+	case "web":
+		if quota.MaxApps > 0 && usage.Apps >= quota.MaxApps {
+			return &QuotaError{Resource: "applications", Used: int64(usage.Apps), Limit: int64(quota.MaxApps)}
+		}
+	case "database":
+		if quota.MaxDatabases > 0 && usage.Databases >= quota.MaxDatabases {
+			return &QuotaError{Resource: "databases", Used: int64(usage.Databases), Limit: int64(quota.MaxDatabases)}
+		}
+		if quota.MaxVolumeDisk > 0 && usage.VolumeDisk >= quota.MaxVolumeDisk {
+			return &QuotaError{Resource: "volume disk", Used: usage.VolumeDisk, Limit: quota.MaxVolumeDisk}
+		}
+	}
+
+	if quota.MaxMemory > 0 && usage.Memory+memory > quota.MaxMemory {
+		return &QuotaError{Resource: "memory", Used: usage.Memory, Limit: quota.MaxMemory}
+	}
+	return nil
+}
+
+// CheckDeployJobQuota checks the quota again when a deploy job is about to create its container: the limits of the
+// job are updated to the ones of its runtime (an auto detected runtime is only known after cloning the repo) and the job,
+// which is already counted in the usage, can go on only if the usage doesn't exceed the quota
+func (c ContainerController) CheckDeployJobQuota(student Student, jobID primitive.ObjectID, limits ResourceLimits, db *mongo.Database) error {
+	unlock := c.LockQuota(student.ID)
+	defer unlock()
+
+	if _, err := db.Collection("deployJobs").UpdateOne(context.TODO(), bson.M{"_id": jobID}, bson.M{"$set": bson.M{"limits": limits}}); err != nil {
+		return err
+	}
+	quota := GetQuota(student)
+	usage, err := c.GetQuotaUsage(student.ID, db)
+	if err != nil {
+		return err
+	}
+	if quota.MaxApps > 0 && usage.Apps > quota.MaxApps {
+		return &QuotaError{Resource: "applications", Used: int64(usage.Apps - 1), Limit: int64(quota.MaxApps)}
+	}
+	if quota.MaxMemory > 0 && usage.Memory > quota.MaxMemory {
+		return &QuotaError{Resource: "memory", Used: usage.Memory - limits.Memory, Limit: quota.MaxMemory}
+	}
+	return nil
+}
+
+// loadDefaultQuota reads the default quota from the enviroment variables, the empty ones are ignored:
+// QUOTA_MAX_APPS (5), QUOTA_MAX_DATABASES (3), QUOTA_MAX_MEMORY (2g), QUOTA_MAX_VOLUME_DISK (2g)
+func loadDefaultQuota() error {
+	if apps := os.Getenv("QUOTA_MAX_APPS"); apps != "" {
+		value, err := strconv.Atoi(apps)
+		if err != nil {
+			return fmt.Errorf("invalid QUOTA_MAX_APPS: %v", err)
+		}
+		DefaultQuota.MaxApps = value
+	}
+
+	if databases := os.Getenv("QUOTA_MAX_DATABASES"); databases != "" {
+		value, err := strconv.Atoi(databases)
+		if err != nil {
+			return fmt.Errorf("invalid QUOTA_MAX_DATABASES: %v", err)
+		}
+		DefaultQuota.MaxDatabases = value
+	}
+
+	if memory := os.Getenv("QUOTA_MAX_MEMORY"); memory != "" {
+		bytes, err := units.RAMInBytes(memory)
+		if err != nil {
+			return fmt.Errorf("invalid QUOTA_MAX_MEMORY: %v", err)
+		}
+		DefaultQuota.MaxMemory = bytes
+	}
+
+	if disk := os.Getenv("QUOTA_MAX_VOLUME_DISK"); disk != "" {
+		bytes, err := units.RAMInBytes(disk)
+		if err != nil {
+			return fmt.Errorf("invalid QUOTA_MAX_VOLUME_DISK: %v", err)
+		}
+		DefaultQuota.MaxVolumeDisk = bytes
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// default number of release images kept for each application
+const defaultReleasesToKeep = 3
+
+// Release is a successful deploy of an application, the image is kept tagged with
+// the commit until the release is one of the last ones so it can be rolled back without rebuilding
+type Release struct {
+	ID            primitive.ObjectID `bson:"_id" json:"id"`
+	ApplicationID primitive.ObjectID `bson:"applicationID" json:"-"`
+	StudentID     int                `bson:"studentID" json:"-"`
+	CommitHash    string             `bson:"commitHash" json:"commitHash"`
+	Image         string             `bson:"image" json:"image"`                               //tag of the image (<image name>:<commit>-<build>)
+	ImageID       string             `bson:"imageID" json:"imageID"`                           //id of the image
+	Envs          []Env              `bson:"envs,omitempty" json:"envs,omitempty"`             //envs the container ran with
+	RollbackOf    primitive.ObjectID `bson:"rollbackOf,omitempty" json:"rollbackOf,omitempty"` //release brought back by this one
+	Pruned        bool               `bson:"pruned" json:"pruned"`                             //true if the image was removed
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// TagReleaseImage tags the image just built with the commit hash and the id of the build (<image name>:<short commit>-<build>)
+// and removes the latest tag, so the next build of the same application doesn't replace it. The builds of the same
+// commit get different tags, so removing the image of an old release never untags the one of a newer release
+func (c ContainerController) TagReleaseImage(imageName, imageID, hash, buildID string) (string, error) {
+	tag := hash
+	if len(tag) > 12 {
+		tag = tag[:12]
+	}
+	tag += "-" + buildID
+	//docker references must be lower case
+	image := strings.ToLower(imageName) + ":" + tag
+	if err := c.cli.ImageTag(c.ctx, imageID, image); err != nil {
+		return "", err
+	}
+	if err := c.RemoveImage(imageName); err != nil && !client.IsErrNotFound(err) {
+		log.Printf("[ERROR] can't remove the tag %s: %v", imageName, err)
+	}
+	return image, nil
+}
+
+// saveRelease inserts the release of an application and removes the images of the old ones,
+// it runs after the switch to the new container so the callers log its errors without failing the job
+func (h Handler) saveRelease(release Release, db *mongo.Database) error {
+	release.ID = primitive.NewObjectID()
+	release.CreatedAt = time.Now()
+	if _, err := db.Collection("releases").InsertOne(context.TODO(), release); err != nil {
+		return fmt.Errorf("error saving the release: %v", err)
+	}
+
+	if err := h.pruneReleases(release.ApplicationID, db); err != nil {
+		//the release is saved, the images will be removed by the next deploy
+		log.Printf("[ERROR] can't prune the releases of application %s: %v", release.ApplicationID.Hex(), err)
+	}
+	return nil
+}
+
+// GetReleases returns the releases of an application, the newest first
+func GetReleases(applicationID primitive.ObjectID, db *mongo.Database) ([]Release, error) {
+	cur, err := db.Collection("releases").Find(context.TODO(), bson.M{"applicationID": applicationID},
+		options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []Release
+	if err := cur.All(context.TODO(), &releases); err != nil {
+		return nil, err
+	}
+	return releases, nil
+}
+
+// pruneReleases keeps the images of the last releases of an application and removes the others,
+// the images shared by more releases (a rollback uses the image of the release it brings back) are kept
+// if any of them is recent
+func (h Handler) pruneReleases(applicationID primitive.ObjectID, db *mongo.Database) error {
+	releases, err := GetReleases(applicationID, db)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool)
+	for _, r := range releases {
+		if len(keep) == h.releasesToKeep {
+			break
+		}
+		keep[r.Image] = true
+	}
+	//the image of the running container is never removed, even if its release isn't one of the last ones
+	var app Application
+	if err := db.Collection("applications").FindOne(context.TODO(), bson.M{"_id": applicationID}).Decode(&app); err == nil {
+		if current, err := h.cc.cli.ContainerInspect(h.cc.ctx, app.ContainerID); err == nil {
+			keep[current.Config.Image] = true
+			for _, r := range releases {
+				if r.ImageID == current.Image {
+					keep[r.Image] = true
+				}
+			}
+		}
+	}
+
+	pruned := make(map[string]bool)
+	for _, r := range releases {
+		if r.Pruned || keep[r.Image] || pruned[r.Image] {
+			continue
+		}
+		if err := h.cc.RemoveImage(r.Image); err != nil && !client.IsErrNotFound(err) {
+			return err
+		}
+		if _, err := db.Collection("releases").UpdateMany(context.TODO(), bson.M{"applicationID": applicationID, "image": r.Image}, bson.M{"$set": bson.M{"pruned": true}}); err != nil {
+			return err
+		}
+		pruned[r.Image] = true
+	}
+	return nil
+}
+
+// removeReleases removes the images and the releases of a deleted application
+func (h Handler) removeReleases(applicationID primitive.ObjectID, db *mongo.Database) error {
+	releases, err := GetReleases(applicationID, db)
+	if err != nil {
+		return err
+	}
+	for _, r := range releases {
+		if r.Pruned {
+			continue
+		}
+		if err := h.cc.RemoveImage(r.Image); err != nil && !client.IsErrNotFound(err) {
+			log.Printf("[ERROR] can't remove the image %s: %v", r.Image, err)
+		}
+	}
+	_, err = db.Collection("releases").DeleteMany(context.TODO(), bson.M{"applicationID": applicationID})
+	return err
+}
+
+// currentContainerName returns the name the container of an application keeps in a blue/green deploy
+// (without the suffix of a previous deploy that couldn't rename it)
+func currentContainerName(current types.ContainerJSON) string {
+	return strings.TrimSuffix(strings.TrimPrefix(current.Name, "/"), "-next")
+}
+
+// runRollbackJob replaces the container of an application with one created from the image of a previous release,
+// the swap is done with the same blue/green deploy of the updates so the current version keeps running if it fails
+func (h Handler) runRollbackJob(job DeployJob, buildLog io.Writer) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Client().Disconnect(context.TODO())
+
+	var app Application
+	if err := db.Collection("applications").FindOne(context.TODO(), bson.M{"_id": job.ApplicationID}).Decode(&app); err != nil {
+		return fmt.Errorf("error getting the application: %v", err)
+	}
+
+	var release Release
+	if err := db.Collection("releases").FindOne(context.TODO(), bson.M{"_id": job.ReleaseID, "applicationID": app.ID}).Decode(&release); err != nil {
+		return fmt.Errorf("error getting the release: %v", err)
+	}
+	if release.Pruned {
+		return fmt.Errorf("the image of the release %s was removed, only the last %d releases can be rolled back", release.ID.Hex(), h.releasesToKeep)
+	}
+	if _, _, err := h.cc.cli.ImageInspectWithRaw(h.cc.ctx, release.Image); err != nil {
+		return fmt.Errorf("the image of the release is not available: %v", err)
+	}
+
+	student, err := GetStudentFromID(job.StudentID, db)
+	if err != nil {
+		return fmt.Errorf("error getting the student: %v", err)
+	}
+	limits := ApplicationLimits(student, app)
+
+	current, err := h.cc.cli.ContainerInspect(h.cc.ctx, app.ContainerID)
+	if err != nil {
+		return fmt.Errorf("error getting the current container: %v", err)
+	}
+	containerName := currentContainerName(current)
+
+	if err := setJobPhase(job.ID, JobPhaseStarting, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(buildLog, "rolling back to commit %s (%s)\n", release.CommitHash, release.Image)
+
+	//the release runs with the envs it had
+	app.Envs = release.Envs
+	id, err := h.startNextContainer(app, containerName, release.Image, limits, buildLog)
+	if err != nil {
+		return err
+	}
+
+	status, err := h.cc.GetContainerStatus(id)
+	if err != nil {
+		h.cc.DeleteContainer(id)
+		return fmt.Errorf("error getting the status of the container: %v", err)
+	}
+
+	if err := h.switchApplicationContainer(&app, bson.M{
+		"containerID":    id,
+		"status":         status,
+		"health":         HealthHealthy,
+		"lastCommitHash": release.CommitHash,
+		"envs":           release.Envs,
+		"limits":         limits,
+	}, db); err != nil {
+		h.cc.DeleteContainer(id)
+		return err
+	}
+	h.retireContainer(app.ContainerID, id, containerName, buildLog)
+
+	//the rollback is a release too, so it's the current one in the history
+	if err := h.saveRelease(Release{
+		ApplicationID: app.ID,
+		StudentID:     app.StudentID,
+		CommitHash:    release.CommitHash,
+		Image:         release.Image,
+		ImageID:       release.ImageID,
+		Envs:          release.Envs,
+		RollbackOf:    release.ID,
+	}, db); err != nil {
+		//the application already runs the new container, only the history misses it
+		log.Printf("[ERROR] Error saving the release of application %s: %v", app.ID.Hex(), err)
+	}
+
+	return setJobPhase(job.ID, JobPhaseSucceeded, bson.M{
+		"containerID": id,
+		"url":         app.URL,
+	})
+}
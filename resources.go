@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+)
+
+// ResourceLimits are the limits applied to a container (and to the build of its image),
+// a zero value means that the limit is not set and the one with lower priority is used
+type ResourceLimits struct {
+	Memory      int64 `bson:"memory,omitempty" json:"memory,omitempty"`           //memory limit in bytes
+	NanoCPUs    int64 `bson:"nanoCPUs,omitempty" json:"nanoCPUs,omitempty"`       //cpu quota in units of 10^-9 cpus
+	PidsLimit   int64 `bson:"pidsLimit,omitempty" json:"pidsLimit,omitempty"`     //max number of processes
+	BuildMemory int64 `bson:"buildMemory,omitempty" json:"buildMemory,omitempty"` //memory limit of the image build in bytes
+}
+
+// default limits, the values are read from the enviroment variables in loadDefaultLimits
+var DefaultLimits = ResourceLimits{
+	Memory:      512 * units.MiB,
+	NanoCPUs:    500000000,
+	PidsLimit:   256,
+	BuildMemory: 1 * units.GiB,
+}
+
+// Merge returns the limits with the non zero values of override replacing the current ones
+func (l ResourceLimits) Merge(override ResourceLimits) ResourceLimits {
+	if override.Memory != 0 {
+		l.Memory = override.Memory
+	}
+	if override.NanoCPUs != 0 {
+		l.NanoCPUs = override.NanoCPUs
+	}
+	if override.PidsLimit != 0 {
+		l.PidsLimit = override.PidsLimit
+	}
+	if override.BuildMemory != 0 {
+		l.BuildMemory = override.BuildMemory
+	}
+	return l
+}
+
+// HostResources converts the limits in the resources of a docker host config,
+// the swap is disabled setting it equal to the memory
+func (l ResourceLimits) HostResources() container.Resources {
+	resources := container.Resources{
+		Memory:     l.Memory,
+		MemorySwap: l.Memory,
+		NanoCPUs:   l.NanoCPUs,
+	}
+	if l.PidsLimit != 0 {
+		pids := l.PidsLimit
+		resources.PidsLimit = &pids
+	}
+	return resources
+}
+
+// GetResourceLimits returns the limits for a container of the student, the priority is:
+// 1) the overrides of the student
+// 2) the limits of the runtime or of the db engine
+// 3) the default limits
+func GetResourceLimits(student Student, limits ResourceLimits) ResourceLimits {
+	effective := DefaultLimits.Merge(limits)
+	if student.Limits != nil {
+		effective = effective.Merge(*student.Limits)
+	}
+	return effective
+}
+
+// loadDefaultLimits reads the default limits from the enviroment variables, the empty ones are ignored:
+// DEFAULT_MEMORY_LIMIT (512m), DEFAULT_CPU_LIMIT (0.5), DEFAULT_PIDS_LIMIT (256), DEFAULT_BUILD_MEMORY_LIMIT (1g)
+func loadDefaultLimits() error {
+	limits, err := limitsFromEnv("DEFAULT", DefaultLimits)
+	if err != nil {
+		return err
+	}
+	DefaultLimits = limits
+	return nil
+}
+
+// limitsFromEnv overrides the given limits with the enviroment variables <prefix>_MEMORY_LIMIT, <prefix>_CPU_LIMIT,
+// <prefix>_PIDS_LIMIT and <prefix>_BUILD_MEMORY_LIMIT, the empty ones are ignored
+func limitsFromEnv(prefix string, limits ResourceLimits) (ResourceLimits, error) {
+	if memory := os.Getenv(prefix + "_MEMORY_LIMIT"); memory != "" {
+		bytes, err := units.RAMInBytes(memory)
+		if err != nil {
+			return limits, fmt.Errorf("invalid %s_MEMORY_LIMIT: %v", prefix, err)
+		}
+		limits.Memory = bytes
+	}
+
+	if cpus := os.Getenv(prefix + "_CPU_LIMIT"); cpus != "" {
+		value, err := strconv.ParseFloat(cpus, 64)
+		if err != nil {
+			return limits, fmt.Errorf("invalid %s_CPU_LIMIT: %v", prefix, err)
+		}
+		limits.NanoCPUs = int64(value * 1e9)
+	}
+
+	if pids := os.Getenv(prefix + "_PIDS_LIMIT"); pids != "" {
+		value, err := strconv.ParseInt(pids, 10, 64)
+		if err != nil {
+			return limits, fmt.Errorf("invalid %s_PIDS_LIMIT: %v", prefix, err)
+		}
+		limits.PidsLimit = value
+	}
+
+	if memory := os.Getenv(prefix + "_BUILD_MEMORY_LIMIT"); memory != "" {
+		bytes, err := units.RAMInBytes(memory)
+		if err != nil {
+			return limits, fmt.Errorf("invalid %s_BUILD_MEMORY_LIMIT: %v", prefix, err)
+		}
+		limits.BuildMemory = bytes
+	}
+	return limits, nil
+}
@@ -6,6 +6,15 @@ import (
 	"net/http"
 )
 
+// quote returns the message as a json string, the quotes and the control characters in it are escaped
+func quote(message string) string {
+	quoted, err := json.Marshal(message)
+	if err != nil {
+		return `""`
+	}
+	return string(quoted)
+}
+
 func Errorf(w http.ResponseWriter, code int, format string, args ...interface{}) {
 	Error(w, code, fmt.Sprintf(format, args...))
 }
@@ -13,7 +22,7 @@ func Errorf(w http.ResponseWriter, code int, format string, args ...interface{})
 func Error(w http.ResponseWriter, code int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	fmt.Fprintf(w, `{"code": %d, "msg":"%s", "error": true}`, code, message)
+	fmt.Fprintf(w, `{"code": %d, "msg":%s, "error": true}`, code, quote(message))
 }
 
 func ErrorParse(w http.ResponseWriter, code int, message string, values interface{}) {
@@ -24,13 +33,13 @@ func ErrorParse(w http.ResponseWriter, code int, message string, values interfac
 		Errorf(w, http.StatusInternalServerError, "Error marshalling json: %s", e)
 		return
 	}
-	fmt.Fprintf(w, `{"code": %d, "msg":"%s", "error": true, "data":%s}`, code, message, resp)
+	fmt.Fprintf(w, `{"code": %d, "msg":%s, "error": true, "data":%s}`, code, quote(message), resp)
 }
 
 func ErrorJson(w http.ResponseWriter, code int, message string, json []byte) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	fmt.Fprintf(w, `{"code": %d, "msg":"%s", "error": true, "data":%s}`, code, message, json)
+	fmt.Fprintf(w, `{"code": %d, "msg":%s, "error": true, "data":%s}`, code, quote(message), json)
 }
 
 func Successf(w http.ResponseWriter, code int, format string, args ...interface{}) {
@@ -40,7 +49,7 @@ func Successf(w http.ResponseWriter, code int, format string, args ...interface{
 func Success(w http.ResponseWriter, code int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	fmt.Fprintf(w, `{"code": %d, "msg":"%s", "error": false}`, code, message)
+	fmt.Fprintf(w, `{"code": %d, "msg":%s, "error": false}`, code, quote(message))
 }
 
 func SuccessParse(w http.ResponseWriter, code int, message string, values interface{}) {
@@ -51,11 +60,11 @@ func SuccessParse(w http.ResponseWriter, code int, message string, values interf
 		Errorf(w, http.StatusInternalServerError, "Error marshalling json: %s", e)
 		return
 	}
-	fmt.Fprintf(w, `{"code": %d, "msg":"%s", "error": false, "data":%s}`, code, message, resp)
+	fmt.Fprintf(w, `{"code": %d, "msg":%s, "error": false, "data":%s}`, code, quote(message), resp)
 }
 
 func SuccessJson(w http.ResponseWriter, code int, message string, json []byte) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	fmt.Fprintf(w, `{"code": %d, "msg":"%s", "error": false, "data":%s}`, code, message, json)
+	fmt.Fprintf(w, `{"code": %d, "msg":%s, "error": false, "data":%s}`, code, quote(message), json)
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+
+	"github.com/docker/go-units"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Runtime is a document of the langs collection, it describes how to build and run
+// an application written in a given language
+type Runtime struct {
+	Lang         string         `bson:"lang" json:"lang"`                         //id of the runtime, used in AppPost.Language
+	Name         string         `bson:"name" json:"name"`                         //human readable name
+	Template     string         `bson:"template" json:"-"`                        //dockerfile template in the dockerfiles folder (empty for the dockerfile runtime)
+	BaseImage    string         `bson:"baseImage" json:"baseImage"`               //image used to build the application
+	DefaultPort  string         `bson:"defaultPort" json:"defaultPort"`           //port used if the user doesn't set one
+	BuildCommand string         `bson:"buildCommand" json:"buildCommand"`         //command run to build the application (can be empty)
+	StartCommand string         `bson:"startCommand" json:"startCommand"`         //command run to start the application
+	Markers      []string       `bson:"markers" json:"markers"`                   //files in the root of a repo that identify the runtime
+	Limits       ResourceLimits `bson:"limits,omitempty" json:"limits,omitempty"` //resource limits of the runtime, override the default ones
+}
+
+// DockerfileData are the variables available in the dockerfile templates
+type DockerfileData struct {
+	AppName      string
+	Repo         string
+	Port         int
+	BaseImage    string
+	BuildCommand string
+	StartCommand string
+}
+
+// defaultRuntimes is the catalog of the runtimes, they are saved in the langs collection when the database is initialized.
+// The order is the priority used when more runtimes are detected in the same repo
+var defaultRuntimes = []Runtime{
+	{
+		Lang:         "go",
+		Name:         "Go",
+		Template:     "go.dockerfile",
+		BaseImage:    "golang:1-alpine3.15",
+		DefaultPort:  "8080",
+		BuildCommand: "go build -o $IPAAS_APP_NAME",
+		StartCommand: "./$IPAAS_APP_NAME",
+		Markers:      []string{"go.mod"},
+	},
+	{
+		Lang:         "python",
+		Name:         "Python",
+		Template:     "python.dockerfile",
+		BaseImage:    "python:3.10-slim",
+		DefaultPort:  "8000",
+		BuildCommand: "if [ -f requirements.txt ]; then pip install --no-cache-dir -r requirements.txt; elif [ -f pyproject.toml ]; then pip install --no-cache-dir .; fi",
+		StartCommand: "python main.py",
+		Markers:      []string{"requirements.txt", "pyproject.toml", "Pipfile"},
+	},
+	{
+		Lang:         "node",
+		Name:         "Node.js",
+		Template:     "node.dockerfile",
+		BaseImage:    "node:18-alpine",
+		DefaultPort:  "3000",
+		BuildCommand: "npm install && (npm run build --if-present)",
+		StartCommand: "npm start",
+		Markers:      []string{"package.json"},
+	},
+	{
+		Lang:         "java-maven",
+		Name:         "Java (Maven)",
+		Template:     "java-maven.dockerfile",
+		BaseImage:    "maven:3.8-openjdk-17-slim",
+		DefaultPort:  "8080",
+		BuildCommand: "mvn -B package -DskipTests",
+		StartCommand: "java -jar app.jar",
+		Markers:      []string{"pom.xml"},
+		Limits:       ResourceLimits{Memory: 768 * units.MiB, BuildMemory: 2 * units.GiB},
+	},
+	{
+		Lang:         "java-gradle",
+		Name:         "Java (Gradle)",
+		Template:     "java-gradle.dockerfile",
+		BaseImage:    "gradle:7-jdk17",
+		DefaultPort:  "8080",
+		BuildCommand: "gradle build -x test --no-daemon",
+		StartCommand: "java -jar app.jar",
+		Markers:      []string{"build.gradle", "build.gradle.kts"},
+		Limits:       ResourceLimits{Memory: 768 * units.MiB, BuildMemory: 2 * units.GiB},
+	},
+	{
+		Lang:         "php",
+		Name:         "PHP",
+		Template:     "php.dockerfile",
+		BaseImage:    "php:8.1-apache",
+		DefaultPort:  "80",
+		BuildCommand: "if [ -f composer.json ]; then composer install --no-dev --optimize-autoloader; fi",
+		StartCommand: "apache2-foreground",
+		Markers:      []string{"composer.json", "index.php"},
+	},
+	{
+		Lang:         "rust",
+		Name:         "Rust",
+		Template:     "rust.dockerfile",
+		BaseImage:    "rust:1.64",
+		DefaultPort:  "8080",
+		BuildCommand: "cargo build --release",
+		StartCommand: "./app",
+		Markers:      []string{"Cargo.toml"},
+		Limits:       ResourceLimits{BuildMemory: 2 * units.GiB},
+	},
+	{
+		Lang:         DockerfileRuntime,
+		Name:         "Dockerfile",
+		Template:     "",
+		BaseImage:    "",
+		DefaultPort:  "",
+		BuildCommand: "",
+		StartCommand: "",
+		Markers:      []string{"Dockerfile"},
+	},
+	{
+		Lang:         "static",
+		Name:         "Static site",
+		Template:     "static.dockerfile",
+		BaseImage:    "nginx:1.23-alpine",
+		DefaultPort:  "80",
+		BuildCommand: "",
+		StartCommand: "nginx -g 'daemon off;'",
+		Markers:      []string{"index.html"},
+	},
+}
+
+// GetRuntime returns the runtime with the given lang, false if it's not supported
+func GetRuntime(lang string) (Runtime, bool) {
+	for _, r := range Runtimes {
+		if r.Lang == lang {
+			return r, true
+		}
+	}
+	return Runtime{}, false
+}
+
+// ApplicationLimits returns the limits of the student on the runtime of the application, if the runtime
+// was removed from the catalog the limits saved on the application are kept
+func ApplicationLimits(student Student, app Application) ResourceLimits {
+	runtime, found := GetRuntime(app.Lang)
+	if !found {
+		return GetResourceLimits(student, app.Limits)
+	}
+	return GetResourceLimits(student, runtime.Limits)
+}
+
+// MaxRuntimeLimits returns the limits of the student on the runtime that reserves the most memory,
+// they are reserved by the deploys that detect the runtime
+func MaxRuntimeLimits(student Student) ResourceLimits {
+	max := GetResourceLimits(student, ResourceLimits{})
+	for _, r := range Runtimes {
+		if limits := GetResourceLimits(student, r.Limits); limits.Memory > max.Memory {
+			max = limits
+		}
+	}
+	return max
+}
+
+// RenderDockerfile fills the template of the runtime with the given data,
+// the base image, build and start commands are taken from the runtime
+func (r Runtime) RenderDockerfile(data DockerfileData) (string, error) {
+	t, err := template.ParseFiles("dockerfiles/" + r.Template)
+	if err != nil {
+		return "", err
+	}
+
+	data.BaseImage = r.BaseImage
+	data.BuildCommand = r.BuildCommand
+	data.StartCommand = r.StartCommand
+
+	var dockerfile bytes.Buffer
+	if err := t.Execute(&dockerfile, data); err != nil {
+		return "", fmt.Errorf("error rendering the %s dockerfile: %v", r.Lang, err)
+	}
+	return dockerfile.String(), nil
+}
+
+// seedRuntimes saves the default runtimes in the langs collection,
+// the runtimes already saved with a template are not overwritten so they can be customized
+func seedRuntimes(db *mongo.Database) error {
+	langs := db.Collection("langs")
+	for _, r := range defaultRuntimes {
+		var saved bson.M
+		err := langs.FindOne(context.Background(), bson.M{"lang": r.Lang, "template": bson.M{"$exists": true}}).Decode(&saved)
+		if err == nil {
+			//runtimes saved by older versions miss the fields added later (markers, limits, ...), they get the default values
+			if err := backfillRuntime(langs, saved, r); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+
+		//the old documents only had the lang, they are replaced with the complete one
+		if _, err := langs.ReplaceOne(context.Background(), bson.M{"lang": r.Lang}, r, options.Replace().SetUpsert(true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillRuntime sets the fields of the default runtime that are missing in the saved document,
+// the ones already saved are kept
+func backfillRuntime(langs *mongo.Collection, saved bson.M, r Runtime) error {
+	raw, err := bson.Marshal(r)
+	if err != nil {
+		return err
+	}
+	var defaults bson.M
+	if err := bson.Unmarshal(raw, &defaults); err != nil {
+		return err
+	}
+
+	missing := bson.M{}
+	for field, value := range defaults {
+		if _, found := saved[field]; !found {
+			missing[field] = value
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	_, err = langs.UpdateOne(context.Background(), bson.M{"_id": saved["_id"]}, bson.M{"$set": missing})
+	return err
+}
+
+// loadRuntimes reads the supported runtimes from the langs collection
+func loadRuntimes(db *mongo.Database) ([]Runtime, error) {
+	cur, err := db.Collection("langs").Find(context.Background(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+
+	var runtimes []Runtime
+	if err := cur.All(context.Background(), &runtimes); err != nil {
+		return nil, err
+	}
+	return runtimes, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	//prefix of the encrypted values, the values without it were saved before the encryption
+	secretPrefix = "enc:"
+	//min length of SECRETS_KEY
+	minSecretsKeyLength = 32
+)
+
+// SecretStore encrypts the values saved on the database (envs and database credentials)
+// with aes-gcm, the key is derived from the master key in the configuration
+type SecretStore struct {
+	aead cipher.AEAD
+}
+
+// NewSecretStore creates a store from the master key (SECRETS_KEY), changing the key
+// makes the values already saved unreadable
+func NewSecretStore(masterKey string) (*SecretStore, error) {
+	if len(masterKey) < minSecretsKeyLength {
+		return nil, fmt.Errorf("the secrets key must be at least %d characters long", minSecretsKeyLength)
+	}
+	key := sha256.Sum256([]byte(masterKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretStore{aead: aead}, nil
+}
+
+// Encrypt returns the value encrypted with a random nonce, encoded in base64 with the secret prefix
+func (s *SecretStore) Encrypt(value string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(value), nil)
+	return secretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the value of an encrypted string, the strings without the secret prefix are returned as they are
+func (s *SecretStore) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, secretPrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid secret: %v", err)
+	}
+	if len(sealed) < s.aead.NonceSize() {
+		return "", fmt.Errorf("invalid secret: too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("can't decrypt the secret, has the secrets key changed? %v", err)
+	}
+	return string(plain), nil
+}
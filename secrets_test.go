@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSecretsKey = "0123456789abcdef0123456789abcdef"
+
+func TestSecretStore(t *testing.T) {
+	store, err := NewSecretStore(testSecretsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := store.Encrypt("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, secretPrefix) || strings.Contains(encrypted, "password") {
+		t.Errorf("Encrypt() = %s, not encrypted", encrypted)
+	}
+	if again, _ := store.Encrypt("password"); again == encrypted {
+		t.Errorf("Encrypt() returned the same value twice")
+	}
+
+	decrypted, err := store.Decrypt(encrypted)
+	if err != nil || decrypted != "password" {
+		t.Errorf("Decrypt() = %s, %v, want password", decrypted, err)
+	}
+
+	//the values saved before the encryption are returned as they are
+	if plain, err := store.Decrypt("plain"); err != nil || plain != "plain" {
+		t.Errorf("Decrypt() = %s, %v, want plain", plain, err)
+	}
+
+	other, _ := NewSecretStore(testSecretsKey + "-other")
+	if _, err := other.Decrypt(encrypted); err == nil {
+		t.Errorf("Decrypt() with another key didn't fail")
+	}
+	if _, err := store.Decrypt(secretPrefix + "AAAA"); err == nil {
+		t.Errorf("Decrypt() of a short value didn't fail")
+	}
+}
+
+func TestNewSecretStoreShortKey(t *testing.T) {
+	if _, err := NewSecretStore("short"); err == nil {
+		t.Errorf("NewSecretStore() with a short key didn't fail")
+	}
+}
@@ -57,6 +57,12 @@ $("#giturl").keyup(debounce(async () => {
         option.text = branches[i];
         select.appendChild(option);
     }
+
+    //select the language detected from the repo
+    const detection = data.data.detection;
+    if (detection && detection.lang) {
+        $("#lang").val(detection.lang);
+    }
 }));
 
 function getEnvs() {
@@ -97,12 +103,27 @@ async function createNewApplication() {
         "description": description,
     }
 
+    const dockerfilePath = document.getElementById('dockerfilePath').value;
+    if (lang === "dockerfile" && dockerfilePath !== '') {
+        appObj["dockerfile-path"] = dockerfilePath;
+    }
+
+    const restartPolicy = document.getElementById('restartPolicy').value;
+    if (restartPolicy !== "on-failure") {
+        appObj["restart-policy"] = {"name": restartPolicy};
+    }
+
+    const healthPath = document.getElementById('healthPath').value;
+    if (healthPath !== '') {
+        appObj["health-check"] = {"path": healthPath};
+    }
+
     if (thereAreEnvs() ) {
         appObj.envs = getEnvs();
     }
 
     //check if they are not empty
-    if (url === '' || port === '') {
+    if (url === '') {
         alert('Please fill in all the fields');
         return
     }
@@ -119,8 +140,8 @@ async function createNewApplication() {
     });
     const data = await res.json();
 
-    $("#creationButton").prop("disabled", false);
     if (data.error) {
+        $("#creationButton").prop("disabled", false);
         if (data.code === 498) {
             await newTokenPair(createNewApplication);
         }else{
@@ -128,7 +149,52 @@ async function createNewApplication() {
         }
         return
     }
-    document.getElementById("result").innerText = "applicazione creata con successo, la locazione é: " + data.data.external_port;
+    streamBuildLog(data.data.jobID);
+    await pollDeployJob(data.data.jobID);
+}
+
+//show the build log while the application is being deployed
+function streamBuildLog(jobID) {
+    const buildLog = document.getElementById("buildLog");
+    buildLog.innerText = "";
+    const source = new EventSource('/api/app/jobs/' + jobID + '/logs/stream');
+    source.onmessage = (e) => {
+        buildLog.innerText += e.data + "\n";
+    };
+    //the whole log is sent on every (re)connection
+    source.onopen = () => {
+        buildLog.innerText = "";
+    };
+    source.addEventListener("end", () => source.close());
+}
+
+//poll the deploy job until it's finished
+async function pollDeployJob(jobID) {
+    const res = await fetch('/api/app/jobs/' + jobID);
+    const data = await res.json();
+    if (data.error) {
+        if (data.code === 498) {
+            await newTokenPair(pollDeployJob, jobID);
+        }else{
+            $("#creationButton").prop("disabled", false);
+            alert(data.msg);
+        }
+        return
+    }
+
+    const job = data.data;
+    switch (job.phase) {
+        case "succeeded":
+            $("#creationButton").prop("disabled", false);
+            document.getElementById("result").innerText = "applicazione creata con successo, la locazione é: " + job.url;
+            return
+        case "failed":
+            $("#creationButton").prop("disabled", false);
+            document.getElementById("result").innerText = "errore durante la creazione dell'applicazione: " + job.error;
+            return
+    }
+    document.getElementById("result").innerText = "Stiamo creando la tua applicazione... (" + job.phase + ")";
+    setTimeout(() => pollDeployJob(jobID), 2000);
 }
 
 async function createNewDatabase() {
@@ -47,6 +47,7 @@ async function loadDatabases() {
 
     dbDiv.appendChild(name);
     dbDiv.appendChild(exportBtn);
+    dbDiv.appendChild(powerButton(db));
     dbDiv.appendChild(deleteBtn);
 
     document.getElementById("databasesContainer").appendChild(dbDiv);
@@ -69,6 +70,49 @@ async function deleteContainer(containerId) {
   document.getElementById(containerId).remove();
 }
 
+//button to start or stop a container depending on its status
+function powerButton(container) {
+  //the sleeping applications are started by their next request
+  const running =
+    container.status === "running" || container.status === "sleeping";
+  const powerBtn = document.createElement("button");
+  powerBtn.id = "power" + container.containerID;
+  powerBtn.type = "button";
+  powerBtn.className = running ? "btn btn-secondary" : "btn btn-success";
+  powerBtn.innerText = running ? "Stop" : "Start";
+  powerBtn.setAttribute(
+    "onclick",
+    "powerContainer('" +
+      container.containerID +
+      "', '" +
+      (running ? "stop" : "start") +
+      "')"
+  );
+  return powerBtn;
+}
+
+//action can be start, stop or restart
+async function powerContainer(containerId, action) {
+  const res = await fetch("/api/container/" + action + "/" + containerId, {
+    method: "POST",
+  });
+  const data = await res.json();
+  if (data.error) {
+    if (data.code === 498) {
+      await newTokenPair(powerContainer, containerId, action);
+    }
+    alert(data.error);
+    return;
+  }
+  const powerBtn = document.getElementById("power" + containerId);
+  powerBtn.replaceWith(
+    powerButton({
+      containerID: containerId,
+      status: action === "stop" ? "stopped" : "running",
+    })
+  );
+}
+
 async function loadApplications() {
   const res = await fetch("/api/user/getApps/web");
   const apps = await res.json();
@@ -94,7 +138,7 @@ async function loadApplications() {
     appDiv.className = "doc";
 
     const name = document.createElement("p");
-    name.innerHTML = `<a target="_blank" href="http://localhost:${app.externalPort}">${app.name}</a>`;
+    name.innerHTML = `<a target="_blank" href="${appLocation(app)}">${app.name}</a>`;
 
     const publicBtn = document.createElement("button");
     publicBtn.id = "public" + app.containerID;
@@ -131,6 +175,7 @@ async function loadApplications() {
 
     appDiv.appendChild(name);
     appDiv.appendChild(publicBtn);
+    appDiv.appendChild(powerButton(app));
     appDiv.appendChild(deleteBtn);
     appDiv.appendChild(hr);
     appDiv.appendChild(desc);
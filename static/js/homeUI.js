@@ -18,10 +18,10 @@ function transition(from, to) {
 }
 
 function logout() {
-    //remove accessToken and refreshToken from cookie
-    document.cookie = "ipaas-access-token=; expires=Thu, 01 Jan 1970 00:00:00 UTC; path=/;";
-    document.cookie = "ipaas-refresh-token=; expires=Thu, 01 Jan 1970 00:00:00 UTC; path=/;";
-    window.location.href = "/login";
+    //the token cookies are http only, the server removes them
+    fetch("/api/logout", { method: "POST" }).finally(() => {
+        window.location.href = "/login";
+    });
 }
 
 function logoutconfirm(x) {
@@ -30,11 +30,10 @@ async function loadApplications() {
     const app = apps.data[i];
 
     const appDiv = document.createElement("div");
-    appDiv.id = app.containerID;
     appDiv.className = "doc";
 
     const name = document.createElement("p");
-    name.innerHTML = `<a target="_blank" href="http://localhost:${app.externalPort}">${app.name}</a>`;
+    name.innerHTML = `<a target="_blank" href="${appLocation(app)}">${app.name}</a>`;
 
     const hr = document.createElement("hr");
 
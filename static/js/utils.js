@@ -15,4 +15,12 @@ function debounce(func, timeout = 600){
         clearTimeout(timer);
         timer = setTimeout(() => { func.apply(this, args); }, timeout);
     };
-}
\ No newline at end of file
+}
+
+//the applications are reached through the proxy, the ones created before it still have a port
+function appLocation(app) {
+    if (app.url) {
+        return app.url;
+    }
+    return `http://localhost:${app.externalPort}`;
+}
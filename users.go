@@ -12,12 +12,14 @@ import (
 
 type Student struct {
 	// MID      primitive.ObjectID `bson:"_id" json:"-"`
-	ID       int    `bson:"userID" json:"matricola"` //id of the student (teachers will use the same, but it's 6 digit long instead of 5)
-	Name     string `bson:"name" json:"nome"`        //name of the student
-	LastName string `bson:"lastName" json:"cognome"` //last name of the student
-	Email    string `bson:"email" json:"email"`      //email of the student
-	Pfp      string `bson:"pfp" json:"pfp"`          //profile picture of the student (autogenerated)
-	IsMock   bool   `bson:"isMock" json:"isMock"`    //if the user is a mock user (used for testing)
+	ID       int             `bson:"userID" json:"matricola"`   //id of the student (teachers will use the same, but it's 6 digit long instead of 5)
+	Name     string          `bson:"name" json:"nome"`          //name of the student
+	LastName string          `bson:"lastName" json:"cognome"`   //last name of the student
+	Email    string          `bson:"email" json:"email"`        //email of the student
+	Pfp      string          `bson:"pfp" json:"pfp"`            //profile picture of the student (autogenerated)
+	IsMock   bool            `bson:"isMock" json:"isMock"`      //if the user is a mock user (used for testing)
+	Limits   *ResourceLimits `bson:"limits,omitempty" json:"-"` //overrides of the resource limits of the user's containers (set by the admins)
+	Quota    *Quota          `bson:"quota,omitempty" json:"-"`  //overrides of the quota of the user (set by the admins)
 	// Applications []string `bson:"applications" json:"applications"` //list of the applications of the student
 }
 
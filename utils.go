@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/tidwall/gjson"
 	"io"
-	"math/rand"
+	"math/big"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -133,14 +135,24 @@ func (u Util) DownloadGithubRepo(userID int, branch, url string) (string, string
 	fmt.Println("ok")
 	fmt.Println("repo name:", repoName)
 
-	//get the repo name
-	tmpPath := fmt.Sprintf("./tmp/%d-%s-%s", userID, repoName, branch)
-	err = os.Mkdir(tmpPath, os.ModePerm)
+	//every download gets its own folder (<userID>-<repo>-<random>), so the jobs of the same repo
+	//and branch running at the same time don't use or remove each other's files
+	if err := os.MkdirAll("./tmp", os.ModePerm); err != nil {
+		return "", "", "", fmt.Errorf("error creating the tmp folder: %v", err)
+	}
+	tmpPath, err := os.MkdirTemp("./tmp", fmt.Sprintf("%d-%s-", userID, repoName))
 	if err != nil {
 		return "", "", "", fmt.Errorf("error creating the tmp folder: %v", err)
 	}
+	//the folder is removed by the caller only if the download succeeds
+	fail := func(err error) (string, string, string, error) {
+		fmt.Println("err")
+		os.RemoveAll(tmpPath)
+		return "", "", "", err
+	}
+
 	fmt.Printf("downloading repo in %s...", tmpPath)
-	r, err := git.PlainClone(fmt.Sprintf("%s", tmpPath), false, &git.CloneOptions{
+	r, err := git.PlainClone(tmpPath, false, &git.CloneOptions{
 		URL:           url,
 		Depth:         1,
 		SingleBranch:  true,
@@ -148,14 +160,13 @@ func (u Util) DownloadGithubRepo(userID int, branch, url string) (string, string
 		// Progress: os.Stdout,
 	})
 	if err != nil {
-		fmt.Println("err")
-		return "", "", "", err
+		return fail(err)
 	}
 	fmt.Println("ok")
 
 	logs, err := r.Log(&git.LogOptions{})
 	if err != nil {
-		return "", "", "", err
+		return fail(err)
 	}
 	defer logs.Close()
 
@@ -163,19 +174,17 @@ func (u Util) DownloadGithubRepo(userID int, branch, url string) (string, string
 	fmt.Print("getting last commit hash...")
 	commitHash, err := logs.Next()
 	if err != nil {
-		fmt.Println("err")
-		return "", "", "", err
+		return fail(err)
 	}
 	fmt.Println("ok")
 
 	//remove the .git folder
 	fmt.Print("removing .git...")
 	if err := os.RemoveAll(fmt.Sprintf("%s/.git", tmpPath)); err != nil {
-		fmt.Println("err")
-		return "", "", "", err
+		return fail(err)
 	}
 	fmt.Println("ok")
-	return fmt.Sprintf("%s", tmpPath), repoName, commitHash.Hash.String(), nil
+	return tmpPath, repoName, commitHash.Hash.String(), nil
 }
 
 // GetMetadataFromRepo gets the description, default branch and all the branches of a GitHub repository
@@ -225,6 +234,41 @@ func (u Util) GetMetadataFromRepo(url string) (description, defaultBranch string
 	return description, defaultBranch, branches, nil
 }
 
+// GetRootFilesFromRepo returns the names of the files in the root of a GitHub repository for the given branch,
+// if the branch is empty the default one is used
+func (u Util) GetRootFilesFromRepo(repoUrl, branch string) ([]string, error) {
+	username, repoName, err := u.GetUserAndNameFromRepoUrl(repoUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	contentsUrl := fmt.Sprintf("https://api.github.com/repos/%s/%s/contents", url.PathEscape(username), url.PathEscape(repoName))
+	if branch != "" {
+		//the branch names can contain characters like # and &
+		contentsUrl += "?ref=" + url.QueryEscape(branch)
+	}
+	resp, err := http.Get(contentsUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("error reading the content of the repository: %v", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, f := range gjson.Get(string(body), `#(type=="file")#.name`).Array() {
+		files = append(files, f.String())
+	}
+	return files, nil
+}
+
 // HasLastCommitChanged will check if the last commit of a GitHub url is different from the given to the function
 // TODO: should read just the last one not all the commits in the json
 func (u Util) HasLastCommitChanged(commit, url, branch string) (bool, error) {
@@ -303,6 +347,12 @@ func initDatabase(db *mongo.Database) error {
 		"oauthStates",
 		"pollingIDs",
 		"refreshTokens",
+		"deployJobs",
+		"releases",
+		"appEvents",
+		"domains",
+		"metrics",
+		"execSessions",
 	}
 	existingCollections, err := db.ListCollectionNames(context.Background(), bson.D{{}})
 	if err != nil {
@@ -330,19 +380,47 @@ func initDatabase(db *mongo.Database) error {
 		}
 	}
 
-	langs, err := db.Collection("langs").CountDocuments(context.Background(), bson.M{})
-	if err != nil {
+	if err := ensureIndexes(db); err != nil {
 		return err
 	}
-	if langs == 0 {
-		//insert langs
-		if _, err := db.Collection("langs").InsertMany(context.Background(), []interface{}{
-			bson.M{"lang": "go"},
-		}); err != nil {
-			return err
+
+	//insert the supported runtimes
+	return seedRuntimes(db)
+}
+
+// error code returned by mongo when an index exists with the same keys and different options
+const indexOptionsConflictCode = 85
+
+// ensureIndexes creates the indexes of the collections that grow with the usage,
+// the ones that already exist are left as they are
+func ensureIndexes(db *mongo.Database) error {
+	indexes := map[string][]mongo.IndexModel{
+		//the metrics are always read by application in a range of time
+		"metrics": {{Keys: bson.D{{Key: "applicationID", Value: 1}, {Key: "time", Value: 1}}}},
+		//the events are removed by mongo after the retention
+		"appEvents": {{
+			Keys:    bson.D{{Key: "time", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(eventsRetention() / time.Second)),
+		}},
+	}
+
+	for collection, models := range indexes {
+		fmt.Printf("creating the indexes of %s\n", collection)
+		for _, model := range models {
+			_, err := db.Collection(collection).Indexes().CreateOne(context.Background(), model)
+			var cmdErr mongo.CommandError
+			if errors.As(err, &cmdErr) && cmdErr.Code == indexOptionsConflictCode && model.Options != nil && model.Options.ExpireAfterSeconds != nil {
+				//the retention changed since the index was created, its ttl is updated
+				err = db.RunCommand(context.Background(), bson.D{
+					{Key: "collMod", Value: collection},
+					{Key: "index", Value: bson.M{"keyPattern": model.Keys, "expireAfterSeconds": *model.Options.ExpireAfterSeconds}},
+				}).Err()
+			}
+			if err != nil {
+				return fmt.Errorf("error creating the indexes of %s: %v", collection, err)
+			}
 		}
 	}
-
 	return nil
 }
 
@@ -352,33 +430,43 @@ func generateRandomString(size int) string {
 	minUpperCase := 4
 	passwordLength := size
 
-	rand.Seed(time.Now().UnixNano())
 	var password strings.Builder
 
 	//Set numeric
 	for i := 0; i < minNum; i++ {
-		random := rand.Intn(len(numberSet))
+		random := randomIndex(len(numberSet))
 		password.WriteString(string(numberSet[random]))
 	}
 
 	//Set uppercase
 	for i := 0; i < minUpperCase; i++ {
-		random := rand.Intn(len(upperCharSet))
+		random := randomIndex(len(upperCharSet))
 		password.WriteString(string(upperCharSet[random]))
 	}
 
 	remainingLength := passwordLength - minNum - minUpperCase
 	for i := 0; i < remainingLength; i++ {
-		random := rand.Intn(len(allCharSet))
+		random := randomIndex(len(allCharSet))
 		password.WriteString(string(allCharSet[random]))
 	}
 	inRune := []rune(password.String())
-	rand.Shuffle(len(inRune), func(i, j int) {
+	for i := len(inRune) - 1; i > 0; i-- {
+		j := randomIndex(i + 1)
 		inRune[i], inRune[j] = inRune[j], inRune[i]
-	})
+	}
 	return string(inRune)
 }
 
+// randomIndex returns a number in [0, n) read from crypto/rand, the strings generated
+// are used as passwords and tokens so they must not be predictable
+func randomIndex(n int) int {
+	random, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic("error reading random bytes: " + err.Error())
+	}
+	return int(random.Int64())
+}
+
 // return a random open port on the host
 func getFreePort() (int, error) {
 	//:0 is the kernel port to get a free port